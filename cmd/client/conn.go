@@ -2,13 +2,18 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strings"
 	"sync"
+
+	"github.com/recyvan/smf/internal/protocol"
+	"golang.org/x/term"
 )
 
 type Conn struct {
@@ -16,7 +21,13 @@ type Conn struct {
 	addr     []string
 	ConnAddr map[string]net.Conn
 	activeID string
-	mu       sync.Mutex //还是没有搞清楚io重定向在终端的影响，这里通过AI询问解决了打印和输入冲突的问题，但是服务端还没有解决但是没关系可以正常运行
+	raw      bool                    // 是否处于原始模式(伪终端会话)
+	rawState *term.State             // 进入原始模式前的终端状态
+	detach   *protocol.DetachMatcher // 与任务交互时识别断开按键，未交互时为 nil
+	mu       sync.Mutex              //还是没有搞清楚io重定向在终端的影响，这里通过AI询问解决了打印和输入冲突的问题，但是服务端还没有解决但是没关系可以正常运行
+
+	// StderrMode 标准错误的显示方式: prefix 添加 [stderr] 前缀，color 红色显示，plain 原样显示
+	StderrMode string
 }
 
 type jsonMessage struct {
@@ -93,38 +104,197 @@ func (conn *Conn) Connect(addr, username, token string) {
 }
 
 func (conn *Conn) handleServerMessages(UserConn net.Conn) {
-	serverScanner := bufio.NewScanner(UserConn)
+	var parser protocol.Parser
+	var line, errLine []byte
+	buf := make([]byte, 4096)
 	fmt.Printf("@%s->", conn.activeID)
 	os.Stdout.Sync()
-	for serverScanner.Scan() {
-		serverData := serverScanner.Text()
-		if serverData != "\n" {
+	for {
+		n, err := UserConn.Read(buf)
+		parser.FeedFunc(buf[:n], func(data []byte) {
 			conn.mu.Lock()
-			fmt.Printf("\r%s\n", serverData)
-			//fmt.Printf("@%s->", conn.activeID)
+			defer conn.mu.Unlock()
+			// 原始模式下输出原样交给终端
+			if conn.raw {
+				os.Stdout.Write(data)
+				return
+			}
+			line = append(line, data...)
+			for {
+				idx := bytes.IndexByte(line, '\n')
+				if idx < 0 {
+					break
+				}
+				fmt.Printf("\r%s\n", line[:idx])
+				line = line[idx+1:]
+			}
 			os.Stdout.Sync()
-			conn.mu.Unlock()
-		} else {
-			conn.mu.Lock()
+		}, func(frame protocol.Frame) {
+			if frame.Kind == protocol.FrameStderr {
+				data, err := protocol.DecodeStderr(frame.Payload)
+				if err != nil {
+					return
+				}
+				conn.mu.Lock()
+				defer conn.mu.Unlock()
+				if conn.raw {
+					os.Stderr.Write(data)
+					return
+				}
+				errLine = append(errLine, data...)
+				for {
+					idx := bytes.IndexByte(errLine, '\n')
+					if idx < 0 {
+						break
+					}
+					conn.printStderr(errLine[:idx])
+					errLine = errLine[idx+1:]
+				}
+				return
+			}
+			if frame.Kind == protocol.FrameInteract {
+				conn.handleInteract(UserConn, frame.Payload)
+				return
+			}
+			if frame.Kind == protocol.FrameNotify {
+				text, err := protocol.DecodeNotify(frame.Payload)
+				if err != nil {
+					return
+				}
+				conn.printNotify(text)
+				return
+			}
+			if frame.Kind == protocol.FrameRawMode {
+				if frame.Payload == "on" {
+					conn.mu.Lock()
+					os.Stdout.Write(line)
+					line = line[:0]
+					conn.mu.Unlock()
+					conn.enterRawMode(UserConn)
+				} else {
+					conn.leaveRawMode(UserConn)
+				}
+			}
+		})
+		if err != nil {
+			conn.leaveRawMode(nil)
 			fmt.Printf("@%s->", conn.activeID)
 			os.Stdout.Sync()
-			conn.mu.Unlock()
+			if err != io.EOF {
+				conn.mu.Lock()
+				fmt.Printf("[!] Error reading from server: %v\n", err)
+				os.Stdout.Sync()
+				conn.mu.Unlock()
+			}
+			return
 		}
-		//conn.mu.Lock()
-		//fmt.Printf("\r%s\n", serverData)
-		////fmt.Printf("@%s->", conn.activeID)
-		//os.Stdout.Sync()
-		//conn.mu.Unlock()
 	}
-	fmt.Printf("@%s->", conn.activeID)
+}
+
+// printStderr 按 StderrMode 输出一行标准错误，调用方需持有 conn.mu
+func (conn *Conn) printStderr(line []byte) {
+	switch conn.StderrMode {
+	case "color":
+		fmt.Fprintf(os.Stderr, "\r\x1b[31m%s\x1b[0m\n", line)
+	case "plain":
+		fmt.Fprintf(os.Stderr, "\r%s\n", line)
+	default:
+		fmt.Fprintf(os.Stderr, "\r[stderr] %s\n", line)
+	}
+	os.Stderr.Sync()
+}
+
+// printNotify 在单独的一行显示服务端推送的任务事件，之后重新显示提示符
+func (conn *Conn) printNotify(text string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.raw {
+		fmt.Fprintf(os.Stdout, "\r\n[notify] %s\r\n", text)
+		return
+	}
+	fmt.Printf("\r\x1b[K[notify] %s\n@%s->", text, conn.activeID)
 	os.Stdout.Sync()
-	if err := serverScanner.Err(); err != nil {
+}
+
+// enterRawMode 将本地终端切换为原始模式，按键直接转发给服务端
+func (conn *Conn) enterRawMode(UserConn net.Conn) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.raw {
+		return
+	}
+	conn.raw = true
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		if state, err := term.MakeRaw(fd); err == nil {
+			conn.rawState = state
+		}
+	}
+	if rows, cols, ok := terminalSize(); ok {
+		UserConn.Write(protocol.EncodeWinsize(rows, cols))
+	}
+}
+
+// leaveRawMode 恢复本地终端，并向服务端确认已退出原始模式
+func (conn *Conn) leaveRawMode(UserConn net.Conn) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if !conn.raw {
+		return
+	}
+	conn.raw = false
+	if conn.rawState != nil {
+		term.Restore(int(os.Stdin.Fd()), conn.rawState)
+		conn.rawState = nil
+	}
+	if UserConn != nil {
+		protocol.WriteFrame(UserConn, protocol.FrameRawMode, "off")
+	}
+	fmt.Println()
+}
+
+// handleInteract 处理服务端的交互帧: on 时按服务端给出的按键识别断开，off 时退出原始模式并回送确认
+func (conn *Conn) handleInteract(UserConn net.Conn, payload string) {
+	state, spec, _ := strings.Cut(payload, ";")
+	if state == "on" {
+		keys, err := protocol.ParseDetachKeys(spec)
+		if err != nil {
+			return
+		}
 		conn.mu.Lock()
-		fmt.Printf("[!] Error reading from server: %v\n", err)
-		//fmt.Printf("@%s->", conn.activeID)
-		os.Stdout.Sync()
+		conn.detach = protocol.NewDetachMatcher(keys)
 		conn.mu.Unlock()
+		return
+	}
+
+	conn.mu.Lock()
+	conn.detach = nil
+	conn.mu.Unlock()
+	conn.leaveRawMode(UserConn)
+	protocol.WriteFrame(UserConn, protocol.FrameInteract, "off")
+}
+
+// sendWinsize 原始模式下向当前连接上报终端窗口大小
+func (conn *Conn) sendWinsize() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if !conn.raw {
+		return
+	}
+	UserConn, exists := conn.ConnAddr[conn.activeID]
+	if !exists {
+		return
+	}
+	if rows, cols, ok := terminalSize(); ok {
+		UserConn.Write(protocol.EncodeWinsize(rows, cols))
+	}
+}
+
+func terminalSize() (rows, cols int, ok bool) {
+	cols, rows, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return 0, 0, false
 	}
+	return rows, cols, true
 }
 
 func (conn *Conn) ListConn() {
@@ -160,54 +330,97 @@ func (conn *Conn) ChangeConn(connID string) {
 }
 
 func Run(conn *Conn) {
-	scanner := bufio.NewScanner(os.Stdin)
+	conn.watchWindowSize()
 	fmt.Fprintf(os.Stdout, "The management commands for conn connection are: listconn, closeconn, changeconn!\n")
 	fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
 	os.Stdout.Sync()
-	for scanner.Scan() {
-		input := scanner.Text()
-		parts := strings.Fields(input)
-		if len(parts) == 0 {
-			fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
-			os.Stdout.Sync()
-			continue
-		}
+	var line []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			conn.mu.Lock()
+			raw := conn.raw
+			detach := conn.detach
+			UserConn, exists := conn.ConnAddr[conn.activeID]
+			conn.mu.Unlock()
 
-		switch parts[0] {
-		case "listconn":
-			conn.ListConn()
-		case "closeconn":
-			if len(parts) < 2 {
-				fmt.Printf("@%s-> Usage: closeconn <conn.ID>\n", conn.activeID)
-				fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
-				os.Stdout.Sync()
+			// 与任务交互时识别断开按键，按键本身不转发
+			data, detached := buf[:n], false
+			if detach != nil && exists {
+				data, detached = detach.Scan(data)
+			}
+			// 原始模式下按键原样转发
+			if raw && exists {
+				UserConn.Write(data)
+				if detached {
+					protocol.WriteFrame(UserConn, protocol.FrameDetach, "")
+				}
 				continue
 			}
-			conn.CloseConn(parts[1])
-		case "changeconn":
-			if len(parts) < 2 {
-				fmt.Printf("@%s-> Usage: changeconn <conn.ID>\n", conn.activeID)
-				fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
-				os.Stdout.Sync()
+			if detached {
+				line = line[:0]
+				protocol.WriteFrame(UserConn, protocol.FrameDetach, "")
 				continue
 			}
-			conn.ChangeConn(parts[1])
-		default:
-			if UserConn, exists := conn.ConnAddr[conn.activeID]; exists {
-				if _, err := fmt.Fprintln(UserConn, input); err != nil {
-					fmt.Printf("[!] Error sending to server: %v\n", err)
-					fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
-					os.Stdout.Sync()
-					break
-				}
-				if input == "exit" {
+
+			line = append(line, data...)
+			for {
+				idx := bytes.IndexByte(line, '\n')
+				if idx < 0 {
 					break
 				}
-			} else {
-				fmt.Printf("No active connection\n")
+				input := strings.TrimRight(string(line[:idx]), "\r")
+				line = line[idx+1:]
+				conn.handleInput(input)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+// handleInput 处理一行用户输入
+func (conn *Conn) handleInput(input string) {
+	// 空行同样转发给服务端，交互中的任务或 watch 可能在等待回车
+	parts := strings.Fields(input)
+	name := ""
+	if len(parts) > 0 {
+		name = parts[0]
+	}
+
+	switch name {
+	case "listconn":
+		conn.ListConn()
+	case "closeconn":
+		if len(parts) < 2 {
+			fmt.Printf("@%s-> Usage: closeconn <conn.ID>\n", conn.activeID)
+			fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
+			os.Stdout.Sync()
+			return
+		}
+		conn.CloseConn(parts[1])
+	case "changeconn":
+		if len(parts) < 2 {
+			fmt.Printf("@%s-> Usage: changeconn <conn.ID>\n", conn.activeID)
+			fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
+			os.Stdout.Sync()
+			return
+		}
+		conn.ChangeConn(parts[1])
+	default:
+		if UserConn, exists := conn.ConnAddr[conn.activeID]; exists {
+			if _, err := fmt.Fprintln(UserConn, input); err != nil {
+				fmt.Printf("[!] Error sending to server: %v\n", err)
+				fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
+				os.Stdout.Sync()
+				break
 			}
+		} else {
+			fmt.Printf("No active connection\n")
 		}
-		fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
-		os.Stdout.Sync()
 	}
+	fmt.Fprintf(os.Stdout, "@%s->", conn.activeID)
+	os.Stdout.Sync()
 }
@@ -11,8 +11,10 @@ func main() {
 	addr := flag.String("h", "127.0.0.1:8080", "server address")
 	username := flag.String("u", "1234", "username")
 	password := flag.String("p", "1234", "password")
+	stderrMode := flag.String("stderr", "prefix", "stderr rendering: prefix, color or plain")
 	flag.Parse()
 	client := NewConn()
+	client.StderrMode = *stderrMode
 	client.Connect(*addr, *username, *password)
 	Run(client)
 	//test_main()
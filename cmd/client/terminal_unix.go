@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchWindowSize 监听终端窗口大小变化并转发给服务端
+func (conn *Conn) watchWindowSize() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	go func() {
+		for range ch {
+			conn.sendWinsize()
+		}
+	}()
+}
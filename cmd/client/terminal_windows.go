@@ -0,0 +1,6 @@
+//go:build windows
+
+package main
+
+// watchWindowSize Windows 下没有 SIGWINCH，不转发窗口大小变化
+func (conn *Conn) watchWindowSize() {}
@@ -8,16 +8,18 @@ import (
 	"github.com/recyvan/smf/internal/commands/backgroundcommands"
 	"github.com/recyvan/smf/internal/commands/corecommands"
 	"github.com/recyvan/smf/internal/commands/customcommands"
+	"github.com/recyvan/smf/internal/protocol"
 	"github.com/recyvan/smf/plugins"
 	"io"
 	"net"
 	"os"
-	"strings"
 )
 
 type ReadWriter struct {
 	Reader io.Reader
 	Writer io.Writer
+	out    *protocol.EscapeWriter
+	stderr io.Writer
 }
 
 // PluginCommandProvider 插件命令提供者
@@ -29,22 +31,38 @@ func (p *PluginCommandProvider) ProvideCommands() []command.Ecommand {
 	return p.commands
 }
 
-func enginInit() *command.LocalEngine {
+func enginInit(historyFile, logDir, scheduleFile, interpreterFile string) *command.LocalEngine {
 
 	engine_1 := command.NewLocalEngine()
 
 	// 创建TaskManager
-	_, err := backgroundcommands.NewTaskManager(10)
+	_, err := backgroundcommands.NewTaskManager(10, engine_1.CmdRegistry)
 	if err != nil {
 		fmt.Printf("Error creating task manager: %v\n", err)
 		os.Exit(1)
 	}
 	//// 创建并添加基础命令提供者
 	basicCommands, err := backgroundcommands.NewBasicCommands(engine_1.CmdRegistry)
+	if err != nil {
+		fmt.Printf("Error creating basic commands: %v\n", err)
+		os.Exit(1)
+	}
+	if err := basicCommands.SetHistoryFile(historyFile); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	if adopted := basicCommands.SetLogDir(logDir); adopted > 0 {
+		fmt.Printf("Adopted %d detached task(s)\n", adopted)
+	}
+	if err := basicCommands.SetScheduleFile(scheduleFile); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
 	// 创建并添加自定义命令提供者
 	customCommands := customcommands.NewCustomCommands()
 	// 创建并添加核心命令提供者
 	coreCommands := corecommands.NewCoreCommands(engine_1.CmdRegistry)
+	if err := coreCommands.SetInterpreterFile(interpreterFile); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
 	// 注册并包装命令
 	//注册未编译插件的命令
 	pluginCommands := plugins.NewPluginCommand()
@@ -68,12 +86,18 @@ func enginInit() *command.LocalEngine {
 	engine_1.AutoReg.RegisterAll(engine_1.CmdRegistry)
 	return engine_1
 }
-func Run(engine *command.LocalEngine, conn net.Conn) {
+
+// Run 处理一个连接的命令，命令的 context 携带该连接的用户会话
+func Run(engine *command.LocalEngine, conn net.Conn, session command.Session) {
 	// 进行本地io重定向
-	rw := NewReadWriter(conn, conn)
+	// 通过可中断的读取协程读取连接，命令在协程中读取输入时可以在返回前让其退出
+	input := protocol.NewInterruptibleReader(conn)
+	defer input.Close()
+	rw := NewReadWriter(input, conn)
 	fmt.Fprintln(rw, "Engine Core v1.0.0 (2025-03-15)")
 	fmt.Fprintln(rw, "Type 'help' for available commands")
 	defer conn.Close()
+	ctx := command.WithSession(context.Background(), session)
 	scanner := bufio.NewScanner(rw.Reader)
 	for {
 		fmt.Fprint(rw, ">")
@@ -81,8 +105,12 @@ func Run(engine *command.LocalEngine, conn net.Conn) {
 			break
 		}
 
-		input := scanner.Text()
-		parts := strings.Fields(input)
+		input, background := command.CutBackground(scanner.Text())
+		parts, err := command.SplitArgs(input)
+		if err != nil {
+			fmt.Fprintf(rw, "Error: %v\n", err)
+			continue
+		}
 		if len(parts) == 0 {
 			continue
 		}
@@ -95,7 +123,10 @@ func Run(engine *command.LocalEngine, conn net.Conn) {
 
 		cmd, exists := engine.CmdRegistry.Get(cmdName)
 		if exists {
-			_, err := cmd.Handler(rw, context.Background(), args)
+			cmd, args, err := engine.CmdRegistry.Prepare(cmd, args, background)
+			if err == nil {
+				_, err = cmd.Handler(rw, ctx, args)
+			}
 			if err != nil {
 				fmt.Fprintf(rw, "Error: %v\n", err)
 			}
@@ -112,6 +143,8 @@ func NewReadWriter(reader io.Reader, writer io.Writer) *ReadWriter {
 	return &ReadWriter{
 		Reader: reader,
 		Writer: writer,
+		out:    protocol.NewEscapeWriter(writer),
+		stderr: protocol.NewStderrWriter(writer),
 	}
 }
 
@@ -120,7 +153,30 @@ func (rw *ReadWriter) Read(p []byte) (n int, err error) {
 	return rw.Reader.Read(p)
 }
 
-// 实现 io.Writer 接口
+// 实现 io.Writer 接口，输出中可能伪造控制帧的内容被转义
 func (rw *ReadWriter) Write(p []byte) (n int, err error) {
-	return rw.Writer.Write(p)
+	return rw.out.Write(p)
+}
+
+// WriteRawFrame 控制帧原样发送给客户端
+func (rw *ReadWriter) WriteRawFrame(frame []byte) error {
+	return rw.out.WriteRawFrame(frame)
+}
+
+// SupportsFrames 远程客户端能够处理控制帧
+func (rw *ReadWriter) SupportsFrames() bool {
+	return true
+}
+
+// InterruptRead 中断阻塞中的 Read，未读取的输入留给之后的命令
+func (rw *ReadWriter) InterruptRead() (func(), bool) {
+	if input, ok := rw.Reader.(*protocol.InterruptibleReader); ok {
+		return input.Interrupt(), true
+	}
+	return nil, false
+}
+
+// Stderr 标准错误输出以单独的帧发送给客户端
+func (rw *ReadWriter) Stderr() io.Writer {
+	return rw.stderr
 }
@@ -24,6 +24,9 @@ package main
 import (
 	"flag"
 	"strconv"
+
+	"github.com/recyvan/smf/internal/commands/backgroundcommands"
+	"github.com/recyvan/smf/internal/commands/corecommands"
 )
 
 func test_main() {
@@ -35,8 +38,16 @@ func main() {
 	certFile := flag.String("sc", "server.crt", "Path to the server certificate")
 	keyFile := flag.String("sk", "server.key", "Path to the server key")
 	port := flag.Int("p", 8080, "Port to listen on")
+	historyFile := flag.String("history", backgroundcommands.DefaultHistoryFile, "Path to persist background task history (empty keeps it in memory)")
+	logDir := flag.String("logdir", backgroundcommands.DefaultTaskLogDir, "Directory for background task output logs (empty keeps output in memory)")
+	scheduleFile := flag.String("schedules", backgroundcommands.DefaultScheduleFile, "Path to persist scheduled jobs (empty keeps them in memory)")
+	interpreterFile := flag.String("interpreters", corecommands.DefaultInterpreterConfig, "Path to the interpreter config for the run command (empty uses only the built-in interpreters)")
 	flag.Parse()
 	serverconn := NewConn()
+	serverconn.HistoryFile = *historyFile
+	serverconn.LogDir = *logDir
+	serverconn.ScheduleFile = *scheduleFile
+	serverconn.InterpreterFile = *interpreterFile
 	server_host := "0.0.0.0" + ":" + strconv.Itoa(*port)
 	serverconn.ListenAndServe(server_host, *certFile, *keyFile)
 	//test_main()
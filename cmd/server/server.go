@@ -17,6 +17,15 @@ type Conn struct {
 	User    []string
 	conn    []net.Conn
 	ConnMap map[string]net.Conn
+
+	// HistoryFile 后台任务历史的持久化文件，为空时只保存在内存中
+	HistoryFile string
+	// LogDir 后台任务输出日志的目录，为空时输出只保留在内存中
+	LogDir string
+	// ScheduleFile 定时任务的持久化文件，为空时只保存在内存中
+	ScheduleFile string
+	// InterpreterFile run 命令额外解释器的配置文件，为空时只使用内置解释器
+	InterpreterFile string
 }
 
 type jsonMessage struct {
@@ -39,7 +48,7 @@ func NewConn() *Conn {
 
 func (c *Conn) ListenAndServe(addr string, certFile string, keyFile string) {
 	//初始化引擎
-	engine := enginInit()
+	engine := enginInit(c.HistoryFile, c.LogDir, c.ScheduleFile, c.InterpreterFile)
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		fmt.Println("[!] Error loading certificates:", err)
@@ -74,7 +83,8 @@ func (c *Conn) ConnUserRegister(conn net.Conn, engine *command.LocalEngine) {
 		return
 	}
 
-	if checkToken(tempdata.Username, tempdata.Token) {
+	admin, ok := checkToken(tempdata.Username, tempdata.Token)
+	if ok {
 		connID := fmt.Sprintf("%s-%d", tempdata.Username, len(c.conn))
 		resp := response{Status: "ok", ID: connID}
 		respData, _ := json.Marshal(resp)
@@ -86,28 +96,43 @@ func (c *Conn) ConnUserRegister(conn net.Conn, engine *command.LocalEngine) {
 		c.Unlock()
 
 		fmt.Printf("[-] New user %s connected with ID %s\n", tempdata.Username, connID)
+		Run(engine, conn, command.Session{User: tempdata.Username, ID: connID, Admin: admin})
 	} else {
 		resp := response{Status: "error"}
 		respData, _ := json.Marshal(resp)
 		conn.Write(append(respData, '\n'))
 		conn.Close()
 	}
-	Run(engine, conn)
 }
 
-func checkToken(username, token string) bool {
+// checkToken 校验用户口令，返回用户是否为管理员以及口令是否正确
+// token.txt 每行格式为 用户名:口令[:admin]
+func checkToken(username, token string) (bool, bool) {
 	file, err := os.Open("./token.txt")
 	//data, err := ioutil.ReadFile("token.txt")
 	if err != nil {
-		return false
+		return false, false
 	}
 	//读取token.txt文件，并按行分割
 	data, err := ioutil.ReadAll(file)
 	lines := strings.Split(string(data), "\n")
 	for _, line := range lines {
-		if line == username+":"+token {
-			return true
+		if admin, ok := matchToken(strings.TrimSpace(line), username, token); ok {
+			return admin, true
 		}
 	}
-	return false
+	return false, false
+}
+
+// matchToken 校验 token.txt 中的一行，口令中可以含有冒号，末尾的 :admin 表示管理员而不属于口令
+func matchToken(line, username, token string) (bool, bool) {
+	name, secret, found := strings.Cut(line, ":")
+	if !found || name != username {
+		return false, false
+	}
+	secret, admin := strings.CutSuffix(secret, ":admin")
+	if secret != token {
+		return false, false
+	}
+	return admin, true
 }
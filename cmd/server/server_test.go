@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestMatchToken(t *testing.T) {
+	for _, tc := range []struct {
+		line, user, token string
+		admin, ok         bool
+	}{
+		{"bob:pw", "bob", "pw", false, true},
+		{"root:rootpw:admin", "root", "rootpw", true, true},
+		{"bob:a:b:c", "bob", "a:b:c", false, true},
+		{"root:a:b:admin", "root", "a:b", true, true},
+		{"bob:a:b:c", "bob", "a", false, false},
+		{"root:rootpw:admin", "root", "rootpw:admin", false, false},
+		{"bob:pw", "alice", "pw", false, false},
+		{"bob", "bob", "", false, false},
+	} {
+		admin, ok := matchToken(tc.line, tc.user, tc.token)
+		if admin != tc.admin || ok != tc.ok {
+			t.Errorf("matchToken(%q, %q, %q) = %v, %v; want %v, %v", tc.line, tc.user, tc.token, admin, ok, tc.admin, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//go:build !windows
+
+// smf-shim 以独立进程运行后台任务的命令，服务端退出或重启后命令不受影响
+// 命令的标准输出和标准错误写入任务目录中的日志文件，标准输入来自任务目录中的命名管道，
+// 命令结束后将退出状态写入 status.json，重启后的服务端据此接管或记录任务
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// exitStatus 写入 status.json 的退出状态
+type exitStatus struct {
+	ExitCode int       `json:"exit_code"`
+	Signal   string    `json:"signal,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	EndTime  time.Time `json:"end_time"`
+}
+
+func main() {
+	dir := flag.String("dir", "", "task state directory")
+	stdin := flag.Bool("stdin", false, "read command input from the stdin pipe in the task directory")
+	flag.Parse()
+	if *dir == "" || flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: smf-shim -dir <task dir> [-stdin] -- <command> [args...]")
+		os.Exit(2)
+	}
+	os.Exit(run(*dir, *stdin, flag.Args()))
+}
+
+func run(dir string, stdin bool, args []string) int {
+	status := exitStatus{ExitCode: 127}
+	defer func() {
+		status.EndTime = time.Now()
+		writeStatus(dir, status)
+	}()
+
+	stdout, err := os.OpenFile(filepath.Join(dir, "stdout.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		status.Error = err.Error()
+		return status.ExitCode
+	}
+	defer stdout.Close()
+	stderr, err := os.OpenFile(filepath.Join(dir, "stderr.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		status.Error = err.Error()
+		return status.ExitCode
+	}
+	defer stderr.Close()
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if stdin {
+		// 以读写方式打开命名管道，服务端不在时读取会阻塞而不是收到 EOF
+		input, err := os.OpenFile(filepath.Join(dir, "stdin"), os.O_RDWR, 0)
+		if err != nil {
+			status.Error = err.Error()
+			return status.ExitCode
+		}
+		defer input.Close()
+		cmd.Stdin = input
+	}
+
+	// 服务端向整个进程组发送信号，shim 自身只需等待命令退出后记录状态
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	if err := cmd.Start(); err != nil {
+		status.Error = err.Error()
+		fmt.Fprintf(stderr, "smf-shim: %v\n", err)
+		return status.ExitCode
+	}
+	err = cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		status.Error = err.Error()
+	}
+	status.ExitCode = cmd.ProcessState.ExitCode()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		status.Signal = ws.Signal().String()
+		return 128 + int(ws.Signal())
+	}
+	return status.ExitCode
+}
+
+// writeStatus 写入临时文件后重命名，服务端不会读到不完整的状态
+func writeStatus(dir string, status exitStatus) {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	tmp := filepath.Join(dir, "status.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	os.Rename(tmp, filepath.Join(dir, "status.json"))
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Fprintln(os.Stderr, "smf-shim: detached tasks are not supported on windows")
+	os.Exit(1)
+}
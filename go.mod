@@ -2,6 +2,12 @@ module github.com/recyvan/smf
 
 go 1.24.1
 
-require github.com/panjf2000/ants/v2 v2.11.2
+require (
+	github.com/creack/pty v1.1.24
+	github.com/panjf2000/ants/v2 v2.11.2
+	golang.org/x/sys v0.30.0
+	golang.org/x/term v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require golang.org/x/sync v0.11.0 // indirect
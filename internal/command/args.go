@@ -0,0 +1,73 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SplitArgs 按空白拆分命令行，支持单引号、双引号和反斜杠转义
+// 单引号内的内容原样保留，双引号内只有 \" 和 \\ 会被转义
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\'):
+				i++
+				current.WriteRune(runes[i])
+			default:
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\':
+			if i+1 < len(runes) {
+				i++
+				current.WriteRune(runes[i])
+			}
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// CutBackground 去掉命令行末尾表示后台运行的 &，返回剩余部分和是否需要后台运行
+// 被转义的 \& 和 && 不会被当作后台运行，引号中的 & 不在行尾
+func CutBackground(line string) (string, bool) {
+	rest, ok := strings.CutSuffix(strings.TrimRight(line, " \t"), "&")
+	if !ok || strings.TrimSpace(rest) == "" || strings.HasSuffix(rest, "\\") || strings.HasSuffix(rest, "&") {
+		return line, false
+	}
+	return rest, true
+}
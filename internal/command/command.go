@@ -2,6 +2,7 @@ package command
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"sync"
 )
@@ -13,9 +14,95 @@ type Ecommand struct {
 	Description string
 	Usage       string
 	Type        string
-	//是否运行后台执行
+	//是否运行后台执行，未设置 BackgroundPolicy 时 true 等同于 allowed，false 等同于 forbidden
 	Background bool
-	Handler    Handler
+	// BackgroundPolicy 命令能否在后台运行，未设置时由 Background 决定
+	BackgroundPolicy BackgroundPolicy
+	// BackgroundReason 禁止或必须后台运行的原因，显示在错误信息中
+	BackgroundReason string
+	// OwnTimeout 命令自行控制运行时间(例如 exec --timeout)，引擎不再加默认超时
+	OwnTimeout bool
+	// RunsProcess 命令在子进程中运行，后台任务可以通过结束子进程重启本次运行
+	RunsProcess bool
+	Handler     Handler
+}
+
+// BackgroundPolicy 命令的后台运行策略
+type BackgroundPolicy string
+
+const (
+	BackgroundAllowed   BackgroundPolicy = "allowed"   // 前台和后台都可以运行
+	BackgroundForbidden BackgroundPolicy = "forbidden" // 只能在前台运行
+	BackgroundRequired  BackgroundPolicy = "required"  // 只能在后台运行
+)
+
+// Policy 返回命令的后台运行策略，未设置时按 Background 允许或禁止后台运行
+func (c Ecommand) Policy() BackgroundPolicy {
+	switch {
+	case c.BackgroundPolicy != "":
+		return c.BackgroundPolicy
+	case c.Background:
+		return BackgroundAllowed
+	default:
+		return BackgroundForbidden
+	}
+}
+
+// CheckBackground 检查命令能否在后台(background 为 true)或前台运行，不能时返回说明原因的错误
+func (c Ecommand) CheckBackground(background bool) error {
+	switch policy := c.Policy(); {
+	case background && policy == BackgroundForbidden:
+		reason := c.BackgroundReason
+		if reason == "" {
+			reason = "it does not declare background support"
+		}
+		return fmt.Errorf("command %s cannot run in background: %s", c.Name, reason)
+	case !background && policy == BackgroundRequired:
+		reason := c.BackgroundReason
+		if reason == "" {
+			reason = "it only runs as a background task"
+		}
+		return fmt.Errorf("command %s must run in background: %s; use 'bg %s ...' or end the line with &", c.Name, reason, c.Name)
+	}
+	return nil
+}
+
+// StderrProvider 能够单独接收标准错误输出的 io.ReadWriter
+type StderrProvider interface {
+	Stderr() io.Writer
+}
+
+// Stderr 返回 rw 的标准错误输出，未单独提供时与标准输出相同
+func Stderr(rw io.Writer) io.Writer {
+	if p, ok := rw.(StderrProvider); ok {
+		return p.Stderr()
+	}
+	return rw
+}
+
+// FrameProvider 能够处理控制帧的 io.ReadWriter，例如远程客户端的连接
+type FrameProvider interface {
+	SupportsFrames() bool
+}
+
+// SupportsFrames 判断 rw 的另一端是否能处理控制帧
+func SupportsFrames(rw io.Writer) bool {
+	p, ok := rw.(FrameProvider)
+	return ok && p.SupportsFrames()
+}
+
+// ReadInterrupter 能够中断阻塞中的 Read 的 io.Reader，例如远程客户端的连接
+type ReadInterrupter interface {
+	// InterruptRead 让阻塞中的 Read 立即返回错误，读取的协程退出后调用 restore 恢复读取
+	InterruptRead() (restore func(), ok bool)
+}
+
+// InterruptRead 中断 rw 上阻塞中的 Read，rw 不支持中断时 ok 为 false
+func InterruptRead(rw io.Reader) (restore func(), ok bool) {
+	if r, isInterrupter := rw.(ReadInterrupter); isInterrupter {
+		return r.InterruptRead()
+	}
+	return nil, false
 }
 
 type Registry struct {
@@ -42,6 +129,21 @@ func (r *Registry) Get(name string) (Ecommand, bool) {
 	return cmd, exists
 }
 
+// Prepare 检查命令的后台运行策略，background 为 true 时改为通过 bg 命令在后台运行
+func (r *Registry) Prepare(cmd Ecommand, args []string, background bool) (Ecommand, []string, error) {
+	if err := cmd.CheckBackground(background); err != nil {
+		return Ecommand{}, nil, err
+	}
+	if !background {
+		return cmd, args, nil
+	}
+	bg, exists := r.Get("bg")
+	if !exists {
+		return Ecommand{}, nil, fmt.Errorf("background tasks are not available")
+	}
+	return bg, append([]string{cmd.Name}, args...), nil
+}
+
 func (r *Registry) List() []Ecommand {
 	r.RLock()
 	defer r.RUnlock()
@@ -32,18 +32,31 @@ func (e *LocalEngine) RegisterCommand(cmd Ecommand) {
 
 // Execute 执行命令
 func (e *LocalEngine) Execute(rw io.ReadWriter, input string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
-	defer cancel()
-
-	cmd, args := parseLocalCommand(input)
-	if cmd == "" {
+	input, background := CutBackground(input)
+	parts, err := SplitArgs(input)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) == 0 {
 		return "", fmt.Errorf("empty command")
 	}
+	cmd, args := parts[0], parts[1:]
 
 	ecommand, exists := e.CmdRegistry.Get(cmd)
 	if !exists {
 		return "", fmt.Errorf("command not found: %s", cmd)
 	}
+	ecommand, args, err = e.CmdRegistry.Prepare(ecommand, args, background)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	if !ecommand.OwnTimeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
 
 	// 创建本地IO处理器
 	//localIO := NewLocalIO()
@@ -65,14 +78,6 @@ func (e *LocalEngine) Execute(rw io.ReadWriter, input string) (string, error) {
 	return string(result), nil
 }
 
-func parseLocalCommand(input string) (string, []string) {
-	parts := strings.Split(strings.TrimSpace(input), " ")
-	if len(parts) == 0 {
-		return "", nil
-	}
-	return parts[0], parts[1:]
-}
-
 // LocalIO 实现本地IO操作
 type LocalIO struct {
 	output strings.Builder
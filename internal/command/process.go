@@ -0,0 +1,63 @@
+package command
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+// ProcessObserver 观察命令启动的子进程
+// 后台任务管理器通过 context 注入，用于在终止任务时结束对应的进程组
+type ProcessObserver interface {
+	ProcessStarted(p *os.Process)
+	ProcessExited(p *os.Process, state *os.ProcessState)
+}
+
+// DetachedLauncher 可选接口，由进程观察者实现
+// Detached 为 true 时命令在启动前交给 WrapCommand 改为由 shim 作为独立进程运行，服务端重启后仍可接管
+type DetachedLauncher interface {
+	Detached() bool
+	WrapCommand(cmd *exec.Cmd) error
+}
+
+// CommandPreparer 可选接口，由进程观察者实现，在命令启动前修改命令，例如让子进程直接在任务的 cgroup 中创建
+// 返回的 done 在命令启动后调用，释放准备时打开的资源
+type CommandPreparer interface {
+	PrepareCommand(cmd *exec.Cmd) (done func(), err error)
+}
+
+type processObserverKey struct{}
+
+// WithProcessObserver 返回携带进程观察者的 context
+func WithProcessObserver(ctx context.Context, observer ProcessObserver) context.Context {
+	return context.WithValue(ctx, processObserverKey{}, observer)
+}
+
+// ProcessObserverFrom 取出 context 中的进程观察者
+func ProcessObserverFrom(ctx context.Context) (ProcessObserver, bool) {
+	observer, ok := ctx.Value(processObserverKey{}).(ProcessObserver)
+	return observer, ok
+}
+
+// DetachedLauncherFrom 取出 context 中要求独立运行命令的进程观察者
+func DetachedLauncherFrom(ctx context.Context) (DetachedLauncher, bool) {
+	observer, ok := ProcessObserverFrom(ctx)
+	if !ok {
+		return nil, false
+	}
+	launcher, ok := observer.(DetachedLauncher)
+	if !ok || !launcher.Detached() {
+		return nil, false
+	}
+	return launcher, true
+}
+
+// CommandPreparerFrom 取出 context 中需要在启动前修改命令的进程观察者
+func CommandPreparerFrom(ctx context.Context) (CommandPreparer, bool) {
+	observer, ok := ProcessObserverFrom(ctx)
+	if !ok {
+		return nil, false
+	}
+	preparer, ok := observer.(CommandPreparer)
+	return preparer, ok
+}
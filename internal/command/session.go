@@ -0,0 +1,28 @@
+package command
+
+import "context"
+
+// Session 发起命令的用户会话
+type Session struct {
+	User  string
+	ID    string // 连接编号，例如 alice-0
+	Admin bool   // 管理员可以操作其它用户的后台任务
+}
+
+// localSession 本地控制台等没有登录会话的调用方
+var localSession = Session{User: "local", ID: "local", Admin: true}
+
+type sessionKey struct{}
+
+// WithSession 返回携带用户会话的 context
+func WithSession(ctx context.Context, session Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFrom 取出 context 中的用户会话，没有会话时视为本地管理员
+func SessionFrom(ctx context.Context) Session {
+	if session, ok := ctx.Value(sessionKey{}).(Session); ok {
+		return session
+	}
+	return localSession
+}
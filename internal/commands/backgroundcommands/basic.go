@@ -4,21 +4,27 @@ import (
 	"context"
 	"fmt"
 	"github.com/recyvan/smf/internal/command"
+	"github.com/recyvan/smf/internal/protocol"
 
 	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // BasicCommands 提供基础命令
 type BasicCommands struct {
 	tm *TaskManager
 	//cw *CommandWrapper
-	commands map[string]command.Ecommand
-	registry *command.Registry
+	registry  *command.Registry
+	scheduler *Scheduler
+	workflows *WorkflowManager
+	notifier  *Notifier
 }
 
 // NewBasicCommands 创建基础命令提供者
 func NewBasicCommands(registry *command.Registry) (*BasicCommands, error) {
-	tm, err := NewTaskManager(10)
+	tm, err := NewTaskManager(10, registry)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create task manager: %v", err)
@@ -26,90 +32,949 @@ func NewBasicCommands(registry *command.Registry) (*BasicCommands, error) {
 	//cw := NewCommandWrapper(tm)
 	//cw.RegisterCommand()
 
-	return &BasicCommands{tm: tm, commands: make(map[string]command.Ecommand), registry: registry}, nil
+	bc := &BasicCommands{tm: tm, registry: registry}
+	bc.scheduler = NewScheduler(tm)
+	bc.workflows = NewWorkflowManager(tm)
+	bc.notifier = NewNotifier(tm.events)
+	return bc, nil
 }
 
-// RegisterCommand 注册命令
-// 在 BasicCommands 中修改 RegisterCommand 方法
-func (bc *BasicCommands) RegisterCommand() {
-	cmds := bc.registry.List()
-	for _, cmd := range cmds {
-		if cmd.Background {
-			bc.commands[cmd.Name] = cmd
-			bc.tm.RegisterFunction(cmd.Name, cmd.Handler)
-		}
-	}
-}
+var bgstring = `Usage: bg [options] <task_name> [args...]
+Options (必须位于任务名之前):
+  --restart never|on-failure|always  任务结束后的重启策略 (默认 never)
+  --max-retries N                    最大重启次数，0 表示不限 (默认 0)
+  --backoff DURATION                 第一次重启前的等待时间，之后每次翻倍 (默认 1s)
+  --priority N                       协程池已满时的排队优先级，越大越先运行 (默认 0)
+  --cpu N%                           子进程的 CPU 配额，100% 为一个核 (需要 cgroup v2)
+  --mem SIZE                         子进程的内存上限，例如 512M (无 cgroup v2 时使用 RLIMIT_AS)
+  --nofile N                         子进程的最大打开文件数 (子进程启动后立即设置)
+  --timeout DURATION                 单次运行的最长时间，超时后结束子进程并按失败处理
+  --detach                           子进程由 smf-shim 独立运行，服务端重启后重新接管 (不支持 pty)
+  --label KEY=VALUE                  为任务添加标签，可重复，用于 check --label 过滤
+  --health PROBE                     健康检查: exec:<cmd>、tcp:[host:]port、http:<本机 url> 或 output:<DURATION>
+                                     (DURATION 内有输出即为健康)，结果显示在 check 的 HEALTH 列
+  --health-interval DURATION         检查间隔 (默认 10s)
+  --health-timeout DURATION          单次检查的超时 (默认 5s)
+  --health-retries N                 连续失败 N 次后标记为 UNHEALTHY 并按 --health-action 处理，之后每 N 次失败再处理一次 (默认 3)
+  --health-action restart|kill|none  连续失败后立即重启本次运行、终止任务或只标记 (默认 restart，只能用于 exec、pyexec、run)
+任务属于启动它的用户，只有所有者和管理员可以 kill、interact 或修改任务
+资源限制只作用于启动子进程的命令 (exec、pyexec、run)
+连续 5 次在 10s 内退出视为崩溃循环，任务将停止重启
+命令行以单独的 & 结尾时等同于不带选项的 bg，例如 exec long.sh &
+命令的后台策略 (help <command> 中的 Background) 为 forbidden 时不能在后台运行，为 required 时只能在后台运行`
 
 func (bc *BasicCommands) handleBg(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
-	if len(args) < 1 {
-		fmt.Fprint(rw, "usage: bg <task_name> [args...]")
+	opts, rest, err := parseBgArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < 1 {
+		fmt.Fprintln(rw, bgstring)
 		return nil, nil
 	}
 
-	bc.RegisterCommand()
-
-	bc.tm.StartTask(rw, args[0], args[1:]...)
+	session := command.SessionFrom(ctx)
+	opts.Owner, opts.Session = session.User, session.ID
+	if bc.tm.StartTask(rw, opts, rest[0], rest[1:]...) != 0 {
+		bc.notifier.AutoEnable(rw, session)
+	}
 	return nil, nil
 }
 
+// parseBgArgs 解析任务名之前的监管选项
+func parseBgArgs(args []string) (TaskOptions, []string, error) {
+	opts := TaskOptions{Restart: RestartNever, Backoff: defaultBackoff}
+	// --health-* 可以出现在 --health 之前，解析完成后再应用
+	var healthOpts []func(*HealthCheck)
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "--"); i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		if args[i] == "--detach" {
+			opts.Detach = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return opts, nil, fmt.Errorf("missing value for %s", args[i])
+		}
+		value := args[i+1]
+		switch args[i] {
+		case "--restart":
+			policy, err := ParseRestartPolicy(value)
+			if err != nil {
+				return opts, nil, err
+			}
+			opts.Restart = policy
+		case "--max-retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return opts, nil, fmt.Errorf("invalid max retries: %s", value)
+			}
+			opts.MaxRetries = n
+		case "--backoff":
+			backoff, err := time.ParseDuration(value)
+			if err != nil || backoff <= 0 {
+				return opts, nil, fmt.Errorf("invalid backoff: %s", value)
+			}
+			opts.Backoff = backoff
+		case "--priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, nil, fmt.Errorf("invalid priority: %s", value)
+			}
+			opts.Priority = priority
+		case "--cpu":
+			cpu, err := ParseCPU(value)
+			if err != nil {
+				return opts, nil, err
+			}
+			opts.Limits.CPU = cpu
+		case "--mem":
+			memory, err := ParseSize(value)
+			if err != nil {
+				return opts, nil, fmt.Errorf("invalid memory limit: %s", value)
+			}
+			opts.Limits.Memory = memory
+		case "--nofile":
+			nofile, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || nofile == 0 {
+				return opts, nil, fmt.Errorf("invalid nofile limit: %s", value)
+			}
+			opts.Limits.NoFile = nofile
+		case "--timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return opts, nil, fmt.Errorf("invalid timeout: %s", value)
+			}
+			opts.Limits.Timeout = timeout
+		case "--label":
+			key, val, err := ParseLabel(value)
+			if err != nil {
+				return opts, nil, err
+			}
+			if opts.Labels == nil {
+				opts.Labels = make(map[string]string)
+			}
+			opts.Labels[key] = val
+		case "--health":
+			hc, err := ParseHealthProbe(value)
+			if err != nil {
+				return opts, nil, err
+			}
+			opts.Health = hc
+		case "--health-interval", "--health-timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return opts, nil, fmt.Errorf("invalid %s: %s", strings.TrimPrefix(args[i], "--"), value)
+			}
+			if args[i] == "--health-interval" {
+				healthOpts = append(healthOpts, func(hc *HealthCheck) { hc.Interval = d })
+			} else {
+				healthOpts = append(healthOpts, func(hc *HealthCheck) { hc.Timeout = d })
+			}
+		case "--health-retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return opts, nil, fmt.Errorf("invalid health retries: %s", value)
+			}
+			healthOpts = append(healthOpts, func(hc *HealthCheck) { hc.Retries = n })
+		case "--health-action":
+			action, err := ParseHealthAction(value)
+			if err != nil {
+				return opts, nil, err
+			}
+			healthOpts = append(healthOpts, func(hc *HealthCheck) { hc.Action = action })
+		default:
+			return opts, nil, fmt.Errorf("unknown option: %s", args[i])
+		}
+		i++
+	}
+	if len(healthOpts) > 0 && opts.Health == nil {
+		return opts, nil, fmt.Errorf("--health-interval, --health-timeout, --health-retries and --health-action require --health")
+	}
+	for _, apply := range healthOpts {
+		apply(opts.Health)
+	}
+	return opts, args[i:], nil
+}
+
+// 任务管理命令不能在后台运行的原因
+const (
+	taskReason    = "it manages background tasks and must report to the current session"
+	attachReason  = "it attaches to the current session's terminal"
+	sessionReason = "it changes the state of the current session"
+)
+
 // ProvideCommands 实现 command.CommandProvider 接口
 func (bc *BasicCommands) ProvideCommands() []command.Ecommand {
 	return []command.Ecommand{
 		{
-			Name:        "bg",
-			Description: "将存在交互等耗时任务的命令放入后台(协程)运行",
-			Usage:       "bg <task_name> <task_args>",
-			Type:        "system",
-			Background:  false,
-			Handler:     bc.handleBg,
+			Name:             "bg",
+			Description:      "将存在交互等耗时任务的命令放入后台(协程)运行",
+			Usage:            bgstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleBg,
+		},
+		{
+			Name:             "interact",
+			Description:      "与后台协程进行交互，所有输入转发给任务，按断开按键返回",
+			Usage:            interactstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: attachReason,
+			Handler:          bc.handleInteract,
+		},
+		{
+			Name:             "send",
+			Description:      "不进入交互直接向后台任务发送一行输入",
+			Usage:            sendstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleSend,
+		},
+		{
+			Name:             "sendfile",
+			Description:      "将服务端文件的内容作为后台任务的输入",
+			Usage:            "sendfile <task_id> <path>",
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleSendFile,
 		},
 		{
-			Name:        "interact",
-			Description: "与后台协程进行交互",
-			Usage:       "interact <task_id>",
-			Type:        "system",
-			Background:  false,
-			Handler:     bc.handleInteract,
+			Name:             "eof",
+			Description:      "关闭后台任务的标准输入",
+			Usage:            "eof <task_id>",
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleEOF,
 		},
 		{
-			Name:        "check",
-			Description: "列出所有后台(脚本或函数)协程",
-			Usage:       "check",
-			Type:        "system",
-			Background:  false,
-			Handler:     bc.handleList,
+			Name:             "watch",
+			Description:      "只读地观察后台协程的输出，可多个会话同时观察",
+			Usage:            "watch <task_id>",
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: attachReason,
+			Handler:          bc.handleWatch,
 		},
 		{
-			Name:        "kill",
-			Description: "杀死指定后台(脚本或函数)协程",
-			Usage:       "kill <task_id>",
-			Type:        "system",
-			Background:  false,
-			Handler:     bc.handleKill,
+			Name:             "check",
+			Description:      "列出所有后台(脚本或函数)协程，--all 同时列出已结束的任务，支持按用户、标签、状态和命令名过滤",
+			Usage:            checkstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleList,
 		},
 		{
-			Name:        "exit",
-			Description: "退出程序",
-			Usage:       "exit",
-			Type:        "system",
-			Background:  false,
-			Handler:     bc.handleExit,
+			Name:             "task",
+			Description:      "查看后台任务的详情、退出码和已捕获的输出",
+			Usage:            taskstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleTask,
+		},
+		{
+			Name:             "tail",
+			Description:      "查看后台任务日志的最后几行，可持续跟踪输出",
+			Usage:            tailstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: attachReason,
+			Handler:          bc.handleTail,
+		},
+		{
+			Name:             "schedule",
+			Description:      "按 cron 表达式周期运行后台命令",
+			Usage:            schedulestring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleSchedule,
+		},
+		{
+			Name:             "tasks",
+			Description:      "实时显示后台任务子进程的 CPU、内存、线程、文件描述符和 IO",
+			Usage:            tasksstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: attachReason,
+			Handler:          bc.handleTasks,
+		},
+		{
+			Name:             "pool",
+			Description:      "查看或调整后台协程池和等待队列",
+			Usage:            poolstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handlePool,
+		},
+		{
+			Name:             "tm",
+			Description:      "查看任务管理器状态，排空、重启、停止所有任务，或暂停和恢复任务",
+			Usage:            tmstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleTM,
+		},
+		{
+			Name:             "workflow",
+			Description:      "按 YAML 定义的依赖关系运行多个后台命令",
+			Usage:            workflowstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleWorkflow,
+		},
+		{
+			Name:             "notify",
+			Description:      "推送后台任务的开始、结束、失败、终止和重启事件，或转发到 webhook、文件和命令",
+			Usage:            notifystring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: sessionReason,
+			Handler:          bc.handleNotify,
+		},
+		{
+			Name:             "trigger",
+			Description:      "后台任务输出匹配正则时通知、终止、重启任务或运行其它命令",
+			Usage:            triggerstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleTrigger,
+		},
+		{
+			Name:             "kill",
+			Description:      "杀死指定后台(脚本或函数)协程",
+			Usage:            "kill <task_id>",
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: taskReason,
+			Handler:          bc.handleKill,
+		},
+		{
+			Name:             "exit",
+			Description:      "退出程序",
+			Usage:            "exit",
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundForbidden,
+			BackgroundReason: sessionReason,
+			Handler:          bc.handleExit,
 		},
 	}
 }
 
+var interactstring = `Usage: interact [--steal] [--detach-keys KEYS] <task_id>
+  --steal              从其它会话抢占输入锁
+  --detach-keys KEYS   断开交互的按键序列，逗号分隔的字符或 ctrl-<字符> (默认 ctrl-])，例如 ctrl-p,ctrl-q
+所有输入(包括 exit)都会转发给任务，行模式下按键序列之后需按回车`
+
 func (bc *BasicCommands) handleInteract(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	steal := false
+	detachKeys := protocol.DefaultDetachKeys
+	for len(args) > 1 {
+		switch args[0] {
+		case "--steal":
+			steal = true
+			args = args[1:]
+			continue
+		case "--detach-keys":
+			detachKeys = args[1]
+			args = args[2:]
+			continue
+		}
+		break
+	}
 	if len(args) != 1 {
-		fmt.Fprint(rw, "usage: interact <task_id>")
+		fmt.Fprintln(rw, interactstring)
 		return nil, nil
 	}
-	err := bc.tm.InteractTask(rw, args[0])
+	err := bc.tm.InteractTask(rw, command.SessionFrom(ctx), args[0], steal, detachKeys)
 	return nil, err
 }
 
+var sendstring = `Usage: send [-n] <task_id> <text...>
+  -n    不在末尾添加换行
+多个参数以空格连接；任务的输入被 interact 会话独占时拒绝发送，5 秒内任务未读取输入时返回错误`
+
+func (bc *BasicCommands) handleSend(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	newline := "\n"
+	if len(args) > 0 && args[0] == "-n" {
+		newline = ""
+		args = args[1:]
+	}
+	if len(args) < 1 {
+		fmt.Fprintln(rw, sendstring)
+		return nil, nil
+	}
+	text := strings.Join(args[1:], " ") + newline
+	return nil, bc.tm.SendInput(rw, command.SessionFrom(ctx), args[0], []byte(text))
+}
+
+func (bc *BasicCommands) handleSendFile(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		fmt.Fprint(rw, "usage: sendfile <task_id> <path>")
+		return nil, nil
+	}
+	return nil, bc.tm.SendFile(rw, command.SessionFrom(ctx), args[0], args[1])
+}
+
+func (bc *BasicCommands) handleEOF(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		fmt.Fprint(rw, "usage: eof <task_id>")
+		return nil, nil
+	}
+	return nil, bc.tm.CloseInput(rw, command.SessionFrom(ctx), args[0])
+}
+
+func (bc *BasicCommands) handleWatch(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		fmt.Fprint(rw, "usage: watch <task_id>")
+		return nil, nil
+	}
+	return nil, bc.tm.WatchTask(rw, command.SessionFrom(ctx), args[0])
+}
+
+var checkstring = `Usage: check [-a|--all] [filters] [--sort KEY] [-r|--reverse]
+  -a, --all              同时列出历史中已结束的任务
+  --user USER            只列出 USER 启动的任务，- 表示系统任务
+  --label KEY=VALUE      按标签过滤，可重复，需全部匹配
+  --status S1,S2         按状态过滤，例如 running,restarting 或 failed (已结束的状态需配合 -a)
+  --name GLOB            按命令名或完整命令行过滤，例如 'py*'
+  --sort KEY             排序字段: id (默认)、start、duration、name、status、user
+  -r, --reverse          倒序排列`
+
 func (bc *BasicCommands) handleList(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
-	bc.tm.ListTasks(rw)
+	filter, all, err := ParseTaskFilter(args)
+	if err != nil {
+		fmt.Fprintln(rw, checkstring)
+		return nil, err
+	}
+	bc.tm.ListTasks(rw, all, filter)
+	return nil, nil
+}
+
+var taskstring = `Usage: task <subcommand> <task_id>
+  show <task_id>            显示任务详情、退出码和结果
+  output <task_id>          输出任务已捕获的标准输出和标准错误
+  priority <task_id> <n>    修改任务的排队优先级，越大越先运行
+  input <task_id> shared|exclusive
+                            设置输入模式: exclusive 同一时间只有一个 interact 会话可以输入(默认)，shared 所有会话都可以输入`
+
+func (bc *BasicCommands) handleTask(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) == 3 && args[0] == "priority" {
+		return nil, bc.tm.SetPriority(rw, command.SessionFrom(ctx), args[1], args[2])
+	}
+	if len(args) == 3 && args[0] == "input" {
+		return nil, bc.tm.SetInputMode(rw, command.SessionFrom(ctx), args[1], args[2])
+	}
+	if len(args) != 2 {
+		fmt.Fprintln(rw, taskstring)
+		return nil, nil
+	}
+	switch args[0] {
+	case "show":
+		return nil, bc.tm.ShowTask(rw, command.SessionFrom(ctx), args[1])
+	case "output":
+		return nil, bc.tm.TaskOutput(rw, command.SessionFrom(ctx), args[1])
+	default:
+		return nil, fmt.Errorf("unknown task subcommand: %s", args[0])
+	}
+}
+
+var tailstring = `Usage: tail [-f] [-n N] [-e] <task_id>
+  -f, --follow   持续输出新内容，按回车结束
+  -n, --lines N  输出最后 N 行 (默认 10)
+  -e, --stderr   输出标准错误而非标准输出`
+
+func (bc *BasicCommands) handleTail(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	lines := defaultTailLines
+	follow, stderr := false, false
+	taskID := ""
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-f", "--follow":
+			follow = true
+		case "-e", "--stderr":
+			stderr = true
+		case "-n", "--lines":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing value for %s", args[i])
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid line count: %s", args[i])
+			}
+			lines = n
+		default:
+			if taskID != "" {
+				fmt.Fprintln(rw, tailstring)
+				return nil, nil
+			}
+			taskID = args[i]
+		}
+	}
+	if taskID == "" {
+		fmt.Fprintln(rw, tailstring)
+		return nil, nil
+	}
+	return nil, bc.tm.TailTask(rw, command.SessionFrom(ctx), taskID, lines, follow, stderr)
+}
+
+var schedulestring = `Usage: schedule <subcommand> [args]
+  add [options] "<cron expr>" <command> [args...]  添加定时任务，命令须支持后台运行
+      --tz ZONE                     按指定时区计算运行时间 (如 Asia/Shanghai，默认本地时区)
+      --overlap skip|queue|allow    上一次运行未结束时的处理方式 (默认 skip)
+      --jitter DURATION             每次运行随机延迟 0 到 DURATION
+  list                              列出定时任务
+  rm <id>                           删除定时任务
+  pause <id>                        暂停定时任务
+  resume <id>                       恢复定时任务
+cron 表达式为 "分 时 日 月 周"，支持 * , - / 及 @hourly、@daily、@weekly、@monthly、@yearly`
+
+func (bc *BasicCommands) handleSchedule(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) < 1 {
+		fmt.Fprintln(rw, schedulestring)
+		return nil, nil
+	}
+
+	switch args[0] {
+	case "add":
+		job, err := parseScheduleArgs(args[1:])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := bc.tm.lookup(job.Name); err != nil {
+			return nil, err
+		}
+		job.Owner = command.SessionFrom(ctx).User
+		id, err := bc.scheduler.Add(job)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(rw, "Added schedule %d: %s %s %s\n", id, job.Expr, job.Name, strings.Join(job.Args, " "))
+	case "list":
+		bc.scheduler.List(rw)
+	case "rm", "pause", "resume":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: schedule %s <id>", args[0])
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule ID: %v", err)
+		}
+		session := command.SessionFrom(ctx)
+		switch args[0] {
+		case "rm":
+			err = bc.scheduler.Remove(session, id)
+		case "pause":
+			err = bc.scheduler.SetPaused(session, id, true)
+		case "resume":
+			err = bc.scheduler.SetPaused(session, id, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(rw, "Schedule %d: %s done\n", id, args[0])
+	default:
+		return nil, fmt.Errorf("unknown schedule subcommand: %s", args[0])
+	}
+	return nil, nil
+}
+
+// parseScheduleArgs 解析 schedule add 的参数
+func parseScheduleArgs(args []string) (*ScheduledJob, error) {
+	job := &ScheduledJob{Overlap: OverlapSkip}
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "--"); i += 2 {
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value for %s", args[i])
+		}
+		value := args[i+1]
+		switch args[i] {
+		case "--tz":
+			job.TimeZone = value
+		case "--overlap":
+			policy, err := ParseOverlapPolicy(value)
+			if err != nil {
+				return nil, err
+			}
+			job.Overlap = policy
+		case "--jitter":
+			jitter, err := time.ParseDuration(value)
+			if err != nil || jitter < 0 {
+				return nil, fmt.Errorf("invalid jitter: %s", value)
+			}
+			job.Jitter = jitter
+		default:
+			return nil, fmt.Errorf("unknown option: %s", args[i])
+		}
+	}
+	if len(args)-i < 2 {
+		return nil, fmt.Errorf("usage: schedule add [options] \"<cron expr>\" <command> [args...]")
+	}
+	job.Expr = args[i]
+	job.Name = args[i+1]
+	job.Args = args[i+2:]
+	return job, nil
+}
+
+var tasksstring = `Usage: tasks top [-d DURATION] [-n N]
+  top            类似 top 实时显示运行中任务的 CPU%、RSS、线程数、打开的文件数、IO 字节数和运行时间，按回车结束
+  -d DURATION    刷新间隔 (默认 1s)
+  -n N           只刷新 N 次后返回，不清屏`
+
+func (bc *BasicCommands) handleTasks(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) == 0 || args[0] != "top" {
+		fmt.Fprintln(rw, tasksstring)
+		return nil, nil
+	}
+	interval, count := defaultTopInterval, 0
+	for i := 1; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value for %s", args[i])
+		}
+		value := args[i+1]
+		switch args[i] {
+		case "-d":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid interval: %s", value)
+			}
+			interval = d
+		case "-n":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid count: %s", value)
+			}
+			count = n
+		default:
+			return nil, fmt.Errorf("unknown option: %s", args[i])
+		}
+		i++
+	}
+	return nil, bc.tm.TopTasks(rw, interval, count)
+}
+
+var poolstring = `Usage: pool <subcommand>
+  status        显示协程池占用和等待队列
+  resize <n>    调整协程池大小 (仅管理员)
+  limit <n>     设置等待队列的长度上限，队列已满时新任务启动失败 (仅管理员)`
+
+func (bc *BasicCommands) handlePool(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) == 0 || (len(args) == 1 && args[0] == "status") {
+		bc.tm.PoolStatus(rw)
+		return nil, nil
+	}
+	if len(args) != 2 {
+		fmt.Fprintln(rw, poolstring)
+		return nil, nil
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid number: %s", args[1])
+	}
+	if args[0] != "resize" && args[0] != "limit" {
+		return nil, fmt.Errorf("unknown pool subcommand: %s", args[0])
+	}
+	// 协程池和等待队列由所有用户共享
+	if !command.SessionFrom(ctx).Admin {
+		return nil, fmt.Errorf("permission denied: only admins can %s the pool", args[0])
+	}
+	switch args[0] {
+	case "resize":
+		return nil, bc.tm.Resize(rw, n)
+	case "limit":
+		return nil, bc.tm.SetQueueLimit(rw, n)
+	default:
+		return nil, fmt.Errorf("unknown pool subcommand: %s", args[0])
+	}
+}
+
+var workflowstring = `Usage: workflow <subcommand> [args]
+  run <file.yaml>       按依赖关系运行工作流，返回运行 ID
+  status [run_id]       不带 ID 时列出所有运行，否则显示每个步骤的状态
+  resume <run_id>       从失败的步骤继续运行，已成功的步骤不会重新运行
+工作流文件格式:
+  name: deploy
+  steps:
+    - name: build
+      command: exec
+      args: [sh, build.sh]
+      timeout: 10m          # 整个步骤(含重试)的超时
+      retries: 2            # 失败后的重试次数
+    - name: test
+      command: pyexec
+      args: [-f, test.py]
+      depends_on: [build]
+      when: success         # success(默认)、failure 或 always`
+
+func (bc *BasicCommands) handleWorkflow(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) < 1 {
+		fmt.Fprintln(rw, workflowstring)
+		return nil, nil
+	}
+
+	switch args[0] {
+	case "run":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: workflow run <file.yaml>")
+		}
+		wf, err := LoadWorkflow(args[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, step := range wf.Steps {
+			if _, err := bc.tm.lookup(step.Command); err != nil {
+				return nil, fmt.Errorf("step %s: %v", step.Name, err)
+			}
+		}
+		id := bc.workflows.Run(args[1], wf, command.SessionFrom(ctx).User)
+		fmt.Fprintf(rw, "Started workflow %s as run %d\n", wf.Name, id)
+	case "status":
+		if len(args) == 1 {
+			bc.workflows.List(rw)
+			return nil, nil
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid run ID: %v", err)
+		}
+		return nil, bc.workflows.Status(rw, id)
+	case "resume":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: workflow resume <run_id>")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid run ID: %v", err)
+		}
+		if err := bc.workflows.Resume(command.SessionFrom(ctx), id); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(rw, "Resumed workflow run %d\n", id)
+	default:
+		return nil, fmt.Errorf("unknown workflow subcommand: %s", args[0])
+	}
+	return nil, nil
+}
+
+// SetScheduleFile 设置定时任务的持久化文件并加载已有的定时任务
+func (bc *BasicCommands) SetScheduleFile(path string) error {
+	return bc.scheduler.SetFile(path)
+}
+
+// SetLogDir 设置任务输出日志的目录，返回接管的服务端重启前独立运行的任务数
+func (bc *BasicCommands) SetLogDir(dir string) int {
+	return bc.tm.SetLogDir(dir)
+}
+
+// SetHistoryFile 设置任务历史的持久化文件
+func (bc *BasicCommands) SetHistoryFile(path string) error {
+	return bc.tm.SetHistoryFile(path)
+}
+
+var notifystring = `Usage: notify [on|off|sink] ...
+  notify                              显示当前会话的通知设置和所有接收者
+  notify on [--all] [--events LIST]   向当前会话推送事件，--all 包括其它用户的任务 (仅管理员)
+                                      (默认只推送自己任务的 restarted,finished,failed,killed,triggered,unhealthy)
+  notify off                          停止向当前会话推送
+  notify sink add [--events LIST] webhook <url>          以 JSON POST 到本机 URL
+  notify sink add [--events LIST] file <path>            每个事件追加一行 JSON
+  notify sink add [--events LIST] exec <cmd> [args...]   每个事件运行一次命令，JSON 从标准输入传入，
+                                                          并设置 SMF_EVENT、SMF_TASK_ID、SMF_TASK_STATUS 等环境变量
+  notify sink rm <id>                 删除接收者
+事件类型: started, output, restarted, finished, failed, killed, triggered, unhealthy 或 all，逗号分隔
+会话启动后台任务时自动开启通知；接收者默认接收除 output 之外的所有事件，只有管理员可以管理接收者`
+
+func (bc *BasicCommands) handleNotify(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	session := command.SessionFrom(ctx)
+	if len(args) == 0 {
+		bc.notifier.Status(rw, session)
+		return nil, nil
+	}
+
+	switch args[0] {
+	case "on":
+		all := false
+		types := defaultSessionEvents
+		for i := 1; i < len(args); i++ {
+			switch {
+			case args[i] == "--all":
+				all = true
+			case args[i] == "--events" && i+1 < len(args):
+				parsed, err := ParseEventTypes(args[i+1])
+				if err != nil {
+					return nil, err
+				}
+				types = parsed
+				i++
+			default:
+				fmt.Fprintln(rw, notifystring)
+				return nil, nil
+			}
+		}
+		// 其它用户任务的事件(包括 output 中的输出行)只有管理员可以订阅
+		if all && !session.Admin {
+			return nil, fmt.Errorf("permission denied: only admins can receive events of other users' tasks")
+		}
+		bc.notifier.Enable(rw, session, all, types)
+		fmt.Fprintf(rw, "Notifications on: %s\n", formatEventTypes(types))
+	case "off":
+		bc.notifier.Disable(session)
+		fmt.Fprintln(rw, "Notifications off")
+	case "sink":
+		if !session.Admin {
+			return nil, fmt.Errorf("permission denied: only admins can manage notification sinks")
+		}
+		if len(args) >= 2 && args[1] == "add" {
+			sink, types, err := parseSink(args[2:])
+			if err != nil {
+				return nil, err
+			}
+			id := bc.notifier.AddSink(sink, types)
+			fmt.Fprintf(rw, "Added sink %d: %s (%s)\n", id, sink, formatEventTypes(types))
+			return nil, nil
+		}
+		if len(args) == 3 && args[1] == "rm" {
+			id, err := strconv.Atoi(args[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid sink ID: %v", err)
+			}
+			if err := bc.notifier.RemoveSink(id); err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(rw, "Removed sink %d\n", id)
+			return nil, nil
+		}
+		fmt.Fprintln(rw, notifystring)
+	default:
+		fmt.Fprintln(rw, notifystring)
+	}
+	return nil, nil
+}
+
+var tmstring = `Usage: tm <subcommand> [args]
+  status                       显示任务管理器状态、协程池占用和各状态的任务数
+  drain [--wait]               不再接受新任务，已有任务运行结束后不再重启，--wait 等待所有任务结束
+  undrain                      恢复接受新任务
+  reboot [--restart-running]   终止所有任务并重建协程池，--restart-running 以原命令和选项重新启动之前状态为 RUNNING 的任务(不含排队、暂停和等待重启的任务)
+  stop-all                     终止所有任务
+  pause <task_id>              向任务的子进程组发送 SIGSTOP (只支持启动子进程的命令)
+  resume <task_id>             向暂停的任务发送 SIGCONT
+drain、undrain、reboot 和 stop-all 只有管理员可以使用`
+
+func (bc *BasicCommands) handleTM(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	session := command.SessionFrom(ctx)
+	if len(args) < 1 {
+		fmt.Fprintln(rw, tmstring)
+		return nil, nil
+	}
+
+	switch args[0] {
+	case "status":
+		bc.tm.Status(rw)
+		return nil, nil
+	case "pause", "resume":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: tm %s <task_id>", args[0])
+		}
+		if args[0] == "pause" {
+			return nil, bc.tm.PauseTask(rw, session, args[1])
+		}
+		return nil, bc.tm.ResumeTask(rw, session, args[1])
+	case "drain", "undrain", "reboot", "stop-all":
+	default:
+		return nil, fmt.Errorf("unknown tm subcommand: %s", args[0])
+	}
+
+	if !session.Admin {
+		return nil, fmt.Errorf("permission denied: only admins can %s the task manager", args[0])
+	}
+	switch {
+	case args[0] == "drain" && len(args) == 1:
+		return nil, bc.tm.Drain(rw, ctx, false)
+	case args[0] == "drain" && len(args) == 2 && args[1] == "--wait":
+		return nil, bc.tm.Drain(rw, ctx, true)
+	case args[0] == "undrain" && len(args) == 1:
+		return nil, bc.tm.Undrain(rw)
+	case args[0] == "reboot" && len(args) == 1:
+		return nil, bc.tm.Reboot(rw, false)
+	case args[0] == "reboot" && len(args) == 2 && args[1] == "--restart-running":
+		return nil, bc.tm.Reboot(rw, true)
+	case args[0] == "stop-all" && len(args) == 1:
+		bc.tm.StopAll(rw)
+		return nil, nil
+	}
+	fmt.Fprintln(rw, tmstring)
+	return nil, nil
+}
+
+var triggerstring = `Usage: trigger <subcommand> [args]
+  add <task_id|name> --regex <re> --action <action> [options]   添加规则，输出的每一行匹配正则时执行动作
+      name 为匹配命令名或完整命令行的通配符，也作用于之后启动的任务；按任务 ID 添加的规则随任务结束删除
+      --action notify|kill|restart|run:<cmd>   发布 triggered 事件、终止任务、立即重启本次运行或启动后台命令
+      --cooldown DURATION   同一任务两次执行动作的最短间隔，期间的命中只计数 (默认 10s)
+      --stream stdout|stderr   只匹配一路输出 (默认两路)
+  list                 列出规则及其命中次数
+  rm <id>              删除规则
+每次执行动作都会发布 triggered 事件；非管理员按名称添加的规则只作用于自己的任务`
+
+func (bc *BasicCommands) handleTrigger(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	session := command.SessionFrom(ctx)
+	if len(args) < 1 {
+		fmt.Fprintln(rw, triggerstring)
+		return nil, nil
+	}
+
+	switch args[0] {
+	case "add":
+		t, err := ParseTrigger(args[1:])
+		if err != nil {
+			return nil, err
+		}
+		if t.TaskID != 0 {
+			if err := bc.tm.authorizeTask(session, t.TaskID); err != nil {
+				return nil, err
+			}
+		}
+		if t.Action == TriggerRun {
+			if _, err := bc.tm.lookup(t.Command[0]); err != nil {
+				return nil, err
+			}
+		}
+		t.Owner, t.Admin = session.User, session.Admin
+		id := bc.tm.triggers.Add(t)
+		fmt.Fprintf(rw, "Added trigger %d: %s %s\n", id, t.Target, t.rule())
+	case "list":
+		bc.tm.triggers.List(rw, session)
+	case "rm":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: trigger rm <id>")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid trigger ID: %v", err)
+		}
+		if err := bc.tm.triggers.Remove(session, id); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(rw, "Removed trigger %d\n", id)
+	default:
+		return nil, fmt.Errorf("unknown trigger subcommand: %s", args[0])
+	}
 	return nil, nil
 }
 
@@ -118,12 +983,12 @@ func (bc *BasicCommands) handleKill(rw io.ReadWriter, ctx context.Context, args
 		fmt.Fprint(rw, "usage: kill <task_id>")
 		return nil, nil
 	}
-	err := bc.tm.KillTask(rw, args[0])
+	err := bc.tm.KillTask(rw, command.SessionFrom(ctx), args[0])
 	return nil, err
 }
 
+// handleExit 只结束当前连接，协程池和后台任务由所有会话共享，不随之关闭
 func (bc *BasicCommands) handleExit(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
-	bc.tm.pool.Release()
 	fmt.Fprintln(rw, "Bye!")
 	return []byte("Bye!"), nil
 }
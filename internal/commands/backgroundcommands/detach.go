@@ -0,0 +1,454 @@
+package backgroundcommands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/recyvan/smf/internal/protocol"
+)
+
+const (
+	// detachedDirName 日志目录下保存独立运行任务状态的子目录
+	detachedDirName = "detached"
+	// shimName shim 程序名，优先在服务端程序所在目录查找，其次在 PATH 中查找
+	shimName = "smf-shim"
+	// detachedPoll 读取 shim 日志和检查其退出状态的间隔
+	detachedPoll = 200 * time.Millisecond
+)
+
+// detachedMeta 独立运行任务的元数据，服务端重启后据此接管任务
+type detachedMeta struct {
+	ID        int               `json:"id"`
+	Name      string            `json:"name"`
+	Args      []string          `json:"args"`
+	StartTime time.Time         `json:"start_time"`
+	ShimPID   int               `json:"shim_pid,omitempty"`
+	Stdin     bool              `json:"stdin,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Session   string            `json:"session,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// detachedStatus shim 在命令结束后写入的退出状态
+type detachedStatus struct {
+	ExitCode int       `json:"exit_code"`
+	Signal   string    `json:"signal,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	EndTime  time.Time `json:"end_time"`
+}
+
+// detachedTask 由 shim 独立运行的任务，命令的输入输出通过任务目录中的文件转发
+type detachedTask struct {
+	dir     string
+	shim    string
+	meta    detachedMeta
+	stdin   io.Reader // 命令原来的输入输出，shim 启动后开始转发
+	stdout  io.Writer
+	stderr  io.Writer
+	offsets [2]int64      // 本次运行开始转发日志的位置
+	exited  chan struct{} // 本次运行的 shim 退出后关闭
+	tails   sync.WaitGroup
+}
+
+// findShim 查找 shim 程序
+func findShim() (string, error) {
+	if exe, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(exe), shimName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	path, err := exec.LookPath(shimName)
+	if err != nil {
+		return "", fmt.Errorf("%s not found next to the server or in PATH", shimName)
+	}
+	return path, nil
+}
+
+// newDetached 为任务准备独立运行所需的 shim 和状态目录，调用方需持有 tasksLock
+func (tm *TaskManager) newDetached(id int) (*detachedTask, error) {
+	if err := detachSupported(); err != nil {
+		return nil, err
+	}
+	if tm.logDir == "" {
+		return nil, fmt.Errorf("detached tasks require a task log directory")
+	}
+	shim, err := findShim()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Join(tm.logDir, detachedDirName, fmt.Sprintf("task-%d", id)))
+	if err != nil {
+		return nil, err
+	}
+	return &detachedTask{dir: dir, shim: shim}, nil
+}
+
+// Detached 实现 command.DetachedLauncher
+func (task *Task) Detached() bool {
+	return task.detached != nil
+}
+
+// WrapCommand 实现 command.DetachedLauncher，将命令改为由 shim 在新会话中运行
+// 输入写入任务目录中的命名管道，输出由 shim 写入日志文件后转发回任务
+func (task *Task) WrapCommand(cmd *exec.Cmd) error {
+	d := task.detached
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create task directory: %v", err)
+	}
+	os.Remove(filepath.Join(d.dir, "status.json"))
+	if cmd.Stdin != nil {
+		if err := makeFifo(filepath.Join(d.dir, "stdin")); err != nil {
+			return fmt.Errorf("failed to create stdin pipe: %v", err)
+		}
+	}
+	d.meta = detachedMeta{
+		ID:        task.ID,
+		Name:      task.Name,
+		Args:      task.Args,
+		StartTime: task.StartTime,
+		Stdin:     cmd.Stdin != nil,
+		Owner:     task.opts.Owner,
+		Session:   task.opts.Session,
+		Labels:    task.opts.Labels,
+	}
+	if err := writeJSONFile(filepath.Join(d.dir, "meta.json"), d.meta); err != nil {
+		return err
+	}
+
+	args := []string{d.shim, "-dir", d.dir}
+	if cmd.Stdin != nil {
+		args = append(args, "-stdin")
+	}
+	args = append(append(args, "--", cmd.Path), cmd.Args[1:]...)
+	cmd.Path, cmd.Args = d.shim, args
+	setSession(cmd)
+
+	d.stdin, d.stdout, d.stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+	d.offsets = [2]int64{fileSize(filepath.Join(d.dir, "stdout.log")), fileSize(filepath.Join(d.dir, "stderr.log"))}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, nil, nil
+	return nil
+}
+
+// started shim 启动后记录其进程号并开始转发输入输出
+func (d *detachedTask) started(pid int) error {
+	d.meta.ShimPID = pid
+	d.exited = make(chan struct{})
+	d.follow("stdout.log", d.stdout, d.offsets[0])
+	d.follow("stderr.log", d.stderr, d.offsets[1])
+	if d.stdin != nil {
+		go d.forwardInput(d.stdin)
+	}
+	return writeJSONFile(filepath.Join(d.dir, "meta.json"), d.meta)
+}
+
+// stopped shim 退出后转发完日志中剩余的输出
+func (d *detachedTask) stopped() {
+	if d.exited == nil {
+		return
+	}
+	close(d.exited)
+	d.tails.Wait()
+	d.exited = nil
+}
+
+// follow 持续将日志文件 offset 之后新增的内容写入 w，shim 退出后读完剩余内容结束
+func (d *detachedTask) follow(name string, w io.Writer, offset int64) {
+	if w == nil {
+		w = io.Discard
+	}
+	path := filepath.Join(d.dir, name)
+	exited := d.exited
+	d.tails.Add(1)
+	go func() {
+		defer d.tails.Done()
+		ticker := time.NewTicker(detachedPoll)
+		defer ticker.Stop()
+		for {
+			done := false
+			select {
+			case <-exited:
+				done = true
+			case <-ticker.C:
+			}
+			offset = copyFileFrom(path, offset, w)
+			if done {
+				return
+			}
+		}
+	}()
+}
+
+// forwardInput 将任务的输入写入 shim 读取的命名管道，任务的输入关闭时结束
+func (d *detachedTask) forwardInput(input io.Reader) {
+	// 以读写方式打开，shim 尚未打开管道时不会阻塞
+	fifo, err := os.OpenFile(filepath.Join(d.dir, "stdin"), os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer fifo.Close()
+	io.Copy(fifo, input)
+}
+
+// copyFileFrom 将文件 offset 之后的内容写入 w，返回新的位置
+func copyFileFrom(path string, offset int64, w io.Writer) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return offset
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+	n, _ := io.Copy(w, f)
+	return offset + n
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// writeJSONFile 先写入临时文件再重命名，避免读到不完整的内容
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// adoptDetached 扫描独立运行任务的状态目录: 仍在运行的任务重新接管，已结束的写入历史，返回接管的任务数
+func (tm *TaskManager) adoptDetached() int {
+	tm.tasksLock.Lock()
+	logDir := tm.logDir
+	tm.tasksLock.Unlock()
+	if logDir == "" {
+		return 0
+	}
+	root, err := filepath.Abs(filepath.Join(logDir, detachedDirName))
+	if err != nil {
+		return 0
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0
+	}
+
+	adopted := 0
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		var meta detachedMeta
+		if err := readJSONFile(filepath.Join(dir, "meta.json"), &meta); err != nil {
+			continue
+		}
+		tm.tasksLock.Lock()
+		_, exists := tm.tasks[meta.ID]
+		if meta.ID > tm.taskID {
+			tm.taskID = meta.ID
+		}
+		tm.tasksLock.Unlock()
+		if exists {
+			continue
+		}
+
+		var status detachedStatus
+		if readJSONFile(filepath.Join(dir, "status.json"), &status) == nil {
+			tm.recordDetached(meta, dir, &status)
+			continue
+		}
+		if meta.ShimPID > 0 && shimAlive(meta.ShimPID, dir) {
+			tm.adopt(meta, dir)
+			adopted++
+			continue
+		}
+		// shim 可能在检查期间刚刚退出
+		if readJSONFile(filepath.Join(dir, "status.json"), &status) == nil {
+			tm.recordDetached(meta, dir, &status)
+		} else {
+			tm.recordDetached(meta, dir, nil)
+		}
+	}
+	return adopted
+}
+
+// recordDetached 将服务端停止期间已结束的任务写入历史并删除其状态目录
+// status 为 nil 表示 shim 没有记录退出状态就结束了
+func (tm *TaskManager) recordDetached(meta detachedMeta, dir string, status *detachedStatus) {
+	record := &TaskRecord{
+		ID:        meta.ID,
+		Name:      meta.Name,
+		Args:      meta.Args,
+		Status:    TaskStatusFailed,
+		StartTime: meta.StartTime,
+		EndTime:   time.Now(),
+		ExitCode:  1,
+		Error:     "shim exited without recording the exit status",
+		Owner:     meta.Owner,
+		Session:   meta.Session,
+		Labels:    meta.Labels,
+	}
+	if status != nil {
+		record.EndTime = status.EndTime
+		record.ExitCode = status.ExitCode
+		record.Error = status.Error
+		if record.Error == "" && status.Signal != "" {
+			record.Error = "killed by signal: " + status.Signal
+		}
+		if status.ExitCode == 0 && status.Error == "" {
+			record.Status = TaskStatusFinished
+		}
+	}
+	record.Duration = record.EndTime.Sub(record.StartTime)
+	record.LogFile, record.Output = tm.keepDetachedLog(filepath.Join(dir, "stdout.log"), meta.ID, meta.StartTime, false)
+	record.ErrLogFile, record.ErrOutput = tm.keepDetachedLog(filepath.Join(dir, "stderr.log"), meta.ID, meta.StartTime, true)
+	tm.history.Add(record)
+	os.RemoveAll(dir)
+}
+
+// keepDetachedLog 将 shim 的输出日志移到任务日志目录，返回新的路径；无法移动时返回输出的末尾部分
+func (tm *TaskManager) keepDetachedLog(src string, id int, started time.Time, stderr bool) (string, string) {
+	tm.tasksLock.Lock()
+	path := tm.logPath(id, started, stderr)
+	tm.tasksLock.Unlock()
+	if path != "" && os.Rename(src, path) == nil {
+		return path, ""
+	}
+	if data, err := readFileTail(src); err == nil {
+		return "", tail(string(data), maxSavedOutput)
+	}
+	return "", ""
+}
+
+// adopt 接管服务端重启前启动且仍在运行的任务，回放最近的输出后继续转发
+// 接管的任务不占用协程池，结束后不再按重启策略重启
+func (tm *TaskManager) adopt(meta detachedMeta, dir string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p, _ := os.FindProcess(meta.ShimPID)
+	task := &Task{
+		ID:           meta.ID,
+		Name:         meta.Name,
+		Args:         meta.Args,
+		Status:       TaskStatusRunning,
+		StartTime:    meta.StartTime,
+		Done:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		processes:    map[int]*os.Process{p.Pid: p},
+		opts:         TaskOptions{Restart: RestartNever, Detach: true, Owner: meta.Owner, Session: meta.Session, Labels: meta.Labels},
+		attemptStart: meta.StartTime,
+		detached:     &detachedTask{dir: dir, meta: meta, exited: make(chan struct{})},
+	}
+	tm.tasksLock.Lock()
+	// 接管后的输出写入新的日志文件，之前的日志保持不变；日志文件无法创建的警告写入任务的标准错误
+	var warnings bytes.Buffer
+	now := time.Now()
+	task.output = tm.openOutput(&warnings, task.ID, now, false)
+	task.errOutput = tm.openOutput(&warnings, task.ID, now, true)
+	tm.watchOutput(task)
+	tm.tasks[task.ID] = task
+	tm.tasksLock.Unlock()
+	task.errOutput.Write(warnings.Bytes())
+
+	if meta.Stdin {
+		if fifo, err := os.OpenFile(filepath.Join(dir, "stdin"), os.O_RDWR, 0); err == nil {
+			task.InputWriter = fifo
+		}
+	}
+	if task.InputWriter == nil {
+		// 命令没有输入，写入时返回错误
+		reader, writer := io.Pipe()
+		reader.Close()
+		task.InputWriter = writer
+	}
+
+	d := task.detached
+	stdout, stderr := filepath.Join(dir, "stdout.log"), filepath.Join(dir, "stderr.log")
+	d.follow("stdout.log", protocol.NewEscapeWriter(task.output), max(0, fileSize(stdout)-defaultRingSize))
+	d.follow("stderr.log", task.errOutput, max(0, fileSize(stderr)-defaultRingSize))
+	go tm.watchAdopted(task, p)
+}
+
+// watchAdopted 等待接管的 shim 退出，任务被终止时向其进程组发送 SIGTERM
+func (tm *TaskManager) watchAdopted(task *Task, p *os.Process) {
+	d := task.detached
+	statusPath := filepath.Join(d.dir, "status.json")
+	ticker := time.NewTicker(detachedPoll)
+	defer ticker.Stop()
+	cancelled := task.ctx.Done()
+	var status *detachedStatus
+	for {
+		select {
+		case <-cancelled:
+			terminateProcessGroup(p)
+			cancelled = nil
+		case <-ticker.C:
+		}
+		var s detachedStatus
+		if readJSONFile(statusPath, &s) == nil {
+			status = &s
+			break
+		}
+		if !shimAlive(p.Pid, d.dir) {
+			if readJSONFile(statusPath, &s) == nil {
+				status = &s
+			}
+			break
+		}
+	}
+	d.stopped()
+
+	var err error
+	task.procLock.Lock()
+	delete(task.processes, p.Pid)
+	if status != nil {
+		task.exitCode = status.ExitCode
+		task.exited = true
+		if status.Error != "" {
+			err = errors.New(status.Error)
+		}
+	} else {
+		err = fmt.Errorf("shim exited without recording the exit status")
+	}
+	task.procLock.Unlock()
+	task.InputWriter.Close()
+	tm.finishTask(task, nil, err)
+}
+
+// adopted 是否为服务端重启后接管的任务，接管的任务无法再次启动
+func (d *detachedTask) adopted() bool {
+	return d.shim == ""
+}
+
+// info task show 中显示的独立运行信息
+func (d *detachedTask) info() string {
+	if d.meta.ShimPID == 0 {
+		return d.dir
+	}
+	return "shim pid " + strconv.Itoa(d.meta.ShimPID) + ", " + d.dir
+}
@@ -0,0 +1,125 @@
+//go:build linux
+
+package backgroundcommands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeDetached 在日志目录下准备一个独立运行任务的状态目录
+func writeDetached(t *testing.T, logDir string, meta detachedMeta, stdout string, status *detachedStatus) string {
+	t.Helper()
+	dir := filepath.Join(logDir, detachedDirName, fmt.Sprintf("task-%d", meta.ID))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONFile(filepath.Join(dir, "meta.json"), meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stdout.log"), []byte(stdout), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status != nil {
+		if err := writeJSONFile(filepath.Join(dir, "status.json"), status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRecordDetachedFinishedWhileStopped(t *testing.T) {
+	tm := newTestManager(t)
+	logDir := t.TempDir()
+	started := time.Now().Add(-time.Minute)
+	exited := writeDetached(t, logDir, detachedMeta{ID: 7, Name: "exec", Args: []string{"job"}, StartTime: started, Owner: "alice"},
+		"hello\n", &detachedStatus{ExitCode: 3, EndTime: started.Add(time.Second)})
+	// shim 没有写入退出状态就结束了
+	lost := writeDetached(t, logDir, detachedMeta{ID: 9, Name: "exec", Args: []string{"lost"}, StartTime: started}, "", nil)
+
+	if adopted := tm.SetLogDir(logDir); adopted != 0 {
+		t.Fatalf("adopted %d task(s), want 0", adopted)
+	}
+
+	record, ok := tm.history.Get(7)
+	if !ok {
+		t.Fatal("task 7 is not in the history")
+	}
+	if record.Status != TaskStatusFailed || record.ExitCode != 3 || record.Owner != "alice" || record.Duration != time.Second {
+		t.Fatalf("record of task 7: %+v", record)
+	}
+	if data, err := os.ReadFile(record.LogFile); err != nil || string(data) != "hello\n" {
+		t.Fatalf("log of task 7 = %q, %v", data, err)
+	}
+	if record, ok := tm.history.Get(9); !ok || record.Status != TaskStatusFailed || !strings.Contains(record.Error, "without recording") {
+		t.Fatalf("record of task 9: %+v", record)
+	}
+	for _, dir := range []string{exited, lost} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("state directory %s was not removed", dir)
+		}
+	}
+	// 新任务的 ID 接在已有任务之后
+	if task := mustStart(t, tm, TaskOptions{}, "block"); task.ID != 10 {
+		t.Fatalf("new task got ID %d, want 10", task.ID)
+	}
+}
+
+func TestAdoptRunningDetached(t *testing.T) {
+	tm := newTestManager(t)
+	logDir := t.TempDir()
+	meta := detachedMeta{ID: 4, Name: "exec", Args: []string{"server"}, StartTime: time.Now(), Owner: "alice", Labels: map[string]string{"app": "web"}}
+	dir := writeDetached(t, logDir, meta, "before restart\n", nil)
+
+	// 用命令行中带有任务目录的进程代替 shim
+	shim := exec.Command("sh", "-c", "sleep 30; true", dir)
+	shim.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := shim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Kill(-shim.Process.Pid, syscall.SIGKILL)
+		shim.Wait()
+	})
+	meta.ShimPID = shim.Process.Pid
+	if err := writeJSONFile(filepath.Join(dir, "meta.json"), meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if adopted := tm.SetLogDir(logDir); adopted != 1 {
+		t.Fatalf("adopted %d task(s), want 1", adopted)
+	}
+	tm.tasksLock.Lock()
+	task := tm.tasks[4]
+	tm.tasksLock.Unlock()
+	if task == nil || taskStatus(tm, task) != TaskStatusRunning || task.opts.Owner != "alice" || task.opts.Labels["app"] != "web" {
+		t.Fatalf("adopted task: %+v", task)
+	}
+	output := func() string {
+		out, _ := task.snapshot()
+		return out
+	}
+	waitFor(t, "replayed output", func() bool { return strings.Contains(output(), "before restart") })
+
+	f, err := os.OpenFile(filepath.Join(dir, "stdout.log"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("after restart\n")
+	f.Close()
+	waitFor(t, "new output", func() bool { return strings.Contains(output(), "after restart") })
+
+	if err := writeJSONFile(filepath.Join(dir, "status.json"), detachedStatus{EndTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, task)
+	if task.record.Status != TaskStatusFinished {
+		t.Fatalf("adopted task ended as %s, want %s", task.record.Status, TaskStatusFinished)
+	}
+}
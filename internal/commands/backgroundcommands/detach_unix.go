@@ -0,0 +1,51 @@
+//go:build !windows
+
+package backgroundcommands
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detachSupported 当前平台是否支持独立运行任务
+func detachSupported() error {
+	return nil
+}
+
+// makeFifo 创建命名管道，已存在时复用
+func makeFifo(path string) error {
+	if err := syscall.Mkfifo(path, 0600); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	return nil
+}
+
+// setSession shim 作为新会话的首进程运行，不随服务端的终端或会话退出
+func setSession(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+}
+
+// shimAlive shim 进程是否仍在运行，进程号可能已被复用，能读取命令行时确认其属于该任务目录
+func shimAlive(pid int, dir string) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return !os.IsNotExist(err) || !procMounted()
+	}
+	return bytes.Contains(cmdline, []byte(dir))
+}
+
+// procMounted 是否可以通过 /proc 查看进程信息
+func procMounted() bool {
+	_, err := os.Stat("/proc/self/cmdline")
+	return err == nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package backgroundcommands
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// detachSupported Windows 上没有 smf-shim
+func detachSupported() error {
+	return fmt.Errorf("detached tasks are not supported on this platform")
+}
+
+func makeFifo(path string) error {
+	return detachSupported()
+}
+
+func setSession(cmd *exec.Cmd) {}
+
+func shimAlive(pid int, dir string) bool {
+	return false
+}
@@ -0,0 +1,223 @@
+package backgroundcommands
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType 任务生命周期事件的类型
+type EventType string
+
+const (
+	EventStarted   EventType = "started"   // 任务的一次运行开始
+	EventOutput    EventType = "output"    // 任务输出了一行
+	EventRestarted EventType = "restarted" // 任务退出后按重启策略等待重启
+	EventFinished  EventType = "finished"  // 任务正常结束
+	EventFailed    EventType = "failed"    // 任务失败或进入崩溃循环
+	EventKilled    EventType = "killed"    // 任务被终止
+	EventTriggered EventType = "triggered" // 任务输出匹配了触发规则
+	EventUnhealthy EventType = "unhealthy" // 健康检查连续失败
+)
+
+// eventTypes 所有事件类型，用于解析 --events
+var eventTypes = []EventType{EventStarted, EventOutput, EventRestarted, EventFinished, EventFailed, EventKilled, EventTriggered, EventUnhealthy}
+
+const (
+	// eventBuffer 每个订阅者缓冲的事件数，订阅者处理不及时时丢弃新事件
+	eventBuffer = 256
+	// maxEventLine output 事件一行的最大长度，超过时截断为多行
+	maxEventLine = 4096
+)
+
+// Event 任务生命周期事件，以 JSON 格式发送给 webhook、文件和命令
+type Event struct {
+	Type     EventType         `json:"type"`
+	Time     time.Time         `json:"time"`
+	TaskID   int               `json:"task_id"`
+	Command  string            `json:"command"`
+	Owner    string            `json:"owner,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Status   TaskStatus        `json:"status,omitempty"`
+	ExitCode int               `json:"exit_code"`
+	Reason   string            `json:"reason,omitempty"` // 退出或重启的原因
+	Attempt  int               `json:"attempt,omitempty"`
+	Stream   string            `json:"stream,omitempty"` // output 事件: stdout 或 stderr
+	Line     string            `json:"line,omitempty"`
+}
+
+// String 单行描述事件，用于推送给会话
+func (e Event) String() string {
+	prefix := fmt.Sprintf("task %d (%s)", e.TaskID, e.Command)
+	switch e.Type {
+	case EventStarted:
+		if e.Attempt > 1 {
+			return fmt.Sprintf("%s started, attempt %d", prefix, e.Attempt)
+		}
+		return prefix + " started"
+	case EventOutput:
+		return fmt.Sprintf("task %d %s: %s", e.TaskID, e.Stream, e.Line)
+	case EventRestarted:
+		return fmt.Sprintf("%s exited (%s), restarting", prefix, e.Reason)
+	case EventTriggered:
+		return fmt.Sprintf("%s %s: %s", prefix, e.Reason, e.Line)
+	default:
+		return fmt.Sprintf("%s %s: %s", prefix, e.Type, e.Reason)
+	}
+}
+
+// ParseEventTypes 解析逗号分隔的事件类型，all 表示所有类型
+func ParseEventTypes(value string) (map[EventType]bool, error) {
+	types := make(map[EventType]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			for _, t := range eventTypes {
+				types[t] = true
+			}
+			continue
+		}
+		valid := false
+		for _, t := range eventTypes {
+			if EventType(name) == t {
+				types[t] = true
+				valid = true
+			}
+		}
+		if !valid {
+			names := make([]string, len(eventTypes))
+			for i, t := range eventTypes {
+				names[i] = string(t)
+			}
+			return nil, fmt.Errorf("invalid event type: %s (%s, all)", name, strings.Join(names, ", "))
+		}
+	}
+	return types, nil
+}
+
+// formatEventTypes 按固定顺序显示事件类型
+func formatEventTypes(types map[EventType]bool) string {
+	var names []string
+	for _, t := range eventTypes {
+		if types[t] {
+			names = append(names, string(t))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// eventSubscriber 事件的一个订阅者
+type eventSubscriber struct {
+	ch     chan Event
+	filter func(Event) bool
+}
+
+// EventBus 任务事件总线: 发布不阻塞任务，每个订阅者有独立的缓冲
+type EventBus struct {
+	mu     sync.Mutex
+	subs   map[int]*eventSubscriber
+	nextID int
+}
+
+// NewEventBus 创建事件总线
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[int]*eventSubscriber)}
+}
+
+// Subscribe 订阅满足 filter 的事件，返回事件通道和取消订阅的函数，取消后通道关闭
+func (b *EventBus) Subscribe(filter func(Event) bool) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	id := b.nextID
+	sub := &eventSubscriber{ch: make(chan Event, eventBuffer), filter: filter}
+	b.subs[id] = sub
+	return sub.ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[id]; ok {
+			delete(b.subs, id)
+			close(sub.ch)
+		}
+	}
+}
+
+// Publish 发布事件，订阅者的缓冲已满时丢弃
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+// taskEvent 创建任务的事件，只读取任务创建后不再修改的字段
+func taskEvent(task *Task, t EventType) Event {
+	return Event{
+		Type:    t,
+		Time:    time.Now(),
+		TaskID:  task.ID,
+		Command: strings.TrimSpace(task.Name + " " + strings.Join(task.Args, " ")),
+		Owner:   task.opts.Owner,
+		Labels:  task.opts.Labels,
+	}
+}
+
+// lineSplitter 将输出按行切分，不完整的行等待后续数据
+type lineSplitter struct {
+	partial []byte
+	emit    func(line string)
+}
+
+func (s *lineSplitter) Write(p []byte) {
+	s.partial = append(s.partial, p...)
+	for {
+		idx := bytes.IndexByte(s.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		s.emit(strings.TrimSuffix(string(s.partial[:idx]), "\r"))
+		s.partial = s.partial[idx+1:]
+	}
+	for len(s.partial) > maxEventLine {
+		s.emit(string(s.partial[:maxEventLine]))
+		s.partial = s.partial[maxEventLine:]
+	}
+}
+
+// Flush 输出剩余不完整的行
+func (s *lineSplitter) Flush() {
+	if len(s.partial) > 0 {
+		s.emit(string(s.partial))
+		s.partial = nil
+	}
+}
+
+// watchOutput 将任务两路输出的每一行作为 output 事件发布，并按触发规则执行动作
+func (tm *TaskManager) watchOutput(task *Task) {
+	for _, stream := range []struct {
+		name   string
+		output *taskOutput
+	}{{"stdout", task.output}, {"stderr", task.errOutput}} {
+		name := stream.name
+		stream.output.setLineFunc(func(line string) {
+			e := taskEvent(task, EventOutput)
+			e.Stream, e.Line = name, line
+			tm.events.Publish(e)
+			for _, t := range tm.triggers.match(task, name, line) {
+				go tm.fireTrigger(task, t, name, line)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package backgroundcommands
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// systemSession 调度器和工作流等内部调用使用的会话，可以操作所有任务
+var systemSession = command.Session{User: "system", ID: "system", Admin: true}
+
+// authorize 检查会话能否操作任务: 管理员可以操作所有任务，其它用户只能操作自己启动的任务
+func authorize(session command.Session, task *Task) error {
+	return authorizeOwner(session, task.ID, task.opts.Owner)
+}
+
+// authorizeRecord 检查会话能否查看历史中的任务，规则与 authorize 相同
+func authorizeRecord(session command.Session, record *TaskRecord) error {
+	return authorizeOwner(session, record.ID, record.Owner)
+}
+
+func authorizeOwner(session command.Session, id int, owner string) error {
+	if session.Admin || (owner != "" && owner == session.User) {
+		return nil
+	}
+	if owner == "" {
+		owner = "the system"
+	}
+	return fmt.Errorf("permission denied: task %d belongs to %s", id, owner)
+}
+
+// ParseLabel 解析 key=value 格式的标签
+func ParseLabel(value string) (string, string, error) {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid label: %s (expected key=value)", value)
+	}
+	return key, val, nil
+}
+
+// formatLabels 按键排序显示标签，没有标签时为 -
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + labels[key]
+	}
+	return strings.Join(parts, ",")
+}
+
+// TaskFilter check 命令的过滤和排序条件，零值列出全部任务并按 ID 排序
+type TaskFilter struct {
+	User     string
+	System   bool              // 只列出没有所有者的系统任务
+	Labels   map[string]string // 需要全部匹配
+	Statuses []TaskStatus      // 匹配其中任意一个
+	Name     string            // 匹配命令名或完整命令行的通配符
+	Sort     string
+	Reverse  bool
+}
+
+// sortKeys check --sort 支持的排序字段
+var sortKeys = []string{"id", "start", "duration", "name", "status", "user"}
+
+// ParseTaskFilter 解析 check 的过滤参数，返回是否需要同时列出历史中的任务
+func ParseTaskFilter(args []string) (TaskFilter, bool, error) {
+	var filter TaskFilter
+	all := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-a", "--all":
+			all = true
+			continue
+		case "-r", "--reverse":
+			filter.Reverse = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return filter, false, fmt.Errorf("missing value for %s", args[i])
+		}
+		value := args[i+1]
+		switch args[i] {
+		case "--user":
+			if value == "-" {
+				filter.System = true
+			} else {
+				filter.User = value
+			}
+		case "--label":
+			key, val, err := ParseLabel(value)
+			if err != nil {
+				return filter, false, err
+			}
+			if filter.Labels == nil {
+				filter.Labels = make(map[string]string)
+			}
+			filter.Labels[key] = val
+		case "--status":
+			for _, status := range strings.Split(value, ",") {
+				filter.Statuses = append(filter.Statuses, TaskStatus(strings.ToUpper(strings.TrimSpace(status))))
+			}
+		case "--name":
+			if _, err := path.Match(value, ""); err != nil {
+				return filter, false, fmt.Errorf("invalid name pattern: %s", value)
+			}
+			filter.Name = value
+		case "--sort":
+			valid := false
+			for _, key := range sortKeys {
+				valid = valid || key == value
+			}
+			if !valid {
+				return filter, false, fmt.Errorf("invalid sort key: %s (%s)", value, strings.Join(sortKeys, ", "))
+			}
+			filter.Sort = value
+		default:
+			return filter, false, fmt.Errorf("unknown option: %s", args[i])
+		}
+		i++
+	}
+	return filter, all, nil
+}
+
+// taskRow check 中的一行，来自运行中的任务或历史记录
+type taskRow struct {
+	id       int
+	status   TaskStatus
+	health   string // 健康检查的结果，没有检查或已结束时为 -
+	start    time.Time
+	duration time.Duration
+	exit     string // 已结束任务的退出码，运行中为 -
+	restarts int
+	lastExit string
+	usage    string
+	owner    string
+	labels   map[string]string
+	name     string
+	command  string
+}
+
+// match 行是否满足所有过滤条件
+func (f TaskFilter) match(row taskRow) bool {
+	if (f.User != "" && row.owner != f.User) || (f.System && row.owner != "") {
+		return false
+	}
+	for key, val := range f.Labels {
+		if v, ok := row.labels[key]; !ok || v != val {
+			return false
+		}
+	}
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, status := range f.Statuses {
+			found = found || status == row.status
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Name != "" {
+		byName, _ := path.Match(f.Name, row.name)
+		byCommand, _ := path.Match(f.Name, row.command)
+		if !byName && !byCommand {
+			return false
+		}
+	}
+	return true
+}
+
+// apply 过滤并排序，相同时按 ID 排序
+func (f TaskFilter) apply(rows []taskRow) []taskRow {
+	matched := rows[:0]
+	for _, row := range rows {
+		if f.match(row) {
+			matched = append(matched, row)
+		}
+	}
+	less := func(a, b taskRow) bool {
+		switch f.Sort {
+		case "start":
+			if !a.start.Equal(b.start) {
+				return a.start.Before(b.start)
+			}
+		case "duration":
+			if a.duration != b.duration {
+				return a.duration < b.duration
+			}
+		case "name":
+			if a.command != b.command {
+				return a.command < b.command
+			}
+		case "status":
+			if a.status != b.status {
+				return a.status < b.status
+			}
+		case "user":
+			if a.owner != b.owner {
+				return a.owner < b.owner
+			}
+		}
+		return a.id < b.id
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if f.Reverse {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+	return matched
+}
+
+// taskRowOf 运行中任务的行，调用方需持有 tasksLock
+func taskRowOf(task *Task) taskRow {
+	lastExit := task.lastExit
+	if lastExit == "" {
+		lastExit = "-"
+	}
+	return taskRow{
+		id:       task.ID,
+		status:   task.Status,
+		health:   task.healthLabel(),
+		start:    task.StartTime,
+		duration: time.Since(task.StartTime),
+		exit:     "-",
+		restarts: task.restarts,
+		lastExit: lastExit,
+		usage:    task.resourceUsage().summary(task.opts.Limits),
+		owner:    task.opts.Owner,
+		labels:   task.opts.Labels,
+		name:     task.Name,
+		command:  strings.TrimSpace(task.Name + " " + strings.Join(task.Args, " ")),
+	}
+}
+
+// recordRow 历史记录的行
+func recordRow(record *TaskRecord) taskRow {
+	usage := "-"
+	if record.Usage != nil {
+		usage = record.Usage.summary(ResourceLimits{})
+	}
+	return taskRow{
+		id:       record.ID,
+		status:   record.Status,
+		health:   "-",
+		start:    record.StartTime,
+		duration: record.Duration,
+		exit:     fmt.Sprint(record.ExitCode),
+		restarts: record.Restarts,
+		usage:    usage,
+		owner:    record.Owner,
+		labels:   record.Labels,
+		name:     record.Name,
+		command:  strings.TrimSpace(record.Name + " " + strings.Join(record.Args, " ")),
+	}
+}
+
+// ownerName 显示任务的所有者，系统任务为 -
+func ownerName(owner string) string {
+	if owner == "" {
+		return "-"
+	}
+	return owner
+}
@@ -0,0 +1,281 @@
+package backgroundcommands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// HealthState 任务健康检查的结果
+type HealthState string
+
+const (
+	HealthStarting  HealthState = "STARTING"  // 本次运行尚未完成第一次检查
+	HealthHealthy   HealthState = "HEALTHY"   // 最近一次检查成功
+	HealthUnhealthy HealthState = "UNHEALTHY" // 连续失败次数达到上限
+)
+
+// HealthAction 健康检查连续失败后的处理方式
+type HealthAction string
+
+const (
+	HealthRestart HealthAction = "restart" // 结束本次运行并立即重启
+	HealthKill    HealthAction = "kill"    // 终止任务
+	HealthNone    HealthAction = "none"    // 只标记为 UNHEALTHY
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultHealthRetries  = 3
+)
+
+// HealthCheck 任务的健康检查: 运行命令、连接 TCP 端口、请求本机 HTTP 地址或检查最近是否有输出
+type HealthCheck struct {
+	Kind     string // exec, tcp, http 或 output
+	Target   string
+	Command  []string      // exec 检查的命令和参数
+	Within   time.Duration // output 检查: 最近这段时间内需要有输出
+	Interval time.Duration
+	Timeout  time.Duration
+	Retries  int // 连续失败多少次后按 Action 处理
+	Action   HealthAction
+}
+
+// ParseHealthProbe 解析健康检查: exec:<cmd> | tcp:[host:]port | http:<url> | output:<duration>
+func ParseHealthProbe(value string) (*HealthCheck, error) {
+	kind, target, ok := strings.Cut(value, ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("invalid health check: %s (exec:<cmd>, tcp:[host:]port, http:<url>, output:<duration>)", value)
+	}
+	hc := &HealthCheck{
+		Kind:     kind,
+		Target:   target,
+		Interval: defaultHealthInterval,
+		Timeout:  defaultHealthTimeout,
+		Retries:  defaultHealthRetries,
+		Action:   HealthRestart,
+	}
+	switch kind {
+	case "exec":
+		parts, err := command.SplitArgs(target)
+		if err != nil || len(parts) == 0 {
+			return nil, fmt.Errorf("invalid health check command: %s", target)
+		}
+		hc.Command = parts
+	case "tcp":
+		if _, err := strconv.Atoi(target); err == nil {
+			hc.Target = net.JoinHostPort("127.0.0.1", target)
+		} else if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("invalid health check address: %s", target)
+		}
+	case "http":
+		// http:<url> 中的 url 自带协议，例如 http:http://127.0.0.1:8080/healthz
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid health check URL: %s", target)
+		}
+		if !isLocalHost(u.Hostname()) {
+			return nil, fmt.Errorf("health check URL must be on localhost: %s", target)
+		}
+	case "output":
+		within, err := time.ParseDuration(target)
+		if err != nil || within <= 0 {
+			return nil, fmt.Errorf("invalid health check duration: %s", target)
+		}
+		hc.Within = within
+	default:
+		return nil, fmt.Errorf("invalid health check type: %s (exec, tcp, http, output)", kind)
+	}
+	return hc, nil
+}
+
+// ParseHealthAction 解析健康检查失败后的处理方式
+func ParseHealthAction(value string) (HealthAction, error) {
+	switch action := HealthAction(value); action {
+	case HealthRestart, HealthKill, HealthNone:
+		return action, nil
+	default:
+		return "", fmt.Errorf("invalid health action: %s (restart, kill, none)", value)
+	}
+}
+
+// checkHealthAction 检查健康检查失败后的处理方式能否用于命令，restart 需要命令在子进程中运行
+func checkHealthAction(cmd command.Ecommand, hc *HealthCheck) error {
+	if hc == nil || hc.Action != HealthRestart || cmd.RunsProcess {
+		return nil
+	}
+	return fmt.Errorf("--health-action restart requires a command that runs a child process (exec, pyexec, run); use kill or none for %s", cmd.Name)
+}
+
+// isLocalHost 主机名是否指向本机
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// String 单行描述健康检查
+func (hc *HealthCheck) String() string {
+	return fmt.Sprintf("%s:%s every %s, %d retries, then %s", hc.Kind, hc.Target, hc.Interval, hc.Retries, hc.Action)
+}
+
+// probe 运行一次检查，lastOutput 为本次运行最近一次输出的时间
+func (hc *HealthCheck) probe(ctx context.Context, lastOutput time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+	switch hc.Kind {
+	case "exec":
+		cmd := exec.CommandContext(ctx, hc.Command[0], hc.Command[1:]...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			if msg := strings.TrimSpace(string(output)); msg != "" {
+				return fmt.Errorf("%v: %s", err, msg)
+			}
+			return err
+		}
+	case "tcp":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", hc.Target)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.Target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("http status %s", resp.Status)
+		}
+	case "output":
+		if idle := time.Since(lastOutput); idle > hc.Within {
+			return fmt.Errorf("no output for %s", idle.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// healthStatus 任务本次运行的健康状态，由 tasksLock 保护
+type healthStatus struct {
+	state    HealthState
+	failures int    // 连续失败次数
+	last     string // 最近一次检查的结果
+	checked  time.Time
+}
+
+// healthLabel check 中显示的健康状态，没有健康检查时为 -
+func (task *Task) healthLabel() string {
+	if task.opts.Health == nil || task.Status != TaskStatusRunning {
+		return "-"
+	}
+	return string(task.health.state)
+}
+
+// watchHealth 按间隔检查任务，直到任务结束；每次运行开始后等待一个间隔再检查
+func (tm *TaskManager) watchHealth(task *Task) {
+	hc := task.opts.Health
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-task.Done:
+			return
+		case <-ticker.C:
+		}
+
+		tm.tasksLock.Lock()
+		running := task.Status == TaskStatusRunning
+		attempt, started := task.restarts, task.attemptStart
+		tm.tasksLock.Unlock()
+		if !running || time.Since(started) < hc.Interval {
+			continue
+		}
+
+		lastOutput := started
+		for _, t := range []time.Time{task.output.lastWrite(), task.errOutput.lastWrite()} {
+			if t.After(lastOutput) {
+				lastOutput = t
+			}
+		}
+		err := hc.probe(task.ctx, lastOutput)
+		if tm.recordHealth(task, attempt, err) {
+			tm.healthFailed(task)
+		}
+	}
+}
+
+// recordHealth 记录一次检查的结果，返回本次运行是否刚刚达到失败上限
+// 检查期间任务已重启或结束时忽略结果
+func (tm *TaskManager) recordHealth(task *Task, attempt int, err error) bool {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	if task.Status != TaskStatusRunning || task.restarts != attempt {
+		return false
+	}
+	h := &task.health
+	h.checked = time.Now()
+	if err == nil {
+		h.state, h.failures, h.last = HealthHealthy, 0, "ok"
+		return false
+	}
+	h.failures++
+	h.last = err.Error()
+	// 处理后仍然失败时，每再连续失败 Retries 次再处理一次
+	if h.failures%task.opts.Health.Retries != 0 {
+		return false
+	}
+	h.state = HealthUnhealthy
+	e := taskEvent(task, EventUnhealthy)
+	e.Status = task.Status
+	e.Reason = fmt.Sprintf("%d health checks failed, last: %s", h.failures, h.last)
+	tm.events.Publish(e)
+	return true
+}
+
+// healthFailed 按策略处理连续失败的任务
+func (tm *TaskManager) healthFailed(task *Task) {
+	hc := task.opts.Health
+	var err error
+	switch hc.Action {
+	case HealthRestart:
+		err = tm.restartTask(task, fmt.Sprintf("restarted after %d failed health checks", hc.Retries))
+	case HealthKill:
+		fmt.Fprintf(task.errOutput, "[%d health checks failed, killing task %d]\n", hc.Retries, task.ID)
+		rw := &taskIO{reader: strings.NewReader(""), writer: io.Discard, errWriter: io.Discard}
+		err = tm.KillTask(rw, systemSession, strconv.Itoa(task.ID))
+	}
+	if err != nil {
+		fmt.Fprintf(task.errOutput, "[health check %s failed: %v]\n", hc.Action, err)
+	}
+}
+
+// showHealth 在 task show 中显示健康检查的设置和结果
+func showHealth(rw io.ReadWriter, task *Task) {
+	hc := task.opts.Health
+	if hc == nil {
+		return
+	}
+	fmt.Fprintf(rw, "Health:     %s (%s)\n", task.healthLabel(), hc)
+	if !task.health.checked.IsZero() {
+		fmt.Fprintf(rw, "Last Check: %s, %d consecutive failures, %s\n",
+			task.health.checked.Format("15:04:05"), task.health.failures, task.health.last)
+	}
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package backgroundcommands
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthRestartRequiresProcess(t *testing.T) {
+	tm := newTestManager(t)
+	hc := &HealthCheck{Kind: "output", Target: "1h", Within: time.Hour, Interval: time.Hour, Timeout: time.Second, Retries: 3, Action: HealthRestart}
+
+	var out bytes.Buffer
+	if id := tm.StartTask(&out, TaskOptions{Health: hc}, "block"); id != 0 {
+		t.Fatalf("started task %d with --health-action restart for a command without child processes", id)
+	}
+	if !strings.Contains(out.String(), "--health-action restart requires") {
+		t.Fatalf("StartTask output: %q", out.String())
+	}
+
+	none := *hc
+	none.Action = HealthNone
+	mustStart(t, tm, TaskOptions{Health: &none}, "block")
+	mustStart(t, tm, TaskOptions{Health: hc}, "sleep")
+}
+
+// TestHealthActionRepeats 处理后仍然失败时，每连续失败 Retries 次再处理一次
+func TestHealthActionRepeats(t *testing.T) {
+	tm := newTestManager(t)
+	hc := &HealthCheck{Kind: "output", Target: "1h", Within: time.Hour, Interval: time.Hour, Timeout: time.Second, Retries: 3, Action: HealthNone}
+	task := mustStart(t, tm, TaskOptions{Health: hc}, "block")
+
+	var fired []int
+	for i := 1; i <= 7; i++ {
+		if tm.recordHealth(task, 0, errors.New("down")) {
+			fired = append(fired, i)
+		}
+	}
+	if len(fired) != 2 || fired[0] != 3 || fired[1] != 6 {
+		t.Fatalf("health action fired after failures %v, want [3 6]", fired)
+	}
+	tm.recordHealth(task, 0, nil)
+	if tm.recordHealth(task, 0, errors.New("down")) {
+		t.Fatal("health action fired after a single failure following a success")
+	}
+}
@@ -0,0 +1,238 @@
+package backgroundcommands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHistoryFile 任务历史的默认持久化文件
+	DefaultHistoryFile = "task_history.jsonl"
+	// defaultHistorySize 保留的已结束任务数量
+	defaultHistorySize = 100
+	// maxSavedOutput 没有日志文件时每个任务在内存中保留的输出上限(保留末尾部分)
+	maxSavedOutput = 64 * 1024
+)
+
+// TaskRecord 已结束任务的记录
+type TaskRecord struct {
+	ID        int               `json:"id"`
+	Name      string            `json:"name"`
+	Args      []string          `json:"args"`
+	Status    TaskStatus        `json:"status"`
+	StartTime time.Time         `json:"start_time"`
+	EndTime   time.Time         `json:"end_time"`
+	Duration  time.Duration     `json:"duration"`
+	Result    []byte            `json:"result,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	ExitCode  int               `json:"exit_code"`
+	Restarts  int               `json:"restarts,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Session   string            `json:"session,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Limits    string            `json:"limits,omitempty"`
+	Usage     *ResourceUsage    `json:"usage,omitempty"`
+	Triggers  []TriggerHits     `json:"triggers,omitempty"`
+	// 输出保存在日志文件中，不写入历史文件；没有日志文件时只在内存中保留末尾部分
+	LogFile    string `json:"log_file,omitempty"`
+	ErrLogFile string `json:"err_log_file,omitempty"`
+	Output     string `json:"-"`
+	ErrOutput  string `json:"-"`
+}
+
+// TaskHistory 有界的任务历史，可选持久化到 JSONL 文件
+// 每个结束的任务追加一行，文件中的行数超过上限的两倍时按内存中的记录重写
+type TaskHistory struct {
+	mu      sync.Mutex
+	records []*TaskRecord
+	limit   int
+	path    string
+	lines   int // 持久化文件中的记录行数
+}
+
+// NewTaskHistory 创建任务历史
+func NewTaskHistory(limit int) *TaskHistory {
+	return &TaskHistory{limit: limit}
+}
+
+// SetFile 设置持久化文件并加载其中已有的记录，path 为空时关闭持久化
+// 无法解析的行(例如写入中断的最后一行)会被跳过，旧版本的 JSON 数组文件会被转换为 JSONL
+func (h *TaskHistory) SetFile(path string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.path = path
+	h.lines = 0
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read task history: %v", err)
+	}
+
+	var records []*TaskRecord
+	legacy := bytes.HasPrefix(bytes.TrimSpace(data), []byte("["))
+	if legacy {
+		if err := json.Unmarshal(data, &records); err != nil {
+			return fmt.Errorf("failed to parse task history %s: %v", path, err)
+		}
+	} else {
+		skipped := 0
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var record TaskRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				skipped++
+				continue
+			}
+			records = append(records, &record)
+		}
+		if skipped > 0 {
+			fmt.Printf("Warning: skipped %d malformed line(s) in task history %s\n", skipped, path)
+		}
+		h.lines = len(records)
+	}
+	h.records = append(records, h.records...)
+	h.trim()
+	if legacy || h.compactDue() {
+		return h.compact()
+	}
+	return nil
+}
+
+// Add 添加一条记录，超出上限时丢弃最早的记录
+func (h *TaskHistory) Add(record *TaskRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, record)
+	h.trim()
+	if err := h.append(record); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// Get 按任务 ID 查找记录
+func (h *TaskHistory) Get(id int) (*TaskRecord, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, record := range h.records {
+		if record.ID == id {
+			return record, true
+		}
+	}
+	return nil, false
+}
+
+// List 按结束顺序返回所有记录
+func (h *TaskHistory) List() []*TaskRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*TaskRecord{}, h.records...)
+}
+
+// MaxID 返回历史中最大的任务 ID，用于重启后继续编号
+func (h *TaskHistory) MaxID() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	maxID := 0
+	for _, record := range h.records {
+		if record.ID > maxID {
+			maxID = record.ID
+		}
+	}
+	return maxID
+}
+
+func (h *TaskHistory) trim() {
+	if h.limit > 0 && len(h.records) > h.limit {
+		h.records = h.records[len(h.records)-h.limit:]
+	}
+}
+
+// append 在持久化文件末尾追加一条记录
+func (h *TaskHistory) append(record *TaskRecord) error {
+	if h.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode task history: %v", err)
+	}
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write task history: %v", err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write task history: %v", err)
+	}
+	h.lines++
+	if h.compactDue() {
+		return h.compact()
+	}
+	return nil
+}
+
+// compactDue 文件中已丢弃的记录过多时需要重写
+func (h *TaskHistory) compactDue() bool {
+	return h.limit > 0 && h.lines > 2*h.limit
+}
+
+// compact 按内存中的记录重写持久化文件，写入临时文件后重命名，避免写入中断导致文件损坏
+func (h *TaskHistory) compact() error {
+	var buf bytes.Buffer
+	for _, record := range h.records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode task history: %v", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write task history: %v", err)
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return fmt.Errorf("failed to write task history: %v", err)
+	}
+	h.lines = len(h.records)
+	return nil
+}
+
+// recordOutput 返回已结束任务的标准输出或标准错误，有日志文件时从日志文件末尾读取
+func recordOutput(record *TaskRecord, stderr bool) string {
+	path, output := record.LogFile, record.Output
+	if stderr {
+		path, output = record.ErrLogFile, record.ErrOutput
+	}
+	if path == "" {
+		return output
+	}
+	data, err := readFileTail(path)
+	if err != nil {
+		return output
+	}
+	return string(data)
+}
+
+// tail 截取输出末尾的 limit 字节
+func tail(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return s[len(s)-limit:]
+}
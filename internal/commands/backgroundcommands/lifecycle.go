@@ -0,0 +1,285 @@
+package backgroundcommands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// managerState 任务管理器的状态
+type managerState string
+
+const (
+	managerAccepting managerState = "accepting" // 正常接受新任务
+	managerDraining  managerState = "draining"  // 不再接受新任务，已有任务运行结束后不再重启
+	managerRebooting managerState = "rebooting" // 正在停止所有任务并重建协程池
+)
+
+// drainPoll tm drain --wait 检查任务是否全部结束的间隔
+const drainPoll = 200 * time.Millisecond
+
+// accepting 是否接受新任务和重启，调用方需持有 tasksLock
+func (tm *TaskManager) accepting() error {
+	switch tm.state {
+	case managerDraining:
+		return fmt.Errorf("task manager is draining, not accepting new tasks")
+	case managerRebooting:
+		return fmt.Errorf("task manager is rebooting")
+	}
+	return nil
+}
+
+// aliveTasks 返回所有排队、运行、暂停或等待重启的任务，按 ID 排序
+func (tm *TaskManager) aliveTasks() []*Task {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	var tasks []*Task
+	for _, task := range tm.tasks {
+		if task.alive() {
+			tasks = append(tasks, task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	return tasks
+}
+
+// Status 显示任务管理器的状态、协程池占用和各状态的任务数
+func (tm *TaskManager) Status(rw io.ReadWriter) {
+	tm.tasksLock.Lock()
+	counts := make(map[TaskStatus]int)
+	for _, task := range tm.tasks {
+		counts[task.Status]++
+	}
+	state, running, queued := tm.state, tm.running, tm.queue.Len()
+	poolSize, queueLimit := tm.poolSize, tm.queueLimit
+	tm.tasksLock.Unlock()
+
+	fmt.Fprintf(rw, "State:      %s\n", state)
+	fmt.Fprintf(rw, "Pool:       %d/%d running, %d queued (limit %d)\n", running, poolSize, queued, queueLimit)
+	var parts []string
+	for _, status := range []TaskStatus{TaskStatusQueued, TaskStatusRunning, TaskStatusPaused, TaskStatusRestarting, TaskStatusStopped} {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", status, counts[status]))
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "none")
+	}
+	fmt.Fprintf(rw, "Tasks:      %s\n", strings.Join(parts, ", "))
+	fmt.Fprintf(rw, "History:    %d records\n", len(tm.history.List()))
+}
+
+// Drain 停止接受新任务，已有任务运行到结束且不再重启；wait 为 true 时等待所有任务结束
+func (tm *TaskManager) Drain(rw io.ReadWriter, ctx context.Context, wait bool) error {
+	tm.tasksLock.Lock()
+	if tm.state == managerRebooting {
+		tm.tasksLock.Unlock()
+		return fmt.Errorf("task manager is rebooting")
+	}
+	tm.state = managerDraining
+	tm.tasksLock.Unlock()
+
+	remaining := len(tm.aliveTasks())
+	fmt.Fprintf(rw, "Draining: not accepting new tasks, %d task(s) remaining\n", remaining)
+	if !wait || remaining == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for len(tm.aliveTasks()) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	fmt.Fprintln(rw, "All tasks finished")
+	return nil
+}
+
+// Undrain 恢复接受新任务
+func (tm *TaskManager) Undrain(rw io.ReadWriter) error {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	if tm.state == managerRebooting {
+		return fmt.Errorf("task manager is rebooting")
+	}
+	tm.state = managerAccepting
+	fmt.Fprintln(rw, "Accepting new tasks")
+	return nil
+}
+
+// stopTasks 并发终止任务，等待它们结束，返回已结束的任务数
+func (tm *TaskManager) stopTasks(tasks []*Task) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stopped := 0
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task *Task) {
+			defer wg.Done()
+			rw := &taskIO{reader: strings.NewReader(""), writer: io.Discard, errWriter: io.Discard}
+			if tm.KillTask(rw, systemSession, strconv.Itoa(task.ID)) != nil {
+				return
+			}
+			select {
+			case <-task.Done:
+				mu.Lock()
+				stopped++
+				mu.Unlock()
+			default:
+			}
+		}(task)
+	}
+	wg.Wait()
+	return stopped
+}
+
+// StopAll 终止所有任务
+func (tm *TaskManager) StopAll(rw io.ReadWriter) {
+	tasks := tm.aliveTasks()
+	if len(tasks) == 0 {
+		fmt.Fprintln(rw, "No running background tasks")
+		return
+	}
+	stopped := tm.stopTasks(tasks)
+	fmt.Fprintf(rw, "Stopped %d of %d task(s)\n", stopped, len(tasks))
+	if stopped < len(tasks) {
+		fmt.Fprintln(rw, "Some handlers have not returned yet; their workers are still busy")
+	}
+}
+
+// Reboot 停止所有任务并重建协程池，restartRunning 为 true 时以原来的命令和选项重新启动停止前状态为 RUNNING 的任务，
+// 排队、暂停和等待重启的任务不会重新启动；任务通过正常的终止流程结束，Done 只由 closeTask 关闭
+func (tm *TaskManager) Reboot(rw io.ReadWriter, restartRunning bool) error {
+	tm.tasksLock.Lock()
+	if tm.state == managerRebooting {
+		tm.tasksLock.Unlock()
+		return fmt.Errorf("reboot already in progress")
+	}
+	previous := tm.state
+	tm.state = managerRebooting
+	tm.tasksLock.Unlock()
+
+	fmt.Fprintln(rw, "Rebooting task manager...")
+	tasks := tm.aliveTasks()
+	var running []*Task
+	tm.tasksLock.Lock()
+	for _, task := range tasks {
+		if task.Status == TaskStatusRunning {
+			running = append(running, task)
+		}
+	}
+	tm.tasksLock.Unlock()
+	stopped := tm.stopTasks(tasks)
+	fmt.Fprintf(rw, "Stopped %d of %d task(s)\n", stopped, len(tasks))
+
+	pool, err := ants.NewPool(tm.poolSize)
+	tm.tasksLock.Lock()
+	if err != nil {
+		tm.state = previous
+		tm.tasksLock.Unlock()
+		return fmt.Errorf("failed to create new pool: %v", err)
+	}
+	// 未返回的处理函数继续在旧协程池中运行，结束时仍会归还名额
+	old := tm.pool
+	tm.pool = pool
+	tm.state = managerAccepting
+	tm.tasksLock.Unlock()
+	old.Release()
+
+	if restartRunning {
+		// 重新启动的任务仍属于原来的用户和会话，启动信息不写给执行 reboot 的会话
+		for _, task := range running {
+			var out bytes.Buffer
+			startIO := &taskIO{reader: strings.NewReader(""), writer: &out, errWriter: io.Discard}
+			if id := tm.StartTask(startIO, task.opts, task.Name, task.Args...); id != 0 {
+				fmt.Fprintf(rw, "Restarted task %d as task %d\n", task.ID, id)
+			} else {
+				fmt.Fprintf(rw, "Task %d was not restarted: %s", task.ID, out.String())
+			}
+		}
+	}
+	fmt.Fprintln(rw, "Task manager rebooted successfully")
+	return nil
+}
+
+// pausableTask 返回可以暂停或恢复的任务，调用方需持有 tasksLock
+func (tm *TaskManager) pausableTask(user command.Session, taskIDStr string, from TaskStatus) (*Task, error) {
+	id, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid task ID: %v", err)
+	}
+	task, exists := tm.tasks[id]
+	if !exists || !task.alive() {
+		return nil, fmt.Errorf("task %d not found or not running", id)
+	}
+	if err := authorize(user, task); err != nil {
+		return nil, err
+	}
+	if task.Status != from {
+		return nil, fmt.Errorf("task %d is %s", id, task.Status)
+	}
+	return task, nil
+}
+
+// signalProcesses 向任务所有子进程组发送信号，没有子进程时返回错误
+func (task *Task) signalProcesses(signal func(*os.Process) error) error {
+	task.procLock.Lock()
+	defer task.procLock.Unlock()
+	if len(task.processes) == 0 {
+		return fmt.Errorf("task %d has no child process; only process tasks can be paused", task.ID)
+	}
+	for _, p := range task.processes {
+		if err := signal(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// switchPaused 向 from 状态的任务的子进程组发送信号并切换到 to 状态
+func (tm *TaskManager) switchPaused(user command.Session, taskIDStr string, from, to TaskStatus, signal func(*os.Process) error) (*Task, error) {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	task, err := tm.pausableTask(user, taskIDStr, from)
+	if err != nil {
+		return nil, err
+	}
+	if err := task.signalProcesses(signal); err != nil {
+		return nil, err
+	}
+	task.Status = to
+	return task, nil
+}
+
+// PauseTask 向任务的子进程组发送 SIGSTOP
+func (tm *TaskManager) PauseTask(rw io.ReadWriter, user command.Session, taskIDStr string) error {
+	task, err := tm.switchPaused(user, taskIDStr, TaskStatusRunning, TaskStatusPaused, stopProcessGroup)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(rw, "Paused task %d (%s)\n", task.ID, task.Name)
+	return nil
+}
+
+// ResumeTask 向暂停的任务的子进程组发送 SIGCONT
+func (tm *TaskManager) ResumeTask(rw io.ReadWriter, user command.Session, taskIDStr string) error {
+	task, err := tm.switchPaused(user, taskIDStr, TaskStatusPaused, TaskStatusRunning, continueProcessGroup)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(rw, "Resumed task %d (%s)\n", task.ID, task.Name)
+	return nil
+}
@@ -0,0 +1,342 @@
+//go:build linux
+
+package backgroundcommands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// waitTimeout 测试中等待任务状态变化的上限
+const waitTimeout = 5 * time.Second
+
+// blockHandler 一直运行到任务被终止
+func blockHandler(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// napHandler 运行 args[0] 指定的时长后正常结束
+func napHandler(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(d):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sleepHandler 在独立的进程组中运行 sleep，并像 exec 一样通知任务管理器子进程的启动和退出
+func sleepHandler(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	observer, _ := command.ProcessObserverFrom(ctx)
+	observer.ProcessStarted(cmd.Process)
+	err := cmd.Wait()
+	observer.ProcessExited(cmd.Process, cmd.ProcessState)
+	return nil, err
+}
+
+func newTestManager(t *testing.T) *TaskManager {
+	t.Helper()
+	registry := command.NewRegistry()
+	registry.Register(command.Ecommand{Name: "block", BackgroundPolicy: command.BackgroundAllowed, Handler: blockHandler})
+	registry.Register(command.Ecommand{Name: "nap", BackgroundPolicy: command.BackgroundAllowed, Handler: napHandler})
+	registry.Register(command.Ecommand{Name: "sleep", BackgroundPolicy: command.BackgroundAllowed, RunsProcess: true, Handler: sleepHandler})
+	tm, err := NewTaskManager(4, registry)
+	if err != nil {
+		t.Fatalf("NewTaskManager: %v", err)
+	}
+	tm.logDir = ""
+	t.Cleanup(func() { tm.StopAll(&bytes.Buffer{}) })
+	return tm
+}
+
+// mustStart 启动系统任务，失败时结束测试
+func mustStart(t *testing.T, tm *TaskManager, opts TaskOptions, name string, args ...string) *Task {
+	t.Helper()
+	var out bytes.Buffer
+	id := tm.StartTask(&out, opts, name, args...)
+	if id == 0 {
+		t.Fatalf("StartTask %s: %s", name, out.String())
+	}
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	return tm.tasks[id]
+}
+
+func taskStatus(tm *TaskManager, task *Task) TaskStatus {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	return task.Status
+}
+
+// waitFor 等待 cond 成立，超时后结束测试
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitDone(t *testing.T, task *Task) {
+	t.Helper()
+	select {
+	case <-task.Done:
+	case <-time.After(waitTimeout):
+		t.Fatalf("task %d did not finish", task.ID)
+	}
+}
+
+// historyCount 返回历史中任务 ID 为 id 的记录数，每个任务只应结束一次
+func historyCount(tm *TaskManager, id int) int {
+	n := 0
+	for _, record := range tm.history.List() {
+		if record.ID == id {
+			n++
+		}
+	}
+	return n
+}
+
+// processState 返回 /proc/<pid>/stat 中的进程状态，例如 S 或 T
+func processState(t *testing.T, pid int) string {
+	t.Helper()
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		t.Fatalf("read process state: %v", err)
+	}
+	// 进程名可能含有空格，状态位于最后一个 ) 之后
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	return fields[0]
+}
+
+func TestDrainRejectsNewTasksAndLetsRunningFinish(t *testing.T) {
+	tm := newTestManager(t)
+	running := mustStart(t, tm, TaskOptions{}, "nap", "300ms")
+	restarting := mustStart(t, tm, TaskOptions{Restart: RestartAlways, Backoff: 10 * time.Millisecond}, "nap", "100ms")
+
+	var out bytes.Buffer
+	if err := tm.Drain(&out, context.Background(), false); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	out.Reset()
+	if id := tm.StartTask(&out, TaskOptions{}, "block"); id != 0 {
+		t.Fatalf("StartTask while draining started task %d", id)
+	}
+	if !strings.Contains(out.String(), "draining") {
+		t.Fatalf("StartTask while draining: got %q, want a draining error", out.String())
+	}
+
+	out.Reset()
+	if err := tm.Drain(&out, context.Background(), true); err != nil {
+		t.Fatalf("Drain --wait: %v", err)
+	}
+	if !strings.Contains(out.String(), "All tasks finished") {
+		t.Fatalf("Drain --wait output: %q", out.String())
+	}
+	waitDone(t, running)
+	waitDone(t, restarting)
+	if status := running.record.Status; status != TaskStatusFinished {
+		t.Fatalf("running task ended as %s, want %s", status, TaskStatusFinished)
+	}
+	if tm.TaskAlive(restarting.ID) {
+		t.Fatalf("task %d with --restart always was restarted while draining", restarting.ID)
+	}
+
+	if err := tm.Undrain(&out); err != nil {
+		t.Fatalf("Undrain: %v", err)
+	}
+	mustStart(t, tm, TaskOptions{}, "block")
+}
+
+func TestRebootStopsTasks(t *testing.T) {
+	tm := newTestManager(t)
+	tasks := []*Task{
+		mustStart(t, tm, TaskOptions{}, "block"),
+		mustStart(t, tm, TaskOptions{Restart: RestartAlways}, "block"),
+	}
+	oldPool := tm.pool
+
+	var out bytes.Buffer
+	if err := tm.Reboot(&out, false); err != nil {
+		t.Fatalf("Reboot: %v", err)
+	}
+	for _, task := range tasks {
+		waitDone(t, task)
+		if n := historyCount(tm, task.ID); n != 1 {
+			t.Fatalf("task %d finished %d times, want 1", task.ID, n)
+		}
+	}
+	if alive := tm.aliveTasks(); len(alive) != 0 {
+		t.Fatalf("%d task(s) alive after reboot, want 0", len(alive))
+	}
+	if tm.pool == oldPool {
+		t.Fatal("reboot did not replace the pool")
+	}
+	if tm.state != managerAccepting {
+		t.Fatalf("state after reboot is %s, want %s", tm.state, managerAccepting)
+	}
+	mustStart(t, tm, TaskOptions{}, "block")
+}
+
+func TestRebootRestartRunning(t *testing.T) {
+	tm := newTestManager(t)
+	opts := TaskOptions{Owner: "alice", Session: "alice-0", Labels: map[string]string{"app": "web"}}
+	old := mustStart(t, tm, opts, "nap", "1h")
+	paused := mustStart(t, tm, TaskOptions{}, "sleep")
+	waitFor(t, "child process", func() bool {
+		paused.procLock.Lock()
+		defer paused.procLock.Unlock()
+		return len(paused.processes) > 0
+	})
+	if err := tm.PauseTask(&bytes.Buffer{}, systemSession, strconv.Itoa(paused.ID)); err != nil {
+		t.Fatalf("PauseTask: %v", err)
+	}
+	// 占满协程池，之后的任务进入等待队列
+	mustStart(t, tm, TaskOptions{}, "block")
+	mustStart(t, tm, TaskOptions{}, "block")
+	queued := mustStart(t, tm, TaskOptions{}, "nap", "2h")
+	if status := taskStatus(tm, queued); status != TaskStatusQueued {
+		t.Fatalf("task %d is %s, want %s", queued.ID, status, TaskStatusQueued)
+	}
+
+	var out bytes.Buffer
+	if err := tm.Reboot(&out, true); err != nil {
+		t.Fatalf("Reboot: %v", err)
+	}
+	for _, task := range []*Task{old, paused, queued} {
+		waitDone(t, task)
+		if n := historyCount(tm, task.ID); n != 1 {
+			t.Fatalf("task %d finished %d times, want 1", task.ID, n)
+		}
+	}
+	if strings.Contains(out.String(), "Started task") {
+		t.Fatalf("reboot wrote start messages of restarted tasks to the caller: %q", out.String())
+	}
+
+	alive := tm.aliveTasks()
+	if len(alive) != 3 {
+		t.Fatalf("%d task(s) alive after reboot --restart-running, want the 3 running ones", len(alive))
+	}
+	for _, task := range alive {
+		if task.Name == "sleep" || strings.Join(task.Args, " ") == "2h" {
+			t.Fatalf("task %d (%s %v) was not running before the reboot but was restarted", task.ID, task.Name, task.Args)
+		}
+	}
+	restarted := alive[0]
+	if restarted.ID == old.ID || restarted.Name != "nap" || strings.Join(restarted.Args, " ") != "1h" {
+		t.Fatalf("restarted task %d: %s %v", restarted.ID, restarted.Name, restarted.Args)
+	}
+	if restarted.opts.Owner != "alice" || restarted.opts.Session != "alice-0" || restarted.opts.Labels["app"] != "web" {
+		t.Fatalf("restarted task lost its options: %+v", restarted.opts)
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("Restarted task %d as task %d", old.ID, restarted.ID)) {
+		t.Fatalf("Reboot output: %q", out.String())
+	}
+	waitFor(t, "restarted task to run", func() bool { return taskStatus(tm, restarted) == TaskStatusRunning })
+}
+
+func TestStopAll(t *testing.T) {
+	tm := newTestManager(t)
+	var tasks []*Task
+	for i := 0; i < 3; i++ {
+		tasks = append(tasks, mustStart(t, tm, TaskOptions{Restart: RestartAlways}, "block"))
+	}
+
+	var out bytes.Buffer
+	tm.StopAll(&out)
+	if !strings.Contains(out.String(), "Stopped 3 of 3 task(s)") {
+		t.Fatalf("StopAll output: %q", out.String())
+	}
+	for _, task := range tasks {
+		waitDone(t, task)
+		if status := task.record.Status; status != TaskStatusStopped {
+			t.Fatalf("task %d ended as %s, want %s", task.ID, status, TaskStatusStopped)
+		}
+	}
+	if alive := tm.aliveTasks(); len(alive) != 0 {
+		t.Fatalf("%d task(s) alive after stop-all, want 0", len(alive))
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	tm := newTestManager(t)
+	task := mustStart(t, tm, TaskOptions{}, "sleep")
+	var pid int
+	waitFor(t, "child process", func() bool {
+		task.procLock.Lock()
+		defer task.procLock.Unlock()
+		for p := range task.processes {
+			pid = p
+		}
+		return pid != 0
+	})
+	id := strconv.Itoa(task.ID)
+
+	var out bytes.Buffer
+	if err := tm.PauseTask(&out, systemSession, id); err != nil {
+		t.Fatalf("PauseTask: %v", err)
+	}
+	if status := taskStatus(tm, task); status != TaskStatusPaused {
+		t.Fatalf("status after pause is %s, want %s", status, TaskStatusPaused)
+	}
+	waitFor(t, "SIGSTOP", func() bool { return processState(t, pid) == "T" })
+	if err := tm.PauseTask(&out, systemSession, id); err == nil {
+		t.Fatal("pausing a paused task succeeded")
+	}
+
+	if err := tm.ResumeTask(&out, systemSession, id); err != nil {
+		t.Fatalf("ResumeTask: %v", err)
+	}
+	if status := taskStatus(tm, task); status != TaskStatusRunning {
+		t.Fatalf("status after resume is %s, want %s", status, TaskStatusRunning)
+	}
+	waitFor(t, "SIGCONT", func() bool { return processState(t, pid) != "T" })
+
+	// 暂停的任务被终止时先收到 SIGCONT，才能处理 SIGTERM
+	if err := tm.PauseTask(&out, systemSession, id); err != nil {
+		t.Fatalf("PauseTask: %v", err)
+	}
+	if err := tm.KillTask(&out, systemSession, id); err != nil {
+		t.Fatalf("KillTask: %v", err)
+	}
+	waitDone(t, task)
+	if status := task.record.Status; status != TaskStatusStopped {
+		t.Fatalf("paused task ended as %s, want %s", status, TaskStatusStopped)
+	}
+}
+
+func TestPauseRequiresProcess(t *testing.T) {
+	tm := newTestManager(t)
+	task := mustStart(t, tm, TaskOptions{}, "block")
+	waitFor(t, "task to run", func() bool { return taskStatus(tm, task) == TaskStatusRunning })
+	if err := tm.PauseTask(&bytes.Buffer{}, systemSession, strconv.Itoa(task.ID)); err == nil {
+		t.Fatal("pausing a task without child processes succeeded")
+	}
+}
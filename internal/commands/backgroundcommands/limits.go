@@ -0,0 +1,250 @@
+package backgroundcommands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cpuPeriod cgroup cpu.max 的调度周期，单位微秒
+const cpuPeriod = 100000
+
+// ResourceLimits 后台任务子进程的资源限制，零值表示不限制
+// cpu 限制需要 cgroup v2；内存在没有 cgroup 时以 RLIMIT_AS 近似限制
+type ResourceLimits struct {
+	CPU     int           // CPU 配额百分比，100 表示一个核
+	Memory  int64         // 内存上限，字节
+	NoFile  uint64        // 最大打开文件数
+	Timeout time.Duration // 单次运行的最长时间，超时后结束子进程，按失败处理
+}
+
+// IsZero 是否没有任何限制
+func (l ResourceLimits) IsZero() bool {
+	return l == ResourceLimits{}
+}
+
+// needsCgroup 是否有需要 cgroup 才能准确限制的项
+func (l ResourceLimits) needsCgroup() bool {
+	return l.CPU > 0 || l.Memory > 0
+}
+
+func (l ResourceLimits) String() string {
+	var parts []string
+	if l.CPU > 0 {
+		parts = append(parts, fmt.Sprintf("cpu %d%%", l.CPU))
+	}
+	if l.Memory > 0 {
+		parts = append(parts, "mem "+formatBytes(l.Memory))
+	}
+	if l.NoFile > 0 {
+		parts = append(parts, fmt.Sprintf("nofile %d", l.NoFile))
+	}
+	if l.Timeout > 0 {
+		parts = append(parts, "timeout "+l.Timeout.String())
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ParseCPU 解析 CPU 配额，例如 50%、150% 或 50
+func ParseCPU(value string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid cpu limit: %s", value)
+	}
+	return n, nil
+}
+
+// ParseSize 解析内存大小，支持 K、M、G 后缀 (1024 进制)，例如 512M
+func ParseSize(value string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30}
+	number, unit := strings.ToUpper(value), int64(1)
+	number = strings.TrimSuffix(number, "B")
+	if n := len(number); n > 0 {
+		if u, ok := units[number[n-1]]; ok {
+			number, unit = number[:n-1], u
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return n * unit, nil
+}
+
+// formatBytes 以 K、M、G 为单位显示字节数
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
+// ResourceUsage 任务子进程的资源使用情况和触发的限制
+type ResourceUsage struct {
+	CPUTime   time.Duration `json:"cpu_time,omitempty"`
+	Memory    int64         `json:"-"`                    // 当前内存，仅 cgroup 可用
+	MaxMemory int64         `json:"max_memory,omitempty"` // 峰值内存
+	OOMKills  int           `json:"oom_kills,omitempty"`  // 超出内存限制被结束的次数
+	Throttled int           `json:"throttled,omitempty"`  // 超出 CPU 配额被限流的周期数
+	Timeouts  int           `json:"timeouts,omitempty"`   // 超时被结束的次数
+}
+
+// hits 触发过的限制
+func (u ResourceUsage) hits() []string {
+	var hits []string
+	if u.OOMKills > 0 {
+		hits = append(hits, fmt.Sprintf("oom-killed x%d", u.OOMKills))
+	}
+	if u.Throttled > 0 {
+		hits = append(hits, fmt.Sprintf("cpu throttled x%d", u.Throttled))
+	}
+	if u.Timeouts > 0 {
+		hits = append(hits, fmt.Sprintf("timed out x%d", u.Timeouts))
+	}
+	return hits
+}
+
+// summary 单行显示资源使用情况，有限制时显示为 使用/限制
+func (u ResourceUsage) summary(limits ResourceLimits) string {
+	mem := u.Memory
+	if mem == 0 {
+		mem = u.MaxMemory
+	}
+	if u.CPUTime == 0 && mem == 0 && len(u.hits()) == 0 {
+		return "-"
+	}
+	cpu := "cpu " + u.CPUTime.Round(time.Millisecond).String()
+	if limits.CPU > 0 {
+		cpu += fmt.Sprintf("/%d%%", limits.CPU)
+	}
+	memory := "mem " + formatBytes(mem)
+	if limits.Memory > 0 {
+		memory += "/" + formatBytes(limits.Memory)
+	}
+	parts := append([]string{cpu, memory}, u.hits()...)
+	return strings.Join(parts, " ")
+}
+
+// taskCgroup 返回任务的 cgroup，首次调用时创建，cgroup 不可用时返回 nil，调用方需持有 procLock
+func (task *Task) taskCgroup() *taskCgroup {
+	if task.cgroup == nil && task.cgroupErr == nil {
+		task.cgroup, task.cgroupErr = newTaskCgroup(task.ID, task.opts.Limits)
+	}
+	return task.cgroup
+}
+
+// PrepareCommand 实现 command.CommandPreparer，有 cpu 或内存限制时让子进程直接在任务的 cgroup 中创建，
+// 从 exec 之前就受到限制
+func (task *Task) PrepareCommand(cmd *exec.Cmd) (func(), error) {
+	if !task.opts.Limits.needsCgroup() {
+		return func() {}, nil
+	}
+	task.procLock.Lock()
+	defer task.procLock.Unlock()
+	cg := task.taskCgroup()
+	if cg == nil {
+		return func() {}, nil
+	}
+	return cg.placeCommand(cmd)
+}
+
+// applyLimits 对新启动的子进程应用资源限制，调用方需持有 procLock
+// cpu 和内存优先使用任务的 cgroup，内核不支持在创建时放入 cgroup 时在此移入；cgroup 不可用时内存退回 RLIMIT_AS
+// 打开文件数和 RLIMIT_AS 只能在进程启动后通过 prlimit 设置，子进程 exec 之后到设置完成前的极短时间内不受这两项限制
+func (task *Task) applyLimits(p *os.Process) error {
+	limits := task.opts.Limits
+	memory := limits.Memory
+	if limits.needsCgroup() {
+		if cg := task.taskCgroup(); cg != nil {
+			if err := cg.add(p.Pid); err != nil {
+				return err
+			}
+			memory = 0
+		}
+	}
+	if memory > 0 || limits.NoFile > 0 {
+		return setRlimits(p.Pid, memory, limits.NoFile)
+	}
+	return nil
+}
+
+// resourceUsage 返回任务的资源使用情况，有 cgroup 时使用 cgroup 的统计
+func (task *Task) resourceUsage() ResourceUsage {
+	task.procLock.Lock()
+	defer task.procLock.Unlock()
+	usage := task.usage
+	if task.cgroup != nil {
+		stats := task.cgroup.stats()
+		usage.CPUTime = stats.CPUTime
+		usage.Memory = stats.Memory
+		usage.MaxMemory = max(usage.MaxMemory, stats.MaxMemory)
+		usage.OOMKills = stats.OOMKills
+		usage.Throttled = stats.Throttled
+	}
+	return usage
+}
+
+// limitWarning 检查当前环境能否执行所有限制，返回给用户的提示
+func limitWarning(limits ResourceLimits) string {
+	if !limits.needsCgroup() {
+		return ""
+	}
+	err := cgroupAvailable()
+	if err == nil {
+		return ""
+	}
+	var effects []string
+	if limits.CPU > 0 {
+		effects = append(effects, "cpu limit is not enforced")
+	}
+	if limits.Memory > 0 {
+		effects = append(effects, "memory limit falls back to RLIMIT_AS")
+	}
+	return fmt.Sprintf("cgroup v2 is not available (%v): %s", err, strings.Join(effects, ", "))
+}
+
+// startTimeout 为本次运行设置超时，超时后结束所有子进程组，返回取消函数
+func (task *Task) startTimeout() func() {
+	timeout := task.opts.Limits.Timeout
+	if timeout <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(timeout, func() {
+		task.procLock.Lock()
+		task.timedOut = true
+		task.usage.Timeouts++
+		processes := make([]*os.Process, 0, len(task.processes))
+		for _, p := range task.processes {
+			processes = append(processes, p)
+		}
+		task.procLock.Unlock()
+
+		fmt.Fprintf(task.errOutput, "[task %d timed out after %s]\n", task.ID, timeout)
+		for _, p := range processes {
+			terminateProcessGroup(p)
+		}
+		// 宽限期后仍未退出的进程强制结束
+		time.AfterFunc(killGracePeriod, func() {
+			task.procLock.Lock()
+			defer task.procLock.Unlock()
+			for _, p := range processes {
+				if task.processes[p.Pid] == p {
+					killProcessGroup(p)
+				}
+			}
+		})
+	})
+	return func() { timer.Stop() }
+}
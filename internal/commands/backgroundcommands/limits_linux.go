@@ -0,0 +1,270 @@
+//go:build linux
+
+package backgroundcommands
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cgroupServerLeaf 服务端自身所在的叶子 cgroup，使父 cgroup 可以向子 cgroup 开启控制器
+	cgroupServerLeaf = "smf-server"
+	// cgroupTasksDir 任务 cgroup 的父目录
+	cgroupTasksDir = "smf-tasks"
+)
+
+var (
+	cgroupOnce sync.Once
+	cgroupRoot string // 任务 cgroup 的父目录，初始化失败时为空
+	cgroupErr  error
+)
+
+// setRlimits 通过 prlimit 设置子进程的内存(RLIMIT_AS)和打开文件数上限，0 表示不设置
+func setRlimits(pid int, memory int64, nofile uint64) error {
+	if memory > 0 {
+		limit := &unix.Rlimit{Cur: uint64(memory), Max: uint64(memory)}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, limit, nil); err != nil {
+			return fmt.Errorf("failed to set memory limit: %v", err)
+		}
+	}
+	if nofile > 0 {
+		limit := &unix.Rlimit{Cur: nofile, Max: nofile}
+		if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, limit, nil); err != nil {
+			return fmt.Errorf("failed to set nofile limit: %v", err)
+		}
+	}
+	return nil
+}
+
+// cgroupAvailable 首次调用时准备任务 cgroup 的父目录，返回不可用的原因
+func cgroupAvailable() error {
+	cgroupOnce.Do(func() {
+		cgroupRoot, cgroupErr = setupCgroups()
+	})
+	return cgroupErr
+}
+
+// setupCgroups 在服务端所在的 cgroup v2 子树中创建任务 cgroup 的父目录并开启 cpu 和 memory 控制器
+// cgroup v2 不允许有进程的 cgroup 向子 cgroup 开启控制器，必要时先将服务端移入叶子 cgroup
+func setupCgroups() (string, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(mount, own)
+	if err := requireControllers(filepath.Join(base, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("%s: %v", base, err)
+	}
+
+	if requireControllers(filepath.Join(base, "cgroup.subtree_control")) != nil {
+		leaf := filepath.Join(base, cgroupServerLeaf)
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("cgroup %s is not delegated: %v", base, err)
+		}
+		if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return "", err
+		}
+		if err := writeCgroupFile(base, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+			return "", err
+		}
+	}
+
+	root := filepath.Join(base, cgroupTasksDir)
+	if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create cgroup %s: %v", root, err)
+	}
+	if err := writeCgroupFile(root, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+		return "", err
+	}
+	return root, nil
+}
+
+// cgroup2Mount 从 mountinfo 中查找 cgroup v2 的挂载点
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 格式: ID 父ID 设备 根 挂载点 选项 ... - 文件系统类型 来源 超级块选项
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("cgroup2 is not mounted")
+}
+
+// ownCgroup 返回当前进程在 cgroup v2 层级中的路径
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("process is not in a cgroup v2 hierarchy")
+}
+
+// requireControllers 检查控制器列表文件中是否包含 cpu 和 memory
+func requireControllers(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	enabled := strings.Fields(string(data))
+	for _, want := range []string{"cpu", "memory"} {
+		found := false
+		for _, c := range enabled {
+			found = found || c == want
+		}
+		if !found {
+			return fmt.Errorf("%s controller is not available", want)
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Join(dir, name), err)
+	}
+	return nil
+}
+
+// taskCgroup 任务的 cgroup，任务所有的子进程都放入其中
+type taskCgroup struct {
+	path string
+}
+
+// newTaskCgroup 为任务创建 cgroup 并写入 cpu 和内存限制
+func newTaskCgroup(id int, limits ResourceLimits) (*taskCgroup, error) {
+	if err := cgroupAvailable(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(cgroupRoot, fmt.Sprintf("task-%d", id))
+	if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("failed to create cgroup %s: %v", path, err)
+	}
+	cg := &taskCgroup{path: path}
+	if limits.CPU > 0 {
+		quota := limits.CPU * cpuPeriod / 100
+		if err := writeCgroupFile(path, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	if limits.Memory > 0 {
+		if err := writeCgroupFile(path, "memory.max", strconv.FormatInt(limits.Memory, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+		// 没有开启 swap 记账时该文件不存在，忽略错误
+		writeCgroupFile(path, "memory.swap.max", "0")
+	}
+	return cg, nil
+}
+
+// placeCommand 让命令的进程通过 clone3 直接在 cgroup 中创建，返回启动后关闭 cgroup 目录的函数
+// 需要 5.7 以上的内核，更早的内核上返回空操作，进程启动后再由 add 移入
+func (cg *taskCgroup) placeCommand(cmd *exec.Cmd) (func(), error) {
+	if !cloneIntoCgroup() {
+		return func() {}, nil
+	}
+	fd, err := unix.Open(cg.path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cgroup %s: %v", cg.path, err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+	return func() { unix.Close(fd) }, nil
+}
+
+// cloneIntoCgroup 内核是否支持 clone3 的 CLONE_INTO_CGROUP (5.7 以上)
+var cloneIntoCgroup = sync.OnceValue(func() bool {
+	var uname unix.Utsname
+	if unix.Uname(&uname) != nil {
+		return false
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(unix.ByteSliceToString(uname.Release[:]), "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major > 5 || (major == 5 && minor >= 7)
+})
+
+// add 将进程移入 cgroup，之后该进程创建的子进程也在其中
+func (cg *taskCgroup) add(pid int) error {
+	return writeCgroupFile(cg.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// stats 读取 cgroup 的资源使用统计
+func (cg *taskCgroup) stats() ResourceUsage {
+	var usage ResourceUsage
+	cpu := readCgroupKeys(cg.path, "cpu.stat")
+	usage.CPUTime = time.Duration(cpu["usage_usec"]) * time.Microsecond
+	usage.Throttled = int(cpu["nr_throttled"])
+	usage.OOMKills = int(readCgroupKeys(cg.path, "memory.events")["oom_kill"])
+	usage.Memory = readCgroupInt(cg.path, "memory.current")
+	// memory.peak 需要 5.19 以上的内核
+	usage.MaxMemory = readCgroupInt(cg.path, "memory.peak")
+	return usage
+}
+
+// remove 删除 cgroup，其中的进程必须都已退出
+func (cg *taskCgroup) remove() error {
+	return os.Remove(cg.path)
+}
+
+// readCgroupKeys 读取 "键 值" 格式的统计文件
+func readCgroupKeys(dir, name string) map[string]int64 {
+	values := make(map[string]int64)
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			values[key] = n
+		}
+	}
+	return values
+}
+
+func readCgroupInt(dir, name string) int64 {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return n
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package backgroundcommands
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// setRlimits 非 Linux 平台不支持 prlimit
+func setRlimits(pid int, memory int64, nofile uint64) error {
+	return fmt.Errorf("resource limits are not supported on this platform")
+}
+
+// cgroupAvailable 非 Linux 平台没有 cgroup
+func cgroupAvailable() error {
+	return fmt.Errorf("cgroups are not supported on this platform")
+}
+
+type taskCgroup struct{}
+
+func newTaskCgroup(id int, limits ResourceLimits) (*taskCgroup, error) {
+	return nil, cgroupAvailable()
+}
+
+func (cg *taskCgroup) placeCommand(cmd *exec.Cmd) (func(), error) {
+	return func() {}, nil
+}
+
+func (cg *taskCgroup) add(pid int) error {
+	return cgroupAvailable()
+}
+
+func (cg *taskCgroup) stats() ResourceUsage {
+	return ResourceUsage{}
+}
+
+func (cg *taskCgroup) remove() error {
+	return nil
+}
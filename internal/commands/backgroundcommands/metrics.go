@@ -0,0 +1,128 @@
+package backgroundcommands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultTopInterval tasks top 的默认刷新间隔
+const defaultTopInterval = time.Second
+
+// ProcessMetrics 任务子进程树的一次采样
+type ProcessMetrics struct {
+	Processes  int
+	CPUTime    time.Duration // 进程树中存活进程累计的 CPU 时间
+	RSS        int64
+	Threads    int
+	FDs        int
+	ReadBytes  int64
+	WriteBytes int64
+}
+
+// topRow tasks top 中一个任务的信息
+type topRow struct {
+	id      int
+	uptime  time.Duration
+	command string
+	metrics ProcessMetrics
+}
+
+// taskProcessGroups 返回运行中的任务及其子进程，子进程都是各自进程组的首进程
+func (tm *TaskManager) taskProcessGroups() ([]topRow, map[int]int) {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	var rows []topRow
+	groups := make(map[int]int)
+	for _, task := range tm.tasks {
+		if task.Status != TaskStatusRunning && task.Status != TaskStatusPaused {
+			continue
+		}
+		rows = append(rows, topRow{
+			id:      task.ID,
+			uptime:  time.Since(task.attemptStart),
+			command: strings.TrimSpace(task.Name + " " + strings.Join(task.Args, " ")),
+		})
+		task.procLock.Lock()
+		for pid := range task.processes {
+			groups[pid] = task.ID
+		}
+		task.procLock.Unlock()
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].id < rows[j].id })
+	return rows, groups
+}
+
+// TopTasks 类似 top 实时显示运行中任务的进程指标，按回车结束
+// count 大于 0 时只刷新 count 次且不清屏，便于在脚本中使用
+func (tm *TaskManager) TopTasks(rw io.ReadWriter, interval time.Duration, count int) error {
+	if err := metricsAvailable(); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// CPU 使用率需要两次采样之间的差值，先采样一次
+		_, groups := tm.taskProcessGroups()
+		previous, _ := sampleProcesses(groups)
+		last := time.Now()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for i := 0; count <= 0 || i < count; i++ {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			rows, groups := tm.taskProcessGroups()
+			current, err := sampleProcesses(groups)
+			if err != nil {
+				fmt.Fprintf(rw, "Error: %v\n", err)
+				return
+			}
+			now := time.Now()
+			tm.renderTop(rw, rows, previous, current, now.Sub(last), count <= 0)
+			previous, last = current, now
+		}
+	}()
+
+	if count > 0 {
+		<-done
+		return nil
+	}
+	// 任意输入结束刷新
+	buf := make([]byte, 1024)
+	rw.Read(buf)
+	close(stop)
+	<-done
+	return nil
+}
+
+// renderTop 输出一帧，CPU% 为两次采样之间 CPU 时间的增量占经过时间的比例，100% 为一个核
+// live 为 true 时每帧先清屏
+func (tm *TaskManager) renderTop(rw io.ReadWriter, rows []topRow, previous, current map[int]ProcessMetrics, elapsed time.Duration, live bool) {
+	tm.tasksLock.Lock()
+	workers, poolSize, queued := tm.running, tm.poolSize, tm.queue.Len()
+	tm.tasksLock.Unlock()
+	if live {
+		fmt.Fprint(rw, "\x1b[H\x1b[2J")
+	}
+	fmt.Fprintf(rw, "%s  tasks: %d running, %d queued  workers: %d/%d\n",
+		time.Now().Format("15:04:05"), len(rows), queued, workers, poolSize)
+	fmt.Fprintf(rw, "ID\tPIDS\tCPU%%\tRSS\tTHREADS\tFDS\tREAD\tWRITE\tUPTIME\tCOMMAND\n")
+	for _, row := range rows {
+		m := current[row.id]
+		cpu := "-"
+		if before, ok := previous[row.id]; ok && elapsed > 0 && m.CPUTime >= before.CPUTime {
+			cpu = fmt.Sprintf("%.1f", float64(m.CPUTime-before.CPUTime)/float64(elapsed)*100)
+		}
+		fmt.Fprintf(rw, "%d\t%d\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			row.id, m.Processes, cpu, formatBytes(m.RSS), m.Threads, m.FDs,
+			formatBytes(m.ReadBytes), formatBytes(m.WriteBytes),
+			row.uptime.Round(time.Second), row.command)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package backgroundcommands
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks /proc/<pid>/stat 中 CPU 时间的单位 (USER_HZ)，Linux 上固定为 100
+const clockTicks = 100
+
+// metricsAvailable 检查能否读取 /proc
+func metricsAvailable() error {
+	_, err := os.Stat("/proc/self/stat")
+	return err
+}
+
+// sampleProcesses 扫描 /proc，按进程组汇总各任务子进程树的指标
+// groups 为子进程组 ID 到任务 ID 的映射，子进程的后代默认与其处于同一进程组
+func sampleProcesses(groups map[int]int) (map[int]ProcessMetrics, error) {
+	metrics := make(map[int]ProcessMetrics)
+	if len(groups) == 0 {
+		return metrics, nil
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join("/proc", entry.Name())
+		pgrp, cpu, ok := readProcStat(dir)
+		if !ok {
+			continue
+		}
+		taskID, ok := groups[pgrp]
+		if !ok {
+			if taskID, ok = groups[pid]; !ok {
+				continue
+			}
+		}
+
+		m := metrics[taskID]
+		m.Processes++
+		m.CPUTime += cpu
+		status := readProcKeys(dir, "status")
+		m.RSS += status["VmRSS"] * 1024
+		m.Threads += int(status["Threads"])
+		io := readProcKeys(dir, "io")
+		m.ReadBytes += io["read_bytes"]
+		m.WriteBytes += io["write_bytes"]
+		if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+			m.FDs += len(fds)
+		}
+		metrics[taskID] = m
+	}
+	return metrics, nil
+}
+
+// readProcStat 读取进程组 ID 和累计 CPU 时间 (utime + stime)
+func readProcStat(dir string) (pgrp int, cpu time.Duration, ok bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return 0, 0, false
+	}
+	// 进程名可能包含空格和括号，从最后一个 ')' 之后开始解析
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, 0, false
+	}
+	// 字段从 state(第 3 个)开始: state ppid pgrp ... utime(14) stime(15)
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return 0, 0, false
+	}
+	pgrp, err1 := strconv.Atoi(fields[2])
+	utime, err2 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err3 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, 0, false
+	}
+	return pgrp, time.Duration(utime+stime) * time.Second / clockTicks, true
+}
+
+// readProcKeys 读取 "键: 值" 格式的文件，值只取第一个数字 (status 中的 kB 单位被忽略)
+func readProcKeys(dir, name string) map[string]int64 {
+	values := make(map[string]int64)
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return values
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			values[key] = n
+		}
+	}
+	return values
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package backgroundcommands
+
+import "fmt"
+
+// metricsAvailable 非 Linux 平台没有 /proc
+func metricsAvailable() error {
+	return fmt.Errorf("process metrics are only available on linux")
+}
+
+func sampleProcesses(groups map[int]int) (map[int]ProcessMetrics, error) {
+	return nil, metricsAvailable()
+}
@@ -0,0 +1,346 @@
+package backgroundcommands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+	"github.com/recyvan/smf/internal/protocol"
+)
+
+const (
+	// sinkTimeout 接收者处理一个事件的最长时间
+	sinkTimeout = 10 * time.Second
+)
+
+// defaultSessionEvents 会话默认接收的事件，任务开始和输出由用户自己触发或过于频繁，默认不推送
+var defaultSessionEvents = map[EventType]bool{EventRestarted: true, EventFinished: true, EventFailed: true, EventKilled: true, EventTriggered: true, EventUnhealthy: true}
+
+// defaultSinkEvents 接收者默认接收的事件
+var defaultSinkEvents = map[EventType]bool{EventStarted: true, EventRestarted: true, EventFinished: true, EventFailed: true, EventKilled: true, EventTriggered: true, EventUnhealthy: true}
+
+// EventSink 事件的外部接收者
+type EventSink interface {
+	Send(e Event) error
+	String() string
+}
+
+// webhookSink 以 JSON 格式 POST 到本机的 URL，与 http 健康检查一样只允许本机地址
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(rawURL string) (*webhookSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL: %s", rawURL)
+	}
+	if !isLocalHost(u.Hostname()) {
+		return nil, fmt.Errorf("webhook URL must be on localhost: %s", rawURL)
+	}
+	client := &http.Client{
+		Timeout: sinkTimeout,
+		// 不跟随重定向到其它主机
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !isLocalHost(req.URL.Hostname()) {
+				return fmt.Errorf("webhook redirected off localhost: %s", req.URL)
+			}
+			return nil
+		},
+	}
+	return &webhookSink{url: rawURL, client: client}, nil
+}
+
+func (s *webhookSink) Send(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) String() string {
+	return "webhook " + s.url
+}
+
+// fileSink 每个事件以一行 JSON 追加到文件
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Send(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (s *fileSink) String() string {
+	return "file " + s.path
+}
+
+// commandSink 对每个事件运行一次命令，事件的 JSON 从标准输入传入，主要字段同时放入环境变量
+type commandSink struct {
+	name string
+	args []string
+}
+
+func (s *commandSink) Send(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.name, s.args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"SMF_EVENT="+string(e.Type),
+		"SMF_TASK_ID="+strconv.Itoa(e.TaskID),
+		"SMF_TASK_COMMAND="+e.Command,
+		"SMF_TASK_STATUS="+string(e.Status),
+		"SMF_EXIT_CODE="+strconv.Itoa(e.ExitCode),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (s *commandSink) String() string {
+	return strings.TrimSpace("exec " + s.name + " " + strings.Join(s.args, " "))
+}
+
+// sinkEntry 已添加的接收者及其投递情况
+type sinkEntry struct {
+	id      int
+	sink    EventSink
+	types   map[EventType]bool
+	cancel  func()
+	sent    int
+	failed  int
+	lastErr string
+}
+
+// sessionNotify 会话的通知设置，关闭后保留以免再次自动开启
+type sessionNotify struct {
+	enabled bool
+	all     bool
+	types   map[EventType]bool
+	cancel  func()
+}
+
+// Notifier 将任务事件推送给已连接的会话和外部接收者
+type Notifier struct {
+	bus      *EventBus
+	mu       sync.Mutex
+	sessions map[string]*sessionNotify
+	sinks    map[int]*sinkEntry
+	nextSink int
+}
+
+// NewNotifier 创建通知器
+func NewNotifier(bus *EventBus) *Notifier {
+	return &Notifier{
+		bus:      bus,
+		sessions: make(map[string]*sessionNotify),
+		sinks:    make(map[int]*sinkEntry),
+	}
+}
+
+// Enable 开启会话的通知，all 为 false 时只推送该用户自己的任务
+func (n *Notifier) Enable(rw io.ReadWriter, session command.Session, all bool, types map[EventType]bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if old, ok := n.sessions[session.ID]; ok && old.cancel != nil {
+		old.cancel()
+	}
+	ch, cancel := n.bus.Subscribe(func(e Event) bool {
+		return types[e.Type] && (all || e.Owner == session.User)
+	})
+	n.sessions[session.ID] = &sessionNotify{enabled: true, all: all, types: types, cancel: cancel}
+	go n.push(rw, session.ID, ch, cancel)
+}
+
+// AutoEnable 会话第一次启动任务时以默认设置开启通知，用户关闭过则不再开启
+func (n *Notifier) AutoEnable(rw io.ReadWriter, session command.Session) {
+	n.mu.Lock()
+	_, exists := n.sessions[session.ID]
+	n.mu.Unlock()
+	if !exists {
+		n.Enable(rw, session, false, defaultSessionEvents)
+	}
+}
+
+// Disable 关闭会话的通知
+func (n *Notifier) Disable(session command.Session) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if old, ok := n.sessions[session.ID]; ok && old.cancel != nil {
+		old.cancel()
+	}
+	n.sessions[session.ID] = &sessionNotify{}
+}
+
+// push 将事件写入会话的连接，连接断开后取消订阅
+func (n *Notifier) push(rw io.ReadWriter, id string, ch <-chan Event, cancel func()) {
+	frames := command.SupportsFrames(rw)
+	for e := range ch {
+		var err error
+		if frames {
+			err = protocol.WriteNotify(rw, e.String())
+		} else {
+			_, err = fmt.Fprintf(rw, "\n[notify] %s\n", e)
+		}
+		if err != nil {
+			cancel()
+			n.mu.Lock()
+			if state, ok := n.sessions[id]; ok && state.enabled {
+				delete(n.sessions, id)
+			}
+			n.mu.Unlock()
+			return
+		}
+	}
+}
+
+// AddSink 添加外部接收者，每个接收者在独立的协程中按顺序处理事件
+func (n *Notifier) AddSink(sink EventSink, types map[EventType]bool) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nextSink++
+	entry := &sinkEntry{id: n.nextSink, sink: sink, types: types}
+	ch, cancel := n.bus.Subscribe(func(e Event) bool { return types[e.Type] })
+	entry.cancel = cancel
+	n.sinks[entry.id] = entry
+	go func() {
+		for e := range ch {
+			err := sink.Send(e)
+			n.mu.Lock()
+			entry.sent++
+			if err != nil {
+				entry.failed++
+				entry.lastErr = err.Error()
+			}
+			n.mu.Unlock()
+		}
+	}()
+	return entry.id
+}
+
+// RemoveSink 删除外部接收者
+func (n *Notifier) RemoveSink(id int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	entry, ok := n.sinks[id]
+	if !ok {
+		return fmt.Errorf("sink %d not found", id)
+	}
+	entry.cancel()
+	delete(n.sinks, id)
+	return nil
+}
+
+// Status 显示会话的通知设置，管理员同时显示所有外部接收者
+func (n *Notifier) Status(rw io.ReadWriter, session command.Session) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	state, ok := n.sessions[session.ID]
+	switch {
+	case !ok:
+		fmt.Fprintln(rw, "Notifications: off (turned on when this session starts a task)")
+	case !state.enabled:
+		fmt.Fprintln(rw, "Notifications: off")
+	default:
+		scope := "own tasks"
+		if state.all {
+			scope = "all tasks"
+		}
+		fmt.Fprintf(rw, "Notifications: on, %s, events %s\n", scope, formatEventTypes(state.types))
+	}
+
+	if !session.Admin {
+		return
+	}
+	if len(n.sinks) == 0 {
+		fmt.Fprintln(rw, "No sinks")
+		return
+	}
+	ids := make([]int, 0, len(n.sinks))
+	for id := range n.sinks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	fmt.Fprintf(rw, "ID\tEVENTS\tSENT\tFAILED\tSINK\tLAST ERROR\n")
+	for _, id := range ids {
+		entry := n.sinks[id]
+		lastErr := entry.lastErr
+		if lastErr == "" {
+			lastErr = "-"
+		}
+		fmt.Fprintf(rw, "%d\t%s\t%d\t%d\t%s\t%s\n",
+			entry.id, formatEventTypes(entry.types), entry.sent, entry.failed, entry.sink, lastErr)
+	}
+}
+
+// parseSink 解析 sink add 的参数: [--events LIST] webhook <url> | file <path> | exec <command> [args...]
+func parseSink(args []string) (EventSink, map[EventType]bool, error) {
+	types := defaultSinkEvents
+	for len(args) > 1 && args[0] == "--events" {
+		parsed, err := ParseEventTypes(args[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		types = parsed
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		return nil, nil, fmt.Errorf("usage: notify sink add [--events LIST] webhook <url> | file <path> | exec <command> [args...]")
+	}
+	switch args[0] {
+	case "webhook":
+		if len(args) != 2 {
+			return nil, nil, fmt.Errorf("usage: notify sink add webhook <url>")
+		}
+		sink, err := newWebhookSink(args[1])
+		return sink, types, err
+	case "file":
+		if len(args) != 2 {
+			return nil, nil, fmt.Errorf("usage: notify sink add file <path>")
+		}
+		return &fileSink{path: args[1]}, types, nil
+	case "exec":
+		return &commandSink{name: args[1], args: args[2:]}, types, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown sink type: %s (webhook, file, exec)", args[0])
+	}
+}
@@ -0,0 +1,16 @@
+package backgroundcommands
+
+import "testing"
+
+func TestWebhookSinkRequiresLocalhost(t *testing.T) {
+	for _, rawURL := range []string{"http://127.0.0.1:8080/hook", "https://localhost/hook", "http://[::1]:9000/"} {
+		if _, err := newWebhookSink(rawURL); err != nil {
+			t.Errorf("newWebhookSink(%q): %v", rawURL, err)
+		}
+	}
+	for _, rawURL := range []string{"http://example.com/hook", "http://10.0.0.1/hook", "ftp://127.0.0.1/", "http://"} {
+		if _, err := newWebhookSink(rawURL); err == nil {
+			t.Errorf("newWebhookSink(%q) accepted a non-local URL", rawURL)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package backgroundcommands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+	"github.com/recyvan/smf/internal/protocol"
+)
+
+// errInputLocked 输入锁被其它会话持有
+var errInputLocked = errors.New("input is locked by another session")
+
+const (
+	// sendTimeout send 和 sendfile 等待任务读取一块输入的最长时间
+	sendTimeout = 5 * time.Second
+	// sendChunkSize sendfile 每次写入的字节数
+	sendChunkSize = 32 * 1024
+)
+
+// attach 将会话附加到任务，wantInput 为 true 时申请输入锁，steal 为 true 时从其它会话抢占
+// 共享模式下所有 interact 会话都可以输入，返回会话编号
+func (tm *TaskManager) attach(task *Task, wantInput, steal bool) (int, error) {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	if wantInput && !task.sharedInput && task.inputHolder != 0 && !steal {
+		return 0, fmt.Errorf("input of task %d is held by session %d; use 'watch %d' or 'interact --steal %d'",
+			task.ID, task.inputHolder, task.ID, task.ID)
+	}
+	task.sessions++
+	session := task.sessions
+	task.attached++
+	if wantInput && !task.sharedInput {
+		task.inputHolder = session
+	}
+	return session, nil
+}
+
+// detach 会话离开任务并释放其持有的输入锁
+func (tm *TaskManager) detach(task *Task, session int) {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	task.attached--
+	if task.inputHolder == session {
+		task.inputHolder = 0
+	}
+}
+
+// writeInput 以会话的身份向任务写入输入，独占模式下无人持有输入锁时由该会话获得
+func (tm *TaskManager) writeInput(task *Task, session int, data []byte) error {
+	tm.tasksLock.Lock()
+	if !task.sharedInput {
+		if task.inputHolder == 0 {
+			task.inputHolder = session
+		}
+		if task.inputHolder != session {
+			tm.tasksLock.Unlock()
+			return errInputLocked
+		}
+	}
+	input := task.InputWriter
+	tm.tasksLock.Unlock()
+	_, err := input.Write(data)
+	return err
+}
+
+// inputFor 返回会话可以写入的任务输入，独占模式下输入锁被 interact 会话持有时拒绝
+func (tm *TaskManager) inputFor(user command.Session, taskIDStr string) (*Task, io.WriteCloser, error) {
+	id, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid task ID: %v", err)
+	}
+
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	task, exists := tm.tasks[id]
+	if !exists || task.Status != TaskStatusRunning {
+		return nil, nil, fmt.Errorf("task %d not found or not running", id)
+	}
+	if err := authorize(user, task); err != nil {
+		return nil, nil, err
+	}
+	if !task.sharedInput && task.inputHolder != 0 {
+		return nil, nil, fmt.Errorf("input of task %d is held by session %d; use 'task input %d shared' to allow sending",
+			id, task.inputHolder, id)
+	}
+	return task, task.InputWriter, nil
+}
+
+// writeTimeout 写入任务输入，任务在 sendTimeout 内没有读取时返回错误
+// 超时后写入仍在后台等待，直到任务读取或本次运行结束
+func writeTimeout(w io.Writer, data []byte) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(sendTimeout):
+		return fmt.Errorf("task did not read its input within %s", sendTimeout)
+	}
+}
+
+// SendInput 不附加会话直接向任务写入输入
+func (tm *TaskManager) SendInput(rw io.ReadWriter, user command.Session, taskIDStr string, data []byte) error {
+	task, input, err := tm.inputFor(user, taskIDStr)
+	if err != nil {
+		return err
+	}
+	if err := writeTimeout(input, data); err != nil {
+		return fmt.Errorf("failed to send to task %d: %v", task.ID, err)
+	}
+	fmt.Fprintf(rw, "Sent %d bytes to task %d\n", len(data), task.ID)
+	return nil
+}
+
+// SendFile 将服务端的文件内容写入任务的输入
+func (tm *TaskManager) SendFile(rw io.ReadWriter, user command.Session, taskIDStr, path string) error {
+	task, input, err := tm.inputFor(user, taskIDStr)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, sendChunkSize)
+	var sent int64
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			if err := writeTimeout(input, buf[:n]); err != nil {
+				return fmt.Errorf("failed to send to task %d after %d bytes: %v", task.ID, sent, err)
+			}
+			sent += int64(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read file: %v", readErr)
+		}
+	}
+	fmt.Fprintf(rw, "Sent %d bytes from %s to task %d\n", sent, path, task.ID)
+	return nil
+}
+
+// CloseInput 关闭任务本次运行的输入，任务读到 EOF；任务重启后有新的输入
+func (tm *TaskManager) CloseInput(rw io.ReadWriter, user command.Session, taskIDStr string) error {
+	task, input, err := tm.inputFor(user, taskIDStr)
+	if err != nil {
+		return err
+	}
+	if err := input.Close(); err != nil {
+		return fmt.Errorf("failed to close input of task %d: %v", task.ID, err)
+	}
+	fmt.Fprintf(rw, "Closed input of task %d\n", task.ID)
+	return nil
+}
+
+// SetInputMode 设置任务的输入模式: exclusive 同一时间只有一个会话可以输入，shared 所有 interact 会话都可以输入
+func (tm *TaskManager) SetInputMode(rw io.ReadWriter, user command.Session, taskIDStr, mode string) error {
+	id, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid task ID: %v", err)
+	}
+	if err := tm.setInputMode(user, id, mode); err != nil {
+		return err
+	}
+	fmt.Fprintf(rw, "Task %d input mode set to %s\n", id, mode)
+	return nil
+}
+
+// setInputMode 修改任务的输入模式
+func (tm *TaskManager) setInputMode(user command.Session, id int, mode string) error {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	task, exists := tm.tasks[id]
+	if !exists || !task.alive() {
+		return fmt.Errorf("task %d not found or not running", id)
+	}
+	if err := authorize(user, task); err != nil {
+		return err
+	}
+	switch mode {
+	case "shared":
+		task.sharedInput = true
+		task.inputHolder = 0
+	case "exclusive":
+		task.sharedInput = false
+	default:
+		return fmt.Errorf("invalid input mode: %s (shared, exclusive)", mode)
+	}
+	return nil
+}
+
+// WatchTask 只读地附加到任务，回放已保留的输出并实时推送新输出，按回车结束
+func (tm *TaskManager) WatchTask(rw io.ReadWriter, user command.Session, taskIDStr string) error {
+	id, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid task ID: %v", err)
+	}
+
+	tm.tasksLock.Lock()
+	task, exists := tm.tasks[id]
+	if !exists || !task.alive() {
+		tm.tasksLock.Unlock()
+		return fmt.Errorf("task %d not found or not running", id)
+	}
+	tm.tasksLock.Unlock()
+	if err := authorize(user, task); err != nil {
+		return err
+	}
+
+	session, _ := tm.attach(task, false, false)
+	defer tm.detach(task, session)
+	fmt.Fprintf(rw, "Watching task %d (read-only), press Enter to stop\n", id)
+
+	// 伪终端任务的控制帧不转发，客户端保持行模式
+	var mu sync.Mutex
+	var parser protocol.Parser
+	stdout := func(data string) {
+		mu.Lock()
+		defer mu.Unlock()
+		plain, _ := parser.Feed([]byte(data))
+		rw.Write(plain)
+	}
+	stderr := command.Stderr(rw)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		task.output.follow(0, stdout, stop)
+	}()
+	go func() {
+		defer wg.Done()
+		task.errOutput.follow(0, func(data string) { fmt.Fprint(stderr, data) }, stop)
+	}()
+
+	// 任务结束时输出完剩余内容后提示，用户按下回车时停止
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		select {
+		case <-task.Done:
+			wg.Wait()
+			fmt.Fprintf(rw, "\nTask %d finished, press Enter to return\n", id)
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 1024)
+	rw.Read(buf)
+	close(stop)
+	wg.Wait()
+	<-notified
+	return nil
+}
@@ -0,0 +1,293 @@
+package backgroundcommands
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTaskLogDir 任务输出日志的默认目录
+	DefaultTaskLogDir = "tasklogs"
+	// defaultRingSize 每路输出在内存中保留的字节数，用于 interact 回放
+	defaultRingSize = 256 * 1024
+	// defaultLogMaxSize 单个日志文件的大小上限，超过后轮转
+	defaultLogMaxSize = 10 * 1024 * 1024
+	// defaultLogBackups 轮转后保留的旧日志数量
+	defaultLogBackups = 3
+	// maxTailRead tail 从每个日志文件末尾读取的最大字节数
+	maxTailRead = 1024 * 1024
+	// defaultTailLines tail 默认输出的行数
+	defaultTailLines = 10
+)
+
+// taskOutput 任务的一路输出: 内存中只保留末尾部分，完整内容写入日志文件
+// 观察者订阅后在有新输出时收到通知，再按各自的读取位置读取，慢的观察者不会阻塞任务
+type taskOutput struct {
+	mu      sync.Mutex
+	ring    []byte
+	limit   int
+	total   int64 // 累计写入的字节数，用作读取位置
+	log     *rotatingFile
+	subs    map[chan struct{}]struct{}
+	lines   *lineSplitter // 设置后每一行输出都回调一次
+	written time.Time     // 最近一次写入的时间
+	closed  bool
+	path    string // 日志文件路径，只保留在内存中时为空
+}
+
+func newTaskOutput(limit int, log *rotatingFile) *taskOutput {
+	o := &taskOutput{limit: limit, log: log}
+	if log != nil {
+		o.path = log.path
+	}
+	return o
+}
+
+func (o *taskOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ring = append(o.ring, p...)
+	if len(o.ring) > o.limit {
+		o.ring = o.ring[len(o.ring)-o.limit:]
+	}
+	o.total += int64(len(p))
+	o.written = time.Now()
+	if o.lines != nil {
+		o.lines.Write(p)
+	}
+	for ch := range o.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	if o.log != nil {
+		if _, err := o.log.Write(p); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			o.log.Close()
+			o.log = nil
+		}
+	}
+	return len(p), nil
+}
+
+// setLineFunc 设置按行回调的函数
+func (o *taskOutput) setLineFunc(emit func(line string)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lines = &lineSplitter{emit: emit}
+}
+
+// lastWrite 返回最近一次写入的时间
+func (o *taskOutput) lastWrite() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.written
+}
+
+// String 返回内存中保留的输出
+func (o *taskOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return string(o.ring)
+}
+
+// ReadFrom 返回 offset 之后的输出及新的读取位置，已被丢弃的部分会被跳过
+func (o *taskOutput) ReadFrom(offset int64) (string, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	start := o.total - int64(len(o.ring))
+	if offset < start {
+		offset = start
+	}
+	return string(o.ring[offset-start:]), o.total
+}
+
+// Subscribe 返回有新输出时收到通知的通道及取消订阅的函数，输出结束后通道被关闭
+func (o *taskOutput) Subscribe() (<-chan struct{}, func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	if o.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if o.subs == nil {
+		o.subs = make(map[chan struct{}]struct{})
+	}
+	o.subs[ch] = struct{}{}
+	return ch, func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		delete(o.subs, ch)
+	}
+}
+
+// follow 从 offset 开始推送新输出，直到 stop 关闭或输出结束
+func (o *taskOutput) follow(offset int64, emit func(string), stop <-chan struct{}) {
+	notify, unsubscribe := o.Subscribe()
+	defer unsubscribe()
+	for {
+		var data string
+		if data, offset = o.ReadFrom(offset); data != "" {
+			emit(data)
+		}
+		select {
+		case _, ok := <-notify:
+			if !ok {
+				if data, _ = o.ReadFrom(offset); data != "" {
+					emit(data)
+				}
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close 关闭日志文件并通知所有观察者输出已结束
+func (o *taskOutput) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.lines != nil {
+		o.lines.Flush()
+	}
+	if o.log != nil {
+		o.log.Close()
+		o.log = nil
+	}
+	if !o.closed {
+		o.closed = true
+		for ch := range o.subs {
+			close(ch)
+		}
+		o.subs = nil
+	}
+}
+
+// rotatingFile 按大小轮转的日志文件，旧文件依次命名为 path.1、path.2 ...
+type rotatingFile struct {
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	backups int
+}
+
+// openRotatingFile 打开日志文件，已存在的同名文件和轮转的旧文件都会保留，新内容追加在末尾
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	return &rotatingFile{path: path, file: file, size: size, maxSize: maxSize, backups: backups}, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write log file: %v", err)
+	}
+	return n, nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := f.backups; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i-1), fmt.Sprintf("%s.%d", f.path, i))
+	}
+	if f.backups > 0 {
+		os.Rename(f.path, f.path+".1")
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	f.file = file
+	f.size = 0
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+// tailLog 返回日志文件最后 n 行，当前文件行数不足时继续从最近一次轮转的文件中读取
+func tailLog(path string, n int) (string, error) {
+	data, err := readFileTail(path)
+	if err != nil {
+		return "", err
+	}
+	if countLines(data) < n {
+		if older, err := readFileTail(path + ".1"); err == nil {
+			data = append(older, data...)
+		}
+	}
+	return string(lastLines(data, n)), nil
+}
+
+// readFileTail 读取文件末尾最多 maxTailRead 字节
+func readFileTail(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxTailRead {
+		if _, err := file.Seek(info.Size()-maxTailRead, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(file)
+}
+
+func countLines(data []byte) int {
+	n := bytes.Count(data, []byte{'\n'})
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// lastLines 返回 data 的最后 n 行
+func lastLines(data []byte, n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			n--
+			if n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
@@ -0,0 +1,49 @@
+//go:build !windows
+
+package backgroundcommands
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminateProcessGroup 向进程所在的进程组发送 SIGTERM
+func terminateProcessGroup(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGTERM); err == nil {
+		return nil
+	}
+	return p.Signal(syscall.SIGTERM)
+}
+
+// killProcessGroup 向进程所在的进程组发送 SIGKILL
+func killProcessGroup(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+	return p.Kill()
+}
+
+// stopProcessGroup 向进程所在的进程组发送 SIGSTOP
+func stopProcessGroup(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGSTOP); err == nil {
+		return nil
+	}
+	return p.Signal(syscall.SIGSTOP)
+}
+
+// continueProcessGroup 向进程所在的进程组发送 SIGCONT
+func continueProcessGroup(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGCONT); err == nil {
+		return nil
+	}
+	return p.Signal(syscall.SIGCONT)
+}
+
+// processMaxRSS 返回已退出进程的峰值内存，单位字节
+func processMaxRSS(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Linux 下 Maxrss 单位为 KB
+		return int64(rusage.Maxrss) * 1024
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+package backgroundcommands
+
+import (
+	"errors"
+	"os"
+)
+
+// terminateProcessGroup Windows 下没有 SIGTERM，直接结束进程
+func terminateProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// killProcessGroup 结束进程
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// stopProcessGroup Windows 下不支持暂停进程
+func stopProcessGroup(p *os.Process) error {
+	return errors.New("pausing tasks is not supported on windows")
+}
+
+// continueProcessGroup Windows 下不支持暂停进程
+func continueProcessGroup(p *os.Process) error {
+	return errors.New("pausing tasks is not supported on windows")
+}
+
+// processMaxRSS Windows 下不统计峰值内存
+func processMaxRSS(state *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,206 @@
+package backgroundcommands
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// defaultQueueLimit 等待队列的默认长度上限
+const defaultQueueLimit = 100
+
+// taskQueue 等待运行的任务，优先级高的先运行，相同优先级按入队顺序
+type taskQueue []*Task
+
+func (q taskQueue) Len() int { return len(q) }
+
+func (q taskQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].queueIndex = i
+	q[j].queueIndex = j
+}
+
+func (q *taskQueue) Push(x interface{}) {
+	task := x.(*Task)
+	task.queueIndex = len(*q)
+	*q = append(*q, task)
+}
+
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	task := old[len(old)-1]
+	old[len(old)-1] = nil
+	task.queueIndex = -1
+	*q = old[:len(old)-1]
+	return task
+}
+
+// enqueue 将任务放入等待队列，调用方需持有 tasksLock
+func (tm *TaskManager) enqueue(task *Task) {
+	tm.queueSeq++
+	task.seq = tm.queueSeq
+	task.Status = TaskStatusQueued
+	heap.Push(&tm.queue, task)
+}
+
+// dispatch 在协程池有空闲时按优先级启动等待中的任务
+// 运行数由 running 计数控制，提交时协程池不会长时间阻塞
+func (tm *TaskManager) dispatch() {
+	type ready struct {
+		task      *Task
+		input     io.ReadCloser
+		output    io.WriteCloser
+		errOutput io.WriteCloser
+	}
+
+	tm.tasksLock.Lock()
+	var tasks []ready
+	for tm.queue.Len() > 0 && tm.running < tm.poolSize {
+		task := heap.Pop(&tm.queue).(*Task)
+		task.Status = TaskStatusRunning
+		task.attemptStart = time.Now()
+		if task.opts.Health != nil {
+			task.health = healthStatus{state: HealthStarting}
+		}
+		tm.running++
+		e := taskEvent(task, EventStarted)
+		e.Status, e.Attempt = task.Status, task.restarts+1
+		tm.events.Publish(e)
+		tasks = append(tasks, ready{task, task.inputReader, task.outputWriter, task.errorWriter})
+	}
+	pool := tm.pool
+	tm.tasksLock.Unlock()
+
+	for _, r := range tasks {
+		r := r
+		err := pool.Submit(func() {
+			defer tm.release()
+			tm.runTask(r.task, r.input, r.output, r.errOutput)
+		})
+		if err != nil {
+			// 协程池已关闭，按运行失败处理
+			r.input.Close()
+			r.output.Close()
+			r.errOutput.Close()
+			r.task.captured.Wait()
+			tm.finishTask(r.task, nil, fmt.Errorf("failed to submit task: %v", err))
+			tm.release()
+		}
+	}
+}
+
+// release 任务运行结束后归还名额，并在新协程中启动等待的任务，避免在当前工作协程中等待
+func (tm *TaskManager) release() {
+	tm.tasksLock.Lock()
+	tm.running--
+	tm.tasksLock.Unlock()
+	go tm.dispatch()
+}
+
+// abortQueued 结束尚未运行就被终止的任务，调用方需已将其移出队列
+func (tm *TaskManager) abortQueued(task *Task) {
+	task.inputReader.Close()
+	task.outputWriter.Close()
+	task.errorWriter.Close()
+	task.captured.Wait()
+	tm.finishTask(task, nil, nil)
+}
+
+// SetPriority 修改任务的优先级，排队中的任务会立即调整位置
+func (tm *TaskManager) SetPriority(rw io.ReadWriter, user command.Session, taskIDStr, priorityStr string) error {
+	id, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid task ID: %v", err)
+	}
+	priority, err := strconv.Atoi(priorityStr)
+	if err != nil {
+		return fmt.Errorf("invalid priority: %v", err)
+	}
+	if err := tm.setPriority(user, id, priority); err != nil {
+		return err
+	}
+	fmt.Fprintf(rw, "Task %d priority set to %d\n", id, priority)
+	return nil
+}
+
+// setPriority 修改任务的优先级，排队中的任务重新调整位置
+func (tm *TaskManager) setPriority(user command.Session, id, priority int) error {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	task, exists := tm.tasks[id]
+	if !exists || !task.alive() {
+		return fmt.Errorf("task %d not found or not running", id)
+	}
+	if err := authorize(user, task); err != nil {
+		return err
+	}
+	task.priority = priority
+	if task.Status == TaskStatusQueued {
+		heap.Fix(&tm.queue, task.queueIndex)
+	}
+	return nil
+}
+
+// Resize 调整协程池大小，扩大后立即启动等待中的任务，缩小时运行中的任务不受影响
+func (tm *TaskManager) Resize(rw io.ReadWriter, size int) error {
+	if size <= 0 {
+		return fmt.Errorf("pool size must be positive")
+	}
+	tm.tasksLock.Lock()
+	tm.pool.Tune(size)
+	tm.poolSize = size
+	tm.tasksLock.Unlock()
+
+	fmt.Fprintf(rw, "Pool resized to %d workers\n", size)
+	tm.dispatch()
+	return nil
+}
+
+// SetQueueLimit 设置等待队列的长度上限
+func (tm *TaskManager) SetQueueLimit(rw io.ReadWriter, limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("queue limit must not be negative")
+	}
+	tm.tasksLock.Lock()
+	tm.queueLimit = limit
+	tm.tasksLock.Unlock()
+	fmt.Fprintf(rw, "Queue limit set to %d\n", limit)
+	return nil
+}
+
+// PoolStatus 显示协程池和等待队列的状态
+func (tm *TaskManager) PoolStatus(rw io.ReadWriter) {
+	tm.tasksLock.Lock()
+	running, poolSize, queueLimit := tm.running, tm.poolSize, tm.queueLimit
+	// 按出队顺序列出等待的任务
+	queue := append(taskQueue{}, tm.queue...)
+	sort.Slice(queue, queue.Less)
+	rows := make([]string, 0, len(queue))
+	for _, task := range queue {
+		rows = append(rows, fmt.Sprintf("%d\t%d\t%s %s\n", task.ID, task.priority, task.Name, strings.Join(task.Args, " ")))
+	}
+	tm.tasksLock.Unlock()
+
+	fmt.Fprintf(rw, "Workers:  %d/%d busy\n", running, poolSize)
+	fmt.Fprintf(rw, "Queued:   %d (limit %d)\n", len(rows), queueLimit)
+	if len(rows) == 0 {
+		return
+	}
+	fmt.Fprintf(rw, "ID\tPRIORITY\tCOMMAND\n")
+	for _, row := range rows {
+		fmt.Fprint(rw, row)
+	}
+}
@@ -0,0 +1,301 @@
+package backgroundcommands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+const (
+	// DefaultScheduleFile 定时任务的默认持久化文件
+	DefaultScheduleFile = "schedules.json"
+	// scheduleTick 调度器检查到期任务的间隔
+	scheduleTick = time.Second
+)
+
+// OverlapPolicy 上一次运行尚未结束时到期的处理方式
+type OverlapPolicy string
+
+const (
+	OverlapSkip  OverlapPolicy = "skip"  // 跳过本次运行
+	OverlapQueue OverlapPolicy = "queue" // 等上一次结束后立即运行，多次到期只排队一次
+	OverlapAllow OverlapPolicy = "allow" // 同时运行
+)
+
+// ParseOverlapPolicy 解析重叠策略
+func ParseOverlapPolicy(value string) (OverlapPolicy, error) {
+	switch policy := OverlapPolicy(value); policy {
+	case OverlapSkip, OverlapQueue, OverlapAllow:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid overlap policy: %s (skip, queue, allow)", value)
+	}
+}
+
+// ScheduledJob 按 cron 表达式周期运行的后台命令
+type ScheduledJob struct {
+	ID       int           `json:"id"`
+	Expr     string        `json:"expr"`
+	Name     string        `json:"name"`
+	Args     []string      `json:"args"`
+	TimeZone string        `json:"tz,omitempty"`
+	Overlap  OverlapPolicy `json:"overlap"`
+	Jitter   time.Duration `json:"jitter,omitempty"`
+	Paused   bool          `json:"paused,omitempty"`
+	Owner    string        `json:"owner,omitempty"` // 添加定时任务的用户，也是每次运行的任务所有者
+
+	schedule *CronSchedule
+	loc      *time.Location
+	next     time.Time
+	lastRun  time.Time
+	lastTask int
+	pending  bool // queue 策略下等待上一次运行结束
+}
+
+// prepare 解析表达式和时区，并计算下一次运行时间
+func (job *ScheduledJob) prepare(now time.Time) error {
+	schedule, err := ParseCron(job.Expr)
+	if err != nil {
+		return err
+	}
+	loc := time.Local
+	if job.TimeZone != "" {
+		if loc, err = time.LoadLocation(job.TimeZone); err != nil {
+			return fmt.Errorf("invalid time zone %s: %v", job.TimeZone, err)
+		}
+	}
+	if job.Overlap == "" {
+		job.Overlap = OverlapSkip
+	}
+	job.schedule = schedule
+	job.loc = loc
+	job.updateNext(now)
+	return nil
+}
+
+// updateNext 计算 now 之后的下一次运行时间，并加上随机抖动
+func (job *ScheduledJob) updateNext(now time.Time) {
+	job.next = job.schedule.Next(now.In(job.loc))
+	if !job.next.IsZero() && job.Jitter > 0 {
+		job.next = job.next.Add(rand.N(job.Jitter))
+	}
+}
+
+// Scheduler 定时任务调度器，到期的任务通过 TaskManager.StartTask 启动
+type Scheduler struct {
+	mu     sync.Mutex
+	tm     *TaskManager
+	jobs   map[int]*ScheduledJob
+	nextID int
+	path   string
+}
+
+// NewScheduler 创建调度器并开始调度
+func NewScheduler(tm *TaskManager) *Scheduler {
+	s := &Scheduler{
+		tm:   tm,
+		jobs: make(map[int]*ScheduledJob),
+	}
+	go s.loop()
+	return s
+}
+
+// SetFile 设置持久化文件并加载其中的定时任务，path 为空时只保存在内存中
+func (s *Scheduler) SetFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read schedules: %v", err)
+	}
+	var jobs []*ScheduledJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("failed to parse schedules %s: %v", path, err)
+	}
+	now := time.Now()
+	for _, job := range jobs {
+		if err := job.prepare(now); err != nil {
+			fmt.Printf("Warning: skipping schedule %d: %v\n", job.ID, err)
+			continue
+		}
+		s.jobs[job.ID] = job
+		if job.ID > s.nextID {
+			s.nextID = job.ID
+		}
+	}
+	return nil
+}
+
+// Add 添加定时任务，返回分配的 ID
+func (s *Scheduler) Add(job *ScheduledJob) (int, error) {
+	if err := job.prepare(time.Now()); err != nil {
+		return 0, err
+	}
+	if job.next.IsZero() {
+		return 0, fmt.Errorf("cron expression %q never matches", job.Expr)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	job.ID = s.nextID
+	s.jobs[job.ID] = job
+	return job.ID, s.save()
+}
+
+// Remove 删除定时任务，已启动的任务不受影响，只有添加者和管理员可以删除
+func (s *Scheduler) Remove(session command.Session, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, exists := s.jobs[id]
+	if !exists {
+		return fmt.Errorf("schedule %d not found", id)
+	}
+	if !session.Admin && job.Owner != session.User {
+		return fmt.Errorf("permission denied: schedule %d belongs to %s", id, ownerName(job.Owner))
+	}
+	delete(s.jobs, id)
+	return s.save()
+}
+
+// SetPaused 暂停或恢复定时任务，恢复后从当前时间重新计算下一次运行，只有添加者和管理员可以修改
+func (s *Scheduler) SetPaused(session command.Session, id int, paused bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, exists := s.jobs[id]
+	if !exists {
+		return fmt.Errorf("schedule %d not found", id)
+	}
+	if !session.Admin && job.Owner != session.User {
+		return fmt.Errorf("permission denied: schedule %d belongs to %s", id, ownerName(job.Owner))
+	}
+	job.Paused = paused
+	job.pending = false
+	if !paused {
+		job.updateNext(time.Now())
+	}
+	return s.save()
+}
+
+// List 列出所有定时任务
+func (s *Scheduler) List(rw io.ReadWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.jobs) == 0 {
+		fmt.Fprintln(rw, "No scheduled jobs")
+		return
+	}
+
+	jobs := make([]*ScheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+
+	fmt.Fprintf(rw, "ID\tSTATE\tSCHEDULE\tTZ\tOVERLAP\tNEXT RUN\tLAST RUN\tCOMMAND\n")
+	for _, job := range jobs {
+		state, next := "active", "-"
+		if job.Paused {
+			state = "paused"
+		} else if !job.next.IsZero() {
+			next = job.next.In(job.loc).Format("2006-01-02 15:04:05")
+		}
+		lastRun := "-"
+		if job.lastTask != 0 {
+			lastRun = fmt.Sprintf("%s (task %d)", job.lastRun.In(job.loc).Format("2006-01-02 15:04:05"), job.lastTask)
+		}
+		fmt.Fprintf(rw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s %s\n",
+			job.ID, state, job.Expr, job.loc, job.Overlap, next, lastRun,
+			job.Name, strings.Join(job.Args, " "))
+	}
+}
+
+func (s *Scheduler) loop() {
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.tick(now)
+	}
+}
+
+// tick 启动所有到期的定时任务
+func (s *Scheduler) tick(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.Paused {
+			continue
+		}
+		if job.pending && !s.tm.TaskAlive(job.lastTask) {
+			job.pending = false
+			s.run(job, now)
+		}
+		if job.next.IsZero() || now.Before(job.next) {
+			continue
+		}
+		job.updateNext(now)
+
+		if job.lastTask != 0 && s.tm.TaskAlive(job.lastTask) {
+			switch job.Overlap {
+			case OverlapSkip:
+				continue
+			case OverlapQueue:
+				job.pending = true
+				continue
+			}
+		}
+		s.run(job, now)
+	}
+}
+
+// run 通过任务管理器启动一次运行，启动信息不输出到任何连接
+func (s *Scheduler) run(job *ScheduledJob, now time.Time) {
+	rw := &taskIO{reader: strings.NewReader(""), writer: io.Discard, errWriter: io.Discard}
+	opts := TaskOptions{
+		Restart: RestartNever,
+		Owner:   job.Owner,
+		Labels:  map[string]string{"schedule": strconv.Itoa(job.ID)},
+	}
+	if id := s.tm.StartTask(rw, opts, job.Name, job.Args...); id != 0 {
+		job.lastTask = id
+		job.lastRun = now
+	}
+}
+
+// save 写入临时文件后重命名，调用方需持有 mu
+func (s *Scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	jobs := make([]*ScheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode schedules: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write schedules: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,127 @@
+package backgroundcommands
+
+import (
+	"fmt"
+	"time"
+)
+
+// RestartPolicy 任务结束后的重启策略
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+const (
+	// defaultBackoff 第一次重启前的等待时间，之后每次连续失败翻倍
+	defaultBackoff = time.Second
+	// maxBackoff 重启等待时间的上限
+	maxBackoff = 5 * time.Minute
+	// stableRunTime 运行超过该时间视为正常退出，重置退避时间和快速退出计数
+	stableRunTime = 10 * time.Second
+	// crashLoopLimit 连续快速退出达到该次数时判定为崩溃循环，停止重启
+	crashLoopLimit = 5
+)
+
+// TaskOptions 后台任务的监管选项
+type TaskOptions struct {
+	Restart    RestartPolicy
+	MaxRetries int           // 最大重启次数，0 表示不限
+	Backoff    time.Duration // 初始退避时间
+	Priority   int           // 协程池已满时的排队优先级，越大越先运行
+	Limits     ResourceLimits
+	Detach     bool              // 子进程由 shim 独立运行，服务端重启后重新接管
+	Owner      string            // 启动任务的用户，为空表示系统任务，只有管理员可以操作
+	Session    string            // 启动任务的会话
+	Labels     map[string]string // 用于 check 过滤的标签
+	Health     *HealthCheck      // 健康检查，为 nil 时不检查
+}
+
+// ParseRestartPolicy 解析重启策略
+func ParseRestartPolicy(value string) (RestartPolicy, error) {
+	switch policy := RestartPolicy(value); policy {
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid restart policy: %s (never, on-failure, always)", value)
+	}
+}
+
+// exitReason 描述任务一次运行的退出原因
+func exitReason(status TaskStatus, exitCode int, err error) string {
+	switch {
+	case status == TaskStatusStopped:
+		return "killed"
+	case err != nil:
+		return fmt.Sprintf("error: %v", err)
+	default:
+		return fmt.Sprintf("exit code %d", exitCode)
+	}
+}
+
+// nextRestart 根据重启策略判断任务是否需要重启，返回重启前的等待时间
+// 连续快速退出时判定为崩溃循环，返回的状态为 TaskStatusCrashLoop，调用方需持有 tasksLock
+func (task *Task) nextRestart(status TaskStatus, runtime time.Duration) (bool, time.Duration, TaskStatus) {
+	if status == TaskStatusStopped {
+		return false, 0, status
+	}
+	switch task.opts.Restart {
+	case RestartAlways:
+	case RestartOnFailure:
+		if status != TaskStatusFailed {
+			return false, 0, status
+		}
+	default:
+		return false, 0, status
+	}
+	if task.opts.MaxRetries > 0 && task.restarts >= task.opts.MaxRetries {
+		return false, 0, status
+	}
+
+	if runtime < stableRunTime {
+		task.quickExits++
+	} else {
+		task.quickExits = 0
+		task.backoff = task.opts.Backoff
+	}
+	if task.quickExits >= crashLoopLimit {
+		return false, 0, TaskStatusCrashLoop
+	}
+
+	delay := task.backoff
+	task.backoff *= 2
+	if task.backoff > maxBackoff {
+		task.backoff = maxBackoff
+	}
+	return true, delay, status
+}
+
+// restartAfter 等待退避时间后重新运行任务，期间任务被终止则直接结束
+// 期间开始排空时以上一次运行的结果 status 结束任务
+func (tm *TaskManager) restartAfter(task *Task, delay time.Duration, status TaskStatus) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-task.ctx.Done():
+		tm.closeTask(task, TaskStatusStopped)
+		return
+	}
+
+	tm.tasksLock.Lock()
+	if task.ctx.Err() != nil {
+		tm.tasksLock.Unlock()
+		tm.closeTask(task, TaskStatusStopped)
+		return
+	}
+	if tm.accepting() != nil {
+		tm.tasksLock.Unlock()
+		tm.closeTask(task, status)
+		return
+	}
+	tm.launch(task)
+	tm.tasksLock.Unlock()
+	tm.dispatch()
+}
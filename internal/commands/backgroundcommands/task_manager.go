@@ -1,26 +1,36 @@
 package backgroundcommands
 
 import (
-	"bufio"
 	"bytes"
+	"container/heap"
 	"context"
 	"fmt"
 	"io"
-	"reflect"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
+	"github.com/recyvan/smf/internal/command"
+	"github.com/recyvan/smf/internal/protocol"
 )
 
 type TaskStatus string
 
+const (
+	// killGracePeriod 终止任务时等待其退出的时间，超时后强制结束子进程组
+	killGracePeriod = 3 * time.Second
+)
+
 // 首先添加一个辅助类型来包装 Reader 和 Writer
 type taskIO struct {
-	reader io.Reader
-	writer io.Writer
+	reader    io.Reader
+	writer    io.Writer // 运行命令时为 protocol.EscapeWriter，命令输出中伪造的控制帧被转义
+	errWriter io.Writer
 }
 
 // 实现 io.Reader 接口
@@ -33,10 +43,44 @@ func (t *taskIO) Write(p []byte) (n int, err error) {
 	return t.writer.Write(p)
 }
 
+// WriteRawFrame 伪终端等命令发出的控制帧原样写入任务输出，由 interact 转发给客户端
+func (t *taskIO) WriteRawFrame(frame []byte) error {
+	if fw, ok := t.writer.(protocol.RawFrameWriter); ok {
+		return fw.WriteRawFrame(frame)
+	}
+	_, err := t.writer.Write(frame)
+	return err
+}
+
+// Stderr 标准错误输出单独写入任务的错误缓冲区
+func (t *taskIO) Stderr() io.Writer {
+	return t.errWriter
+}
+
+// SupportsFrames 任务输出中的控制帧由 interact 转发给客户端
+func (t *taskIO) SupportsFrames() bool {
+	return true
+}
+
+// InterruptRead 关闭本次运行的输入管道，阻塞中的 Read 立即返回；任务重启时会创建新的管道
+func (t *taskIO) InterruptRead() (func(), bool) {
+	closer, ok := t.reader.(io.Closer)
+	if !ok {
+		return nil, false
+	}
+	closer.Close()
+	return func() {}, true
+}
+
 const (
-	TaskStatusRunning  TaskStatus = "RUNNING"
-	TaskStatusStopped  TaskStatus = "STOPPED"
-	TaskStatusFinished TaskStatus = "FINISHED"
+	TaskStatusQueued     TaskStatus = "QUEUED"
+	TaskStatusRunning    TaskStatus = "RUNNING"
+	TaskStatusStopped    TaskStatus = "STOPPED"
+	TaskStatusFinished   TaskStatus = "FINISHED"
+	TaskStatusFailed     TaskStatus = "FAILED"
+	TaskStatusRestarting TaskStatus = "RESTARTING"
+	TaskStatusCrashLoop  TaskStatus = "CRASHLOOP"
+	TaskStatusPaused     TaskStatus = "PAUSED"
 )
 
 // Task 结构体增加更多信息
@@ -48,332 +92,1155 @@ type Task struct {
 	StartTime    time.Time
 	InputWriter  io.WriteCloser
 	OutputReader io.Reader
-	outputBuffer *bytes.Buffer
-	outputLock   sync.Mutex
+	ErrorReader  io.Reader
+	output       *taskOutput
+	errOutput    *taskOutput
 	Done         chan struct{}
+	ctx          context.Context
+	cancel       context.CancelFunc
+	processes    map[int]*os.Process // 任务启动且尚未退出的子进程
+	exitCode     int                 // 最近退出的子进程的退出码
+	exited       bool                // 是否有子进程退出过
+	usage        ResourceUsage       // 已退出子进程累计的资源使用
+	cgroup       *taskCgroup         // 有 cpu 或内存限制时任务的 cgroup
+	cgroupErr    error               // cgroup 不可用的原因，不再重复尝试
+	timedOut     bool                // 本次运行是否已超时
+	detached     *detachedTask       // 独立运行时 shim 的状态，否则为 nil
+	procLock     sync.Mutex
+	captured     sync.WaitGroup // 输出捕获协程
+
+	// 监管信息，由 tasksLock 保护
+	opts          TaskOptions
+	attemptStart  time.Time     // 本次运行的开始时间
+	restarts      int           // 已重启次数
+	quickExits    int           // 连续快速退出次数
+	backoff       time.Duration // 下一次重启前的等待时间
+	lastExit      string        // 最近一次退出的原因
+	lastCode      int
+	lastErr       error
+	lastResult    []byte
+	health        healthStatus
+	record        *TaskRecord // 任务结束后的记录，Done 关闭后可读
+	forcedRestart string      // 触发规则要求本次运行结束后立即重启的原因
+
+	// 排队信息，由 tasksLock 保护
+	priority     int
+	seq          uint64 // 入队顺序
+	queueIndex   int    // 在等待队列中的位置
+	sessions     int    // 已分配的会话编号
+	attached     int    // 当前附加的会话数
+	inputHolder  int    // 持有输入锁的会话，0 表示无人持有
+	sharedInput  bool   // 共享模式下所有 interact 会话都可以输入
+	inputReader  *io.PipeReader
+	outputWriter *io.PipeWriter
+	errorWriter  *io.PipeWriter
+}
+
+// alive 任务是否仍在排队、运行或等待重启
+func (task *Task) alive() bool {
+	switch task.Status {
+	case TaskStatusQueued, TaskStatusRunning, TaskStatusPaused, TaskStatusRestarting:
+		return true
+	}
+	return false
 }
 
 type TaskManager struct {
-	tasks       map[int]*Task
-	tasksLock   sync.Mutex
-	taskID      int
-	funcMap     map[string]interface{}
-	pool        *ants.Pool
-	poolSize    int
-	isRebooting bool
+	tasks      map[int]*Task
+	tasksLock  sync.Mutex
+	taskID     int
+	registry   *command.Registry // 后台任务运行的命令，运行时按名称查找
+	pool       *ants.Pool
+	poolSize   int
+	state      managerState
+	history    *TaskHistory
+	logDir     string
+	queue      taskQueue // 等待协程池空闲的任务
+	queueLimit int
+	queueSeq   uint64
+	running    int             // 已提交到协程池的任务数
+	events     *EventBus       // 任务生命周期事件
+	triggers   *TriggerManager // 任务输出的触发规则
 }
 
-func NewTaskManager(poolSize int) (*TaskManager, error) {
+// NewTaskManager 创建任务管理器，任务按名称运行 registry 中可后台运行的命令
+func NewTaskManager(poolSize int, registry *command.Registry) (*TaskManager, error) {
 	pool, err := ants.NewPool(poolSize)
 	if err != nil {
 		return nil, err
 	}
 	return &TaskManager{
-		tasks:    make(map[int]*Task),
-		funcMap:  make(map[string]interface{}),
-		pool:     pool,
-		poolSize: poolSize,
+		tasks:      make(map[int]*Task),
+		registry:   registry,
+		pool:       pool,
+		poolSize:   poolSize,
+		history:    NewTaskHistory(defaultHistorySize),
+		logDir:     DefaultTaskLogDir,
+		queueLimit: defaultQueueLimit,
+		state:      managerAccepting,
+		events:     NewEventBus(),
+		triggers:   NewTriggerManager(),
 	}, nil
 }
 
-// Reboot 重启任务管理器
-func (tm *TaskManager) Reboot(rw io.ReadWriter) error {
+// SetLogDir 设置任务输出日志的目录，为空时输出只保留在内存中
+// 之后接管服务端重启前独立运行且仍未结束的任务，返回接管的任务数
+func (tm *TaskManager) SetLogDir(dir string) int {
+	tm.tasksLock.Lock()
+	tm.logDir = dir
+	tm.tasksLock.Unlock()
+	return tm.adoptDetached()
+}
+
+// logPath 返回任务标准输出或标准错误的日志文件路径，文件名带有开始时间
+// 不持久化历史时服务端重启后任务 ID 会重新编号，开始时间避免新任务覆盖之前的日志
+func (tm *TaskManager) logPath(id int, started time.Time, stderr bool) string {
+	if tm.logDir == "" {
+		return ""
+	}
+	name := fmt.Sprintf("task-%d-%s", id, started.Format("20060102-150405"))
+	if stderr {
+		return filepath.Join(tm.logDir, name+".err.log")
+	}
+	return filepath.Join(tm.logDir, name+".log")
+}
+
+// openOutput 创建任务的一路输出，日志文件无法创建时只保留在内存中并向 w 输出警告
+func (tm *TaskManager) openOutput(w io.Writer, id int, started time.Time, stderr bool) *taskOutput {
+	path := tm.logPath(id, started, stderr)
+	if path == "" {
+		return newTaskOutput(defaultRingSize, nil)
+	}
+	log, err := openRotatingFile(path, defaultLogMaxSize, defaultLogBackups)
+	if err != nil {
+		fmt.Fprintf(w, "Warning: %v, output of task %d is kept in memory only\n", err, id)
+		return newTaskOutput(defaultRingSize, nil)
+	}
+	return newTaskOutput(defaultRingSize, log)
+}
+
+// SetHistoryFile 将已结束任务的历史持久化到文件，并从已有记录之后继续分配任务 ID
+func (tm *TaskManager) SetHistoryFile(path string) error {
+	if err := tm.history.SetFile(path); err != nil {
+		return err
+	}
 	tm.tasksLock.Lock()
-	if tm.isRebooting {
+	defer tm.tasksLock.Unlock()
+	if maxID := tm.history.MaxID(); maxID > tm.taskID {
+		tm.taskID = maxID
+	}
+	return nil
+}
+
+// StartTask 启动后台任务，opts 指定任务结束后的重启策略和优先级，返回任务 ID，启动失败时返回 0
+// 协程池已满时任务进入等待队列，按优先级依次运行
+func (tm *TaskManager) StartTask(rw io.ReadWriter, opts TaskOptions, name string, args ...string) int {
+	tm.tasksLock.Lock()
+	if err := tm.accepting(); err != nil {
+		tm.tasksLock.Unlock()
+		fmt.Fprintf(rw, "Failed to start task: %v\n", err)
+		return 0
+	}
+	if _, err := tm.lookup(name); err != nil {
+		tm.tasksLock.Unlock()
+		fmt.Fprintf(rw, "Failed to start task: %v\n", err)
+		return 0
+	}
+	cmd, _ := tm.registry.Get(name)
+	if err := checkHealthAction(cmd, opts.Health); err != nil {
 		tm.tasksLock.Unlock()
-		return fmt.Errorf("reboot already in progress")
+		fmt.Fprintf(rw, "Failed to start task: %v\n", err)
+		return 0
+	}
+	if tm.running >= tm.poolSize && tm.queue.Len() >= tm.queueLimit {
+		tm.tasksLock.Unlock()
+		fmt.Fprintf(rw, "Failed to start task: queue is full (%d waiting)\n", tm.queue.Len())
+		return 0
 	}
-	tm.isRebooting = true
-	defer func() { tm.isRebooting = false }()
 
-	// 保存当前运行的任务信息
-	runningTasks := make([]struct {
-		name string
-		args []string
-	}, 0)
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
 
-	for _, task := range tm.tasks {
-		if task.Status == TaskStatusRunning {
-			runningTasks = append(runningTasks, struct {
-				name string
-				args []string
-			}{task.Name, task.Args})
+	var detached *detachedTask
+	if opts.Detach {
+		d, err := tm.newDetached(tm.taskID + 1)
+		if err != nil {
+			tm.tasksLock.Unlock()
+			fmt.Fprintf(rw, "Failed to start task: %v\n", err)
+			return 0
 		}
+		detached = d
 	}
 
-	// 关闭所有任务
-	for _, task := range tm.tasks {
-		task.Status = TaskStatusStopped
-		task.InputWriter.Close()
-		close(task.Done)
+	tm.taskID++
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// 日志文件无法创建时的警告在解锁后再输出
+	var warnings bytes.Buffer
+	now := time.Now()
+	task := &Task{
+		ID:        tm.taskID,
+		Name:      name,
+		Args:      args,
+		StartTime: now,
+		output:    tm.openOutput(&warnings, tm.taskID, now, false),
+		errOutput: tm.openOutput(&warnings, tm.taskID, now, true),
+		Done:      make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		processes: make(map[int]*os.Process),
+		opts:      opts,
+		backoff:   opts.Backoff,
+		priority:  opts.Priority,
+		detached:  detached,
 	}
-	tm.tasks = make(map[int]*Task)
 
-	// 关闭并重新创建协程池
-	tm.pool.Release()
-	pool, err := ants.NewPool(tm.poolSize)
-	if err != nil {
-		tm.tasksLock.Unlock()
-		return fmt.Errorf("failed to create new pool: %v", err)
+	tm.watchOutput(task)
+	if opts.Health != nil {
+		go tm.watchHealth(task)
 	}
-	tm.pool = pool
+	tm.tasks[tm.taskID] = task
+	tm.launch(task)
+	waiting := tm.running + tm.queue.Len() - tm.poolSize
 	tm.tasksLock.Unlock()
+	rw.Write(warnings.Bytes())
 
-	// 重启之前运行的任务
-	fmt.Fprintln(rw, "Rebooting task manager...")
-	for _, t := range runningTasks {
-		tm.StartTask(rw, t.name, t.args...)
+	if waiting > 0 {
+		fmt.Fprintf(rw, "Queued task %d: %s %v (%d waiting)\n", task.ID, task.Name, task.Args, waiting)
+	} else {
+		fmt.Fprintf(rw, "Started task %d: %s %v\n", task.ID, task.Name, task.Args)
 	}
-	fmt.Fprintln(rw, "Task manager rebooted successfully")
-	return nil
+	if warning := limitWarning(opts.Limits); warning != "" {
+		fmt.Fprintf(rw, "Warning: %s\n", warning)
+	}
+	tm.dispatch()
+	return task.ID
+}
+
+// WaitTask 等待任务结束并返回其记录，任务不存在时从历史中查找
+func (tm *TaskManager) WaitTask(id int) (*TaskRecord, bool) {
+	tm.tasksLock.Lock()
+	task, exists := tm.tasks[id]
+	tm.tasksLock.Unlock()
+	if !exists {
+		return tm.history.Get(id)
+	}
+	<-task.Done
+	return task.record, task.record != nil
 }
 
-func (tm *TaskManager) StartTask(rw io.ReadWriter, name string, args ...string) {
+// TaskAlive 任务是否仍在排队、运行或等待重启
+func (tm *TaskManager) TaskAlive(id int) bool {
 	tm.tasksLock.Lock()
 	defer tm.tasksLock.Unlock()
+	task, exists := tm.tasks[id]
+	return exists && task.alive()
+}
 
-	tm.taskID++
+// launch 为任务的一次运行创建管道并放入等待队列，调用方需持有 tasksLock，之后调用 dispatch 启动
+func (tm *TaskManager) launch(task *Task) {
 	inputReader, inputWriter := io.Pipe()
 	outputReader, outputWriter := io.Pipe()
-	outputBuffer := bytes.NewBuffer(nil)
+	errorReader, errorWriter := io.Pipe()
 
-	task := &Task{
-		ID:           tm.taskID,
-		Name:         name,
-		Args:         args,
-		Status:       TaskStatusRunning,
-		StartTime:    time.Now(),
-		InputWriter:  inputWriter,
-		OutputReader: outputReader,
-		outputBuffer: outputBuffer,
-		Done:         make(chan struct{}),
+	task.InputWriter = inputWriter
+	task.OutputReader = outputReader
+	task.ErrorReader = errorReader
+	task.inputReader = inputReader
+	task.outputWriter = outputWriter
+	task.errorWriter = errorWriter
+	task.procLock.Lock()
+	task.exited = false
+	task.procLock.Unlock()
+
+	task.captured.Add(2)
+	go task.capture(outputReader, task.output)
+	go task.capture(errorReader, task.errOutput)
+
+	tm.enqueue(task)
+}
+
+// taskInput 返回任务当前运行的输入管道，任务重启后会更换
+func (tm *TaskManager) taskInput(task *Task) io.WriteCloser {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	return task.InputWriter
+}
+
+// ListTasks 修改状态显示，all 为 true 时同时列出历史中已结束的任务
+// filter 按用户、标签、状态和命令名过滤并排序
+func (tm *TaskManager) ListTasks(rw io.ReadWriter, all bool, filter TaskFilter) {
+	tm.tasksLock.Lock()
+	// 只显示正在运行或等待重启的任务
+	rows := make([]taskRow, 0)
+	for _, task := range tm.tasks {
+		if task.alive() {
+			rows = append(rows, taskRowOf(task))
+		}
+	}
+	tm.tasksLock.Unlock()
+
+	if all {
+		for _, record := range tm.history.List() {
+			rows = append(rows, recordRow(record))
+		}
 	}
+	rows = filter.apply(rows)
 
-	go func() {
-		defer outputReader.Close()
-		buf := make([]byte, 1024)
-		for {
-			n, err := outputReader.Read(buf)
-			if err != nil {
-				return
+	if len(rows) == 0 {
+		if all {
+			fmt.Fprintln(rw, "No background tasks")
+		} else {
+			fmt.Fprintln(rw, "No running background tasks")
+		}
+		return
+	}
+
+	if all {
+		fmt.Fprintf(rw, "ID\tSTATUS\tHEALTH\tSTART\tDURATION\tEXIT\tRESTARTS\tUSER\tLABELS\tUSAGE\tCOMMAND\n")
+		for _, row := range rows {
+			duration := row.duration.Round(time.Millisecond)
+			if row.exit == "-" {
+				duration = row.duration.Round(time.Second)
 			}
-			task.outputLock.Lock()
-			task.outputBuffer.Write(buf[:n])
-			task.outputLock.Unlock()
+			fmt.Fprintf(rw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+				row.id,
+				row.status,
+				row.health,
+				row.start.Format("2006-01-02 15:04:05"),
+				duration,
+				row.exit,
+				row.restarts,
+				ownerName(row.owner),
+				formatLabels(row.labels),
+				row.usage,
+				row.command)
 		}
-	}()
+		return
+	}
 
-	tm.tasks[tm.taskID] = task
+	fmt.Fprintf(rw, "ID\tSTATUS\tHEALTH\tSTART\tRESTARTS\tLAST EXIT\tUSER\tLABELS\tUSAGE\tCOMMAND\n")
+	for _, row := range rows {
+		fmt.Fprintf(rw, "%d\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			row.id,
+			row.status,
+			row.health,
+			row.start.Format("2006-01-02 15:04:05"),
+			row.restarts,
+			row.lastExit,
+			ownerName(row.owner),
+			formatLabels(row.labels),
+			row.usage,
+			row.command)
+	}
+}
 
-	err := tm.pool.Submit(func() {
-		tm.runTask(task, inputReader, outputWriter)
-	})
+// ShowTask 显示任务详情，任务可以是运行中的或历史中的
+func (tm *TaskManager) ShowTask(rw io.ReadWriter, user command.Session, taskIDStr string) error {
+	id, err := strconv.Atoi(taskIDStr)
 	if err != nil {
-		task.Status = TaskStatusStopped
-		fmt.Fprintf(rw, "Failed to start task %d: %v\n", task.ID, err)
+		return fmt.Errorf("invalid task ID: %v", err)
+	}
+
+	// 在锁内生成输出，解锁后再写给客户端，避免慢的客户端阻塞其它会话
+	var buf bytes.Buffer
+	tm.tasksLock.Lock()
+	task, running := tm.tasks[id]
+	if running {
+		if err := authorize(user, task); err != nil {
+			tm.tasksLock.Unlock()
+			return err
+		}
+		fmt.Fprintf(&buf, "Task:       %d\n", task.ID)
+		fmt.Fprintf(&buf, "Command:    %s %s\n", task.Name, strings.Join(task.Args, " "))
+		fmt.Fprintf(&buf, "Status:     %s\n", task.Status)
+		fmt.Fprintf(&buf, "Start Time: %s\n", task.StartTime.Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(&buf, "Duration:   %s\n", time.Since(task.StartTime).Round(time.Second))
+		fmt.Fprintf(&buf, "Priority:   %d\n", task.priority)
+		showOwner(&buf, task.opts.Owner, task.opts.Session, task.opts.Labels)
+		switch {
+		case task.sharedInput:
+			fmt.Fprintf(&buf, "Sessions:   %d attached, input shared\n", task.attached)
+		case task.inputHolder != 0:
+			fmt.Fprintf(&buf, "Sessions:   %d attached, input held by session %d\n", task.attached, task.inputHolder)
+		default:
+			fmt.Fprintf(&buf, "Sessions:   %d attached\n", task.attached)
+		}
+		if task.opts.Restart != "" && task.opts.Restart != RestartNever {
+			fmt.Fprintf(&buf, "Restart:    %s (max retries %d)\n", task.opts.Restart, task.opts.MaxRetries)
+			fmt.Fprintf(&buf, "Restarts:   %d\n", task.restarts)
+		}
+		if task.lastExit != "" {
+			fmt.Fprintf(&buf, "Last Exit:  %s\n", task.lastExit)
+		}
+		if !task.opts.Limits.IsZero() {
+			fmt.Fprintf(&buf, "Limits:     %s\n", task.opts.Limits)
+		}
+		if task.detached != nil {
+			task.procLock.Lock()
+			fmt.Fprintf(&buf, "Detached:   %s\n", task.detached.info())
+			task.procLock.Unlock()
+		}
+		showHealth(&buf, task)
+		showUsage(&buf, task.resourceUsage())
+		showTriggers(&buf, tm.triggers.hitsFor(task))
+	}
+	tm.tasksLock.Unlock()
+	if running {
+		_, err := rw.Write(buf.Bytes())
+		return err
+	}
+
+	record, exists := tm.history.Get(id)
+	if !exists {
+		return fmt.Errorf("task %d not found", id)
+	}
+	if err := authorizeRecord(user, record); err != nil {
+		return err
+	}
+	fmt.Fprintf(rw, "Task:       %d\n", record.ID)
+	fmt.Fprintf(rw, "Command:    %s %s\n", record.Name, strings.Join(record.Args, " "))
+	fmt.Fprintf(rw, "Status:     %s\n", record.Status)
+	fmt.Fprintf(rw, "Start Time: %s\n", record.StartTime.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(rw, "End Time:   %s\n", record.EndTime.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(rw, "Duration:   %s\n", record.Duration.Round(time.Millisecond))
+	fmt.Fprintf(rw, "Exit Code:  %d\n", record.ExitCode)
+	showOwner(rw, record.Owner, record.Session, record.Labels)
+	if record.Restarts > 0 {
+		fmt.Fprintf(rw, "Restarts:   %d\n", record.Restarts)
+	}
+	if record.Error != "" {
+		fmt.Fprintf(rw, "Error:      %s\n", record.Error)
+	}
+	if record.Limits != "" {
+		fmt.Fprintf(rw, "Limits:     %s\n", record.Limits)
+	}
+	if record.Usage != nil {
+		showUsage(rw, *record.Usage)
+	}
+	showTriggers(rw, record.Triggers)
+	fmt.Fprintf(rw, "Result:     %d bytes\n", len(record.Result))
+	if len(record.Result) > 0 {
+		fmt.Fprintf(rw, "%s\n", strings.TrimRight(string(record.Result), "\n"))
+	}
+	return nil
+}
+
+// showOwner 显示任务的所有者、启动会话和标签
+func showOwner(rw io.ReadWriter, owner, session string, labels map[string]string) {
+	if session != "" {
+		fmt.Fprintf(rw, "User:       %s (session %s)\n", ownerName(owner), session)
+	} else {
+		fmt.Fprintf(rw, "User:       %s\n", ownerName(owner))
+	}
+	if len(labels) > 0 {
+		fmt.Fprintf(rw, "Labels:     %s\n", formatLabels(labels))
+	}
+}
+
+// showUsage 显示资源使用情况和触发过的限制
+func showUsage(rw io.ReadWriter, usage ResourceUsage) {
+	if usage == (ResourceUsage{}) {
 		return
 	}
-	fmt.Fprintf(rw, "Started task %d: %s %v\n", task.ID, task.Name, task.Args)
+	fmt.Fprintf(rw, "CPU Time:   %s\n", usage.CPUTime.Round(time.Millisecond))
+	switch {
+	case usage.Memory > 0:
+		fmt.Fprintf(rw, "Memory:     %s (peak %s)\n", formatBytes(usage.Memory), formatBytes(usage.MaxMemory))
+	case usage.MaxMemory > 0:
+		fmt.Fprintf(rw, "Memory:     peak %s\n", formatBytes(usage.MaxMemory))
+	}
+	if hits := usage.hits(); len(hits) > 0 {
+		fmt.Fprintf(rw, "Limit Hits: %s\n", strings.Join(hits, ", "))
+	}
 }
 
-// ListTasks 修改状态显示
-func (tm *TaskManager) ListTasks(rw io.ReadWriter) {
-	tm.tasksLock.Lock()
-	defer tm.tasksLock.Unlock()
+// TaskOutput 输出任务已捕获的标准输出和标准错误
+func (tm *TaskManager) TaskOutput(rw io.ReadWriter, user command.Session, taskIDStr string) error {
+	id, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid task ID: %v", err)
+	}
 
-	// 只显示正在运行的任务
-	runningTasks := make([]*Task, 0)
-	for _, task := range tm.tasks {
-		if task.Status == TaskStatusRunning {
-			runningTasks = append(runningTasks, task)
+	var output, errOutput string
+	tm.tasksLock.Lock()
+	task, running := tm.tasks[id]
+	tm.tasksLock.Unlock()
+	if running {
+		if err := authorize(user, task); err != nil {
+			return err
+		}
+		output, errOutput = task.snapshot()
+	} else {
+		record, exists := tm.history.Get(id)
+		if !exists {
+			return fmt.Errorf("task %d not found", id)
+		}
+		if err := authorizeRecord(user, record); err != nil {
+			return err
 		}
+		output, errOutput = recordOutput(record, false), recordOutput(record, true)
 	}
 
-	if len(runningTasks) == 0 {
-		fmt.Fprintln(rw, "No running background tasks")
-		return
+	fmt.Fprint(rw, output)
+	fmt.Fprint(command.Stderr(rw), errOutput)
+	return nil
+}
+
+// TailTask 输出任务日志的最后 lines 行，follow 为 true 时持续输出新内容，直到任务结束或用户按下回车
+func (tm *TaskManager) TailTask(rw io.ReadWriter, user command.Session, taskIDStr string, lines int, follow, stderr bool) error {
+	id, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid task ID: %v", err)
 	}
 
-	// 简化输出格式
-	for _, task := range runningTasks {
-		fmt.Fprintf(rw, "%d\t%s\t%s\t%s\n",
-			task.ID,
-			task.StartTime.Format("2006-01-02 15:04:05"),
-			task.Name,
-			strings.Join(task.Args, " "))
+	tm.tasksLock.Lock()
+	task, running := tm.tasks[id]
+	tm.tasksLock.Unlock()
+
+	var writer io.Writer = rw
+	if stderr {
+		writer = command.Stderr(rw)
+	}
+	// 伪终端任务的输出中带有控制帧，tail 只输出普通内容
+	var parser protocol.Parser
+	write := func(data string) {
+		plain, _ := parser.Feed([]byte(data))
+		writer.Write(plain)
+	}
+
+	var output *taskOutput
+	var content, path string
+	var offset int64
+	if running {
+		if err := authorize(user, task); err != nil {
+			return err
+		}
+		output = task.output
+		if stderr {
+			output = task.errOutput
+		}
+		content, offset = output.ReadFrom(0)
+		path = output.path
+	} else {
+		record, exists := tm.history.Get(id)
+		if !exists {
+			return fmt.Errorf("task %d not found", id)
+		}
+		if err := authorizeRecord(user, record); err != nil {
+			return err
+		}
+		content, path = record.Output, record.LogFile
+		if stderr {
+			content, path = record.ErrOutput, record.ErrLogFile
+		}
+	}
+	// 内存中的内容不足时从日志文件读取
+	if countLines([]byte(content)) < lines && path != "" {
+		if data, err := tailLog(path, lines); err == nil {
+			content = data
+		}
+	}
+	write(string(lastLines([]byte(content), lines)))
+
+	if !follow || !running {
+		return nil
 	}
+
+	stop := make(chan struct{})
+	followed := make(chan struct{})
+	go func() {
+		defer close(followed)
+		output.follow(offset, write, stop)
+	}()
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		select {
+		case <-task.Done:
+			<-followed
+			fmt.Fprintf(rw, "\nTask %d finished, press Enter to return\n", id)
+		case <-stop:
+		}
+	}()
+
+	// 任意输入结束跟踪
+	buf := make([]byte, 1024)
+	rw.Read(buf)
+	close(stop)
+	<-followed
+	<-notified
+	return nil
 }
 
-// InteractTask 优化交互体验
-func (tm *TaskManager) InteractTask(rw io.ReadWriter, taskIDStr string) error {
+// InteractTask 以读写方式附加到任务，新输出实时推送
+// 所有输入(包括 exit)都转发给任务，按下断开按键序列时结束交互，任务结束时立即返回
+func (tm *TaskManager) InteractTask(rw io.ReadWriter, user command.Session, taskIDStr string, steal bool, detachKeys string) error {
 	id, err := strconv.Atoi(taskIDStr)
 	if err != nil {
 		return fmt.Errorf("invalid task ID: %v", err)
 	}
+	keys, err := protocol.ParseDetachKeys(detachKeys)
+	if err != nil {
+		return err
+	}
 
 	tm.tasksLock.Lock()
 	task, exists := tm.tasks[id]
-	if !exists || task.Status != TaskStatusRunning {
+	if !exists || !task.alive() {
 		tm.tasksLock.Unlock()
 		return fmt.Errorf("task %d not found or not running", id)
 	}
+	if err := authorize(user, task); err != nil {
+		tm.tasksLock.Unlock()
+		return err
+	}
 	tm.tasksLock.Unlock()
 
-	fmt.Fprintf(rw, "Interacting with task %d\n", id)
+	session, err := tm.attach(task, true, steal)
+	if err != nil {
+		return err
+	}
+	defer tm.detach(task, session)
 
-	task.outputLock.Lock()
-	history := task.outputBuffer.String()
-	task.outputLock.Unlock()
-	fmt.Fprint(rw, history)
+	fmt.Fprintf(rw, "Interacting with task %d, press %s to detach\n", id, detachKeys)
 
+	// 远程客户端在本地识别断开按键并发送断开帧，本地终端则由服务端在输入中查找按键序列
+	frames := command.SupportsFrames(rw)
+	var matcher *protocol.DetachMatcher
+	if frames {
+		protocol.WriteFrame(rw, protocol.FrameInteract, "on;"+detachKeys)
+	} else {
+		matcher = protocol.NewDetachMatcher(keys)
+	}
+
+	// 伪终端任务会在输出中发出原始模式控制帧，据此切换输入的转发方式
+	var rawMode atomic.Bool
+	var outputLock sync.Mutex
+	var outputParser protocol.Parser
+	forward := func(data string) {
+		outputLock.Lock()
+		defer outputLock.Unlock()
+		outputParser.FeedFunc([]byte(data), func(plain []byte) {
+			rw.Write(plain)
+		}, func(frame protocol.Frame) {
+			if frame.Kind == protocol.FrameRawMode {
+				rawMode.Store(frame.Payload == "on")
+			}
+			protocol.WriteFrame(rw, frame.Kind, frame.Payload)
+		})
+	}
+	stderr := command.Stderr(rw)
+
+	// 订阅任务输出，任务结束时输出被关闭
 	quit := make(chan struct{})
-	done := make(chan struct{})
-	outputDone := make(chan struct{}) // 新增通道用于同步输出完成
+	var outputDone sync.WaitGroup
+	outputDone.Add(2)
+	go func() {
+		defer outputDone.Done()
+		task.output.follow(0, forward, quit)
+	}()
+	go func() {
+		defer outputDone.Done()
+		task.errOutput.follow(0, func(data string) { fmt.Fprint(stderr, data) }, quit)
+	}()
+	stop := sync.OnceFunc(func() {
+		close(quit)
+		outputDone.Wait()
+	})
 
-	// 监听任务输出
+	// 通知客户端结束交互，收到客户端的确认帧后返回，之后的输入都被丢弃
+	var ending atomic.Bool
+	end := sync.OnceFunc(func() {
+		ending.Store(true)
+		protocol.WriteFrame(rw, protocol.FrameInteract, "off")
+	})
+
+	// 任务结束时输出完剩余内容后提示，远程客户端无需等待用户输入即可返回
+	completed := make(chan struct{})
 	go func() {
-		defer close(outputDone) // 确保在函数结束时通知输出已完成
-		ticker := time.NewTicker(100 * time.Millisecond)
-		defer ticker.Stop()
-		prevLen := len(history)
-		for {
-			select {
-			case <-ticker.C:
-				task.outputLock.Lock()
-				current := task.outputBuffer.String()
-				task.outputLock.Unlock()
-				if len(current) > prevLen {
-					fmt.Fprint(rw, current[prevLen:])
-					prevLen = len(current)
-				}
-			case <-done:
-				// 在任务完成时，确保输出最后的内容
-				task.outputLock.Lock()
-				current := task.outputBuffer.String()
-				task.outputLock.Unlock()
-				if len(current) > prevLen {
-					fmt.Fprint(rw, current[prevLen:])
-				}
-				return
-			case <-quit:
-				return
+		defer close(completed)
+		select {
+		case <-task.Done:
+			outputDone.Wait()
+			fmt.Fprintln(rw, "\nTask completed")
+			if frames {
+				end()
 			}
+		case <-quit:
 		}
 	}()
 
+	// 输入锁被其它会话抢占后只提示一次
+	lockNotified := false
+	send := func(data []byte) error {
+		err := tm.writeInput(task, session, data)
+		if err == errInputLocked {
+			if !lockNotified {
+				fmt.Fprintf(stderr, "[input lock taken by another session, input is ignored]\n")
+				lockNotified = true
+			}
+			return nil
+		}
+		return err
+	}
+
+	// 原始模式下按键原样转发给伪终端，否则按行转发
+	var line []byte
+	var inputErr error
+	input := func(data []byte) {
+		if inputErr != nil {
+			return
+		}
+		if rawMode.Load() {
+			inputErr = send(data)
+			return
+		}
+		line = append(line, data...)
+		for inputErr == nil {
+			idx := bytes.IndexByte(line, '\n')
+			if idx < 0 {
+				break
+			}
+			text := strings.TrimRight(string(line[:idx]), "\r")
+			line = line[idx+1:]
+			inputErr = send([]byte(text + "\n"))
+		}
+	}
+
 	// 处理用户输入
-	scanner := bufio.NewScanner(rw)
+	var inputParser protocol.Parser
+	buf := make([]byte, 1024)
 	for {
-		select {
-		case <-task.Done:
-			close(done)  // 通知输出 goroutine 任务已完成
-			<-outputDone // 等待所有输出完成
-			fmt.Fprintln(rw, "\nTask completed")
+		if !frames {
+			select {
+			case <-task.Done:
+				stop()
+				<-completed
+				return nil
+			default:
+			}
+		}
+
+		n, err := rw.Read(buf)
+		if err != nil {
+			stop()
 			return nil
-		default:
 		}
 
-		if !scanner.Scan() {
-			break
+		data := buf[:n]
+		detached, acked := false, false
+		if matcher != nil {
+			data, detached = matcher.Scan(data)
 		}
-		input := scanner.Text()
-		if input == "exit" {
-			close(quit)
-			<-outputDone // 等待输出完成
+		inputParser.FeedFunc(data, func(plain []byte) {
+			if !ending.Load() && !detached {
+				input(plain)
+			}
+		}, func(frame protocol.Frame) {
+			switch frame.Kind {
+			case protocol.FrameDetach:
+				detached = true
+			case protocol.FrameInteract:
+				acked = ending.Load() && frame.Payload == "off"
+			case protocol.FrameRawMode, protocol.FrameWinsize:
+				// 窗口大小和客户端退出原始模式的确认帧交还给伪终端任务
+				if !ending.Load() && !detached {
+					send(protocol.Encode(frame.Kind, frame.Payload))
+				}
+			}
+		})
+
+		if acked {
+			stop()
 			return nil
 		}
+		if !frames {
+			if detached {
+				stop()
+				if rawMode.Load() {
+					leaveRawMode(rw)
+				}
+				return nil
+			}
+			if inputErr != nil {
+				stop()
+				if inputErr == io.ErrClosedPipe {
+					return fmt.Errorf("task has finished")
+				}
+				return fmt.Errorf("error sending input: %v", inputErr)
+			}
+			continue
+		}
 
-		if _, err := fmt.Fprintln(task.InputWriter, input); err != nil {
-			if err == io.ErrClosedPipe {
-				return fmt.Errorf("task has finished")
+		// 远程客户端: 断开或任务已无法接收输入时通知客户端退出原始模式并结束交互
+		if !ending.Load() && (detached || inputErr != nil) {
+			if inputErr != nil && inputErr != io.ErrClosedPipe {
+				fmt.Fprintf(stderr, "Error sending input: %v\n", inputErr)
 			}
-			return fmt.Errorf("error sending input: %v", err)
+			if rawMode.Load() {
+				protocol.WriteFrame(rw, protocol.FrameRawMode, "off")
+			}
+			end()
 		}
 	}
-	return nil
 }
 
-func (tm *TaskManager) KillTask(rw io.ReadWriter, taskIDStr string) error {
+// leaveRawMode 通知客户端退出原始模式，并消费掉客户端的确认帧
+func leaveRawMode(rw io.ReadWriter) {
+	protocol.WriteFrame(rw, protocol.FrameRawMode, "off")
+	reader := protocol.NewReader(rw, func(frame protocol.Frame) bool {
+		return frame.Kind != protocol.FrameRawMode
+	})
+	io.Copy(io.Discard, reader)
+	fmt.Fprintln(rw)
+}
+
+// KillTask 终止任务，user 只能终止自己启动的任务，管理员可以终止所有任务
+func (tm *TaskManager) KillTask(rw io.ReadWriter, user command.Session, taskIDStr string) error {
 	id, err := strconv.Atoi(taskIDStr)
 	if err != nil {
 		return fmt.Errorf("invalid task ID: %v", err)
 	}
 
 	tm.tasksLock.Lock()
-	defer tm.tasksLock.Unlock()
-
 	task, exists := tm.tasks[id]
 	if !exists {
+		tm.tasksLock.Unlock()
 		return fmt.Errorf("task %d not found", id)
 	}
 
-	if task.Status != TaskStatusRunning {
+	if !task.alive() {
+		tm.tasksLock.Unlock()
 		return fmt.Errorf("task %d is not running", id)
 	}
-
+	if err := authorize(user, task); err != nil {
+		tm.tasksLock.Unlock()
+		return err
+	}
+	queued := task.Status == TaskStatusQueued
+	if queued {
+		heap.Remove(&tm.queue, task.queueIndex)
+	}
+	paused := task.Status == TaskStatusPaused
 	task.Status = TaskStatusStopped
-	task.InputWriter.Close()
-	close(task.Done)
-	delete(tm.tasks, id)
+	input := task.InputWriter
+	tm.tasksLock.Unlock()
+
+	// 取消任务的 context，进程型命令会向其进程组发送 SIGTERM，等待重启的任务不再重启
+	// 暂停的进程收到 SIGCONT 后才会处理 SIGTERM
+	task.cancel()
+	if paused {
+		task.signalProcesses(continueProcessGroup)
+	}
+	input.Close()
+	if queued {
+		tm.abortQueued(task)
+	}
+
+	select {
+	case <-task.Done:
+	case <-time.After(killGracePeriod):
+		// 宽限期内仍未退出，强制结束所有子进程组
+		task.killProcesses()
+		select {
+		case <-task.Done:
+		case <-time.After(killGracePeriod):
+			fmt.Fprintf(rw, "Killed task %d (%s), but its handler has not returned yet; worker is still busy\n", id, task.Name)
+			return nil
+		}
+	}
 
-	fmt.Fprintf(rw, "Killed task %d (%s)\n", id, task.Name)
+	fmt.Fprintf(rw, "Killed task %d (%s), worker released\n", id, task.Name)
 	return nil
 }
 
-func (tm *TaskManager) runTask(task *Task, input io.Reader, output io.Writer) {
+func (tm *TaskManager) runTask(task *Task, input io.Reader, output, errOutput io.Writer) {
+	var result []byte
+	var taskErr error
+	task.procLock.Lock()
+	task.timedOut = false
+	task.procLock.Unlock()
+	stopTimeout := task.startTimeout()
 	defer func() {
-		task.InputWriter.Close()
+		if r := recover(); r != nil {
+			taskErr = fmt.Errorf("command %s panicked: %v", task.Name, r)
+		}
+		stopTimeout()
+		if closer, ok := input.(io.Closer); ok {
+			closer.Close()
+		}
 		if closer, ok := output.(io.Closer); ok {
 			closer.Close()
 		}
-		task.Status = TaskStatusFinished
-		close(task.Done)
-		tm.removeTask(task.ID)
+		if closer, ok := errOutput.(io.Closer); ok {
+			closer.Close()
+		}
+		task.captured.Wait()
+		tm.finishTask(task, result, taskErr)
 	}()
 
-	fn, exists := tm.funcMap[task.Name]
-	if !exists {
-		fmt.Fprintf(output, "Function %s not found\n", task.Name)
+	// 每次运行时从命令注册表查找，插件重新加载后的处理函数在下一次运行生效
+	handler, err := tm.lookup(task.Name)
+	if err != nil {
+		fmt.Fprintf(errOutput, "%v\n", err)
+		taskErr = err
 		return
 	}
 
 	// 创建一个包装了 input 和 output 的 taskIO
 	rw := &taskIO{
-		reader: input,
-		writer: output,
+		reader:    input,
+		writer:    protocol.NewEscapeWriter(output),
+		errWriter: errOutput,
 	}
 
-	// 调用注册的函数
-	reflect.ValueOf(fn).Call([]reflect.Value{
-		reflect.ValueOf(rw),
-		reflect.ValueOf(context.Background()),
-		reflect.ValueOf(task.Args),
-	})
+	// 调用注册的函数，传入可取消并能跟踪子进程的 context
+	ctx := command.WithProcessObserver(task.ctx, task)
+	result, taskErr = handler(rw, ctx, task.Args)
 }
 
-func (tm *TaskManager) removeTask(id int) {
+// lookup 从命令注册表查找可以后台运行的命令
+func (tm *TaskManager) lookup(name string) (command.Handler, error) {
+	if tm.registry == nil {
+		return nil, fmt.Errorf("command %s not found", name)
+	}
+	cmd, exists := tm.registry.Get(name)
+	if !exists {
+		return nil, fmt.Errorf("command %s not found", name)
+	}
+	if err := cmd.CheckBackground(true); err != nil {
+		return nil, err
+	}
+	if cmd.Handler == nil {
+		return nil, fmt.Errorf("command %s has no handler", name)
+	}
+	return cmd.Handler, nil
+}
+
+// finishTask 记录任务一次运行的结果，按重启策略安排重启或结束任务
+func (tm *TaskManager) finishTask(task *Task, result []byte, err error) {
+	exitCode := task.exitStatus(err)
+
 	tm.tasksLock.Lock()
-	defer tm.tasksLock.Unlock()
-	delete(tm.tasks, id)
+	var status TaskStatus
+	switch {
+	case task.ctx.Err() != nil:
+		status = TaskStatusStopped
+	case err != nil || exitCode != 0:
+		status = TaskStatusFailed
+	default:
+		status = TaskStatusFinished
+	}
+	task.lastExit = exitReason(status, exitCode, err)
+	if task.hasTimedOut() && status != TaskStatusStopped {
+		status = TaskStatusFailed
+		task.lastExit = fmt.Sprintf("timed out after %s", task.opts.Limits.Timeout)
+	}
+	task.lastCode = exitCode
+	task.lastErr = err
+	task.lastResult = result
+
+	var restart bool
+	var delay time.Duration
+	if task.forcedRestart != "" && status != TaskStatusStopped {
+		restart = true
+		task.lastExit = task.forcedRestart
+	} else {
+		restart, delay, status = task.nextRestart(status, time.Since(task.attemptStart))
+	}
+	task.forcedRestart = ""
+	if restart && tm.accepting() != nil {
+		// 排空或重启管理器时任务结束后不再重启
+		restart = false
+	}
+	if restart {
+		task.Status = TaskStatusRestarting
+		task.restarts++
+		fmt.Fprintf(task.errOutput, "[task %d exited (%s), restarting in %s]\n", task.ID, task.lastExit, delay)
+		e := taskEvent(task, EventRestarted)
+		e.Status, e.ExitCode, e.Reason, e.Attempt = task.Status, exitCode, task.lastExit, task.restarts
+		tm.events.Publish(e)
+		tm.tasksLock.Unlock()
+		go tm.restartAfter(task, delay, status)
+		return
+	}
+	if status == TaskStatusCrashLoop {
+		fmt.Fprintf(task.errOutput, "[task %d exited within %s %d times in a row, giving up]\n", task.ID, stableRunTime, crashLoopLimit)
+	}
+	tm.tasksLock.Unlock()
+
+	tm.closeTask(task, status)
+}
+
+// closeTask 结束任务: 关闭输出日志，写入历史并从运行列表中移除
+func (tm *TaskManager) closeTask(task *Task, status TaskStatus) {
+	tm.tasksLock.Lock()
+	task.Status = status
+	record := &TaskRecord{
+		ID:        task.ID,
+		Name:      task.Name,
+		Args:      task.Args,
+		Status:    status,
+		StartTime: task.StartTime,
+		EndTime:   time.Now(),
+		Result:    task.lastResult,
+		ExitCode:  task.lastCode,
+		Restarts:  task.restarts,
+		Owner:     task.opts.Owner,
+		Session:   task.opts.Session,
+		Labels:    task.opts.Labels,
+	}
+	if task.lastErr != nil {
+		record.Error = task.lastErr.Error()
+	}
+	if !task.opts.Limits.IsZero() {
+		record.Limits = task.opts.Limits.String()
+	}
+	tm.tasksLock.Unlock()
+	task.cancel()
+	task.output.Close()
+	task.errOutput.Close()
+
+	if usage := task.resourceUsage(); usage != (ResourceUsage{}) {
+		usage.Memory = 0
+		record.Usage = &usage
+	}
+	task.removeCgroup()
+	if task.detached != nil {
+		os.RemoveAll(task.detached.dir)
+	}
+
+	output, errOutput := task.snapshot()
+	record.Duration = record.EndTime.Sub(record.StartTime)
+	record.LogFile, record.ErrLogFile = task.output.path, task.errOutput.path
+	if record.LogFile == "" {
+		record.Output = tail(output, maxSavedOutput)
+	}
+	if record.ErrLogFile == "" {
+		record.ErrOutput = tail(errOutput, maxSavedOutput)
+	}
+	record.Triggers = tm.triggers.finish(task.ID)
+
+	tm.history.Add(record)
+	task.record = record
+	tm.removeTask(task.ID)
+	close(task.Done)
+	tm.publishEnd(task, record)
 }
-func (tm *TaskManager) RegisterFunction(name string, fn interface{}) {
-	v := reflect.ValueOf(fn)
-	if v.Kind() != reflect.Func {
-		panic("not a function")
+
+// publishEnd 发布任务结束的事件
+func (tm *TaskManager) publishEnd(task *Task, record *TaskRecord) {
+	var e Event
+	switch record.Status {
+	case TaskStatusFinished:
+		e = taskEvent(task, EventFinished)
+	case TaskStatusStopped:
+		e = taskEvent(task, EventKilled)
+	default:
+		e = taskEvent(task, EventFailed)
 	}
+	e.Status, e.ExitCode = record.Status, record.ExitCode
+	tm.tasksLock.Lock()
+	e.Reason = task.lastExit
+	tm.tasksLock.Unlock()
+	if e.Reason == "" {
+		e.Reason = strings.ToLower(string(record.Status))
+	}
+	if record.Status == TaskStatusCrashLoop {
+		e.Reason = fmt.Sprintf("crash loop after %d restarts, last %s", record.Restarts, e.Reason)
+	}
+	tm.events.Publish(e)
+}
 
-	t := v.Type()
-	// 修改参数检查逻辑
-	if t.NumIn() != 3 ||
-		// 检查第一个参数是否为 *ReadWriter 或实现了 io.Reader 和 io.Writer 接口的类型
-		!(t.In(0).Implements(reflect.TypeOf((*io.Reader)(nil)).Elem()) &&
-			t.In(0).Implements(reflect.TypeOf((*io.Writer)(nil)).Elem())) ||
-		// 检查第二个参数是否为 context.Context
-		!t.In(1).Implements(reflect.TypeOf((*context.Context)(nil)).Elem()) ||
-		// 检查第三个参数是否为 []string
-		t.In(2) != reflect.TypeOf([]string{}) {
-		panic("function signature must be func(*ReadWriter, context.Context, []string)")
+// capture 将任务输出持续写入内存缓冲和日志文件
+func (task *Task) capture(reader *io.PipeReader, output *taskOutput) {
+	defer task.captured.Done()
+	defer reader.Close()
+	buf := make([]byte, 1024)
+	for {
+		n, err := reader.Read(buf)
+		if err != nil {
+			return
+		}
+		output.Write(buf[:n])
+	}
+}
+
+// ProcessStarted 实现 command.ProcessObserver，记录任务启动的子进程并应用资源限制
+func (task *Task) ProcessStarted(p *os.Process) {
+	task.procLock.Lock()
+	task.processes[p.Pid] = p
+	err := task.applyLimits(p)
+	if task.detached != nil && err == nil {
+		err = task.detached.started(p.Pid)
 	}
+	task.procLock.Unlock()
+	if err != nil {
+		fmt.Fprintf(task.errOutput, "[task %d: %v]\n", task.ID, err)
+	}
+}
 
-	tm.funcMap[name] = fn
+// ProcessExited 实现 command.ProcessObserver
+func (task *Task) ProcessExited(p *os.Process, state *os.ProcessState) {
+	if task.detached != nil {
+		task.detached.stopped()
+	}
+	task.procLock.Lock()
+	defer task.procLock.Unlock()
+	delete(task.processes, p.Pid)
+	task.exitCode = state.ExitCode()
+	task.exited = true
+	task.usage.CPUTime += state.UserTime() + state.SystemTime()
+	task.usage.MaxMemory = max(task.usage.MaxMemory, processMaxRSS(state))
+}
+
+// hasTimedOut 本次运行是否因超时被结束
+func (task *Task) hasTimedOut() bool {
+	task.procLock.Lock()
+	defer task.procLock.Unlock()
+	return task.timedOut
+}
+
+// removeCgroup 任务结束后删除其 cgroup，仍有残留进程时保留
+func (task *Task) removeCgroup() {
+	task.procLock.Lock()
+	defer task.procLock.Unlock()
+	if task.cgroup != nil && task.cgroup.remove() == nil {
+		task.cgroup = nil
+	}
+}
+
+// exitStatus 返回任务的退出码: 优先使用子进程的退出码，否则根据处理函数是否返回错误
+func (task *Task) exitStatus(err error) int {
+	task.procLock.Lock()
+	defer task.procLock.Unlock()
+	if task.exited {
+		return task.exitCode
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// killProcesses 强制结束任务启动的所有子进程组
+func (task *Task) killProcesses() {
+	task.procLock.Lock()
+	defer task.procLock.Unlock()
+	for _, p := range task.processes {
+		killProcessGroup(p)
+	}
+}
+
+// snapshot 返回内存中保留的标准输出和标准错误内容
+func (task *Task) snapshot() (string, string) {
+	return task.output.String(), task.errOutput.String()
+}
+
+func (tm *TaskManager) removeTask(id int) {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	delete(tm.tasks, id)
 }
@@ -0,0 +1,391 @@
+package backgroundcommands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// TriggerAction 输出匹配规则时执行的动作
+type TriggerAction string
+
+const (
+	TriggerNotify  TriggerAction = "notify"  // 发布 triggered 事件
+	TriggerKill    TriggerAction = "kill"    // 终止任务
+	TriggerRestart TriggerAction = "restart" // 结束本次运行并立即重启，不受重启策略限制
+	TriggerRun     TriggerAction = "run"     // 启动另一个后台命令
+)
+
+// defaultTriggerCooldown 同一规则对同一任务两次执行动作的最短间隔
+const defaultTriggerCooldown = 10 * time.Second
+
+// triggerCount 规则对一个任务的命中情况
+type triggerCount struct {
+	hits  int
+	fired int
+	last  time.Time // 上次执行动作的时间
+}
+
+// Trigger 任务输出的触发规则，每一行输出匹配正则时执行动作，冷却期内的命中只计数
+type Trigger struct {
+	ID       int
+	Target   string // 任务 ID，或匹配命令名、完整命令行的通配符
+	TaskID   int    // Target 为任务 ID 时的值，规则随该任务结束而删除
+	Pattern  *regexp.Regexp
+	Action   TriggerAction
+	Command  []string // run 动作启动的命令和参数
+	Stream   string   // 只匹配 stdout 或 stderr，为空时两者都匹配
+	Cooldown time.Duration
+	Owner    string
+	Admin    bool // 管理员按名称添加的规则作用于所有用户的任务，否则只作用于 Owner 的任务
+
+	counts  map[int]*triggerCount
+	hits    int
+	fired   int
+	lastErr string
+}
+
+// TriggerHits 任务结束时记录的规则命中次数
+type TriggerHits struct {
+	ID    int    `json:"id"`
+	Rule  string `json:"rule"`
+	Hits  int    `json:"hits"`
+	Fired int    `json:"fired"`
+}
+
+// rule 单行描述规则的匹配条件和动作
+func (t *Trigger) rule() string {
+	action := string(t.Action)
+	if t.Action == TriggerRun {
+		action += ":" + strings.Join(t.Command, " ")
+	}
+	return fmt.Sprintf("/%s/ -> %s", t.Pattern, action)
+}
+
+// applies 规则是否作用于任务，由规则启动的任务不再触发同一规则
+func (t *Trigger) applies(task *Task) bool {
+	if task.opts.Labels["trigger"] == strconv.Itoa(t.ID) {
+		return false
+	}
+	if t.TaskID != 0 {
+		return task.ID == t.TaskID
+	}
+	if !t.Admin && task.opts.Owner != t.Owner {
+		return false
+	}
+	byName, _ := path.Match(t.Target, task.Name)
+	byCommand, _ := path.Match(t.Target, strings.TrimSpace(task.Name+" "+strings.Join(task.Args, " ")))
+	return byName || byCommand
+}
+
+// ParseTrigger 解析 trigger add 的参数: <task_id|name> --regex RE --action ACTION [--cooldown D] [--stream S]
+func ParseTrigger(args []string) (*Trigger, error) {
+	if len(args) < 1 || strings.HasPrefix(args[0], "--") {
+		return nil, fmt.Errorf("usage: trigger add <task_id|name> --regex <re> --action <notify|kill|restart|run:<cmd>>")
+	}
+	t := &Trigger{Target: args[0], Cooldown: defaultTriggerCooldown}
+	if id, err := strconv.Atoi(t.Target); err == nil {
+		t.TaskID = id
+	} else if _, err := path.Match(t.Target, ""); err != nil {
+		return nil, fmt.Errorf("invalid name pattern: %s", t.Target)
+	}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value for %s", args[i])
+		}
+		value := args[i+1]
+		switch args[i] {
+		case "--regex":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex: %v", err)
+			}
+			t.Pattern = re
+		case "--action":
+			name, cmdline, _ := strings.Cut(value, ":")
+			switch action := TriggerAction(name); action {
+			case TriggerNotify, TriggerKill, TriggerRestart:
+				if cmdline != "" {
+					return nil, fmt.Errorf("action %s takes no command", action)
+				}
+				t.Action = action
+			case TriggerRun:
+				parts, err := command.SplitArgs(cmdline)
+				if err != nil {
+					return nil, fmt.Errorf("invalid run command: %v", err)
+				}
+				if len(parts) == 0 {
+					return nil, fmt.Errorf("usage: --action run:<cmd> [args...]")
+				}
+				t.Action, t.Command = action, parts
+			default:
+				return nil, fmt.Errorf("invalid action: %s (notify, kill, restart, run:<cmd>)", value)
+			}
+		case "--cooldown":
+			cooldown, err := time.ParseDuration(value)
+			if err != nil || cooldown < 0 {
+				return nil, fmt.Errorf("invalid cooldown: %s", value)
+			}
+			t.Cooldown = cooldown
+		case "--stream":
+			if value != "stdout" && value != "stderr" {
+				return nil, fmt.Errorf("invalid stream: %s (stdout, stderr)", value)
+			}
+			t.Stream = value
+		default:
+			return nil, fmt.Errorf("unknown option: %s", args[i])
+		}
+	}
+	if t.Pattern == nil || t.Action == "" {
+		return nil, fmt.Errorf("both --regex and --action are required")
+	}
+	return t, nil
+}
+
+// TriggerManager 管理所有输出触发规则
+type TriggerManager struct {
+	mu       sync.Mutex
+	triggers map[int]*Trigger
+	nextID   int
+}
+
+// NewTriggerManager 创建规则管理器
+func NewTriggerManager() *TriggerManager {
+	return &TriggerManager{triggers: make(map[int]*Trigger)}
+}
+
+// Add 添加规则并返回其 ID
+func (m *TriggerManager) Add(t *Trigger) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	t.ID = m.nextID
+	t.counts = make(map[int]*triggerCount)
+	m.triggers[t.ID] = t
+	return t.ID
+}
+
+// Remove 删除规则，只有添加者和管理员可以删除
+func (m *TriggerManager) Remove(session command.Session, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.triggers[id]
+	if !ok {
+		return fmt.Errorf("trigger %d not found", id)
+	}
+	if !session.Admin && t.Owner != session.User {
+		return fmt.Errorf("permission denied: trigger %d belongs to %s", id, ownerName(t.Owner))
+	}
+	delete(m.triggers, id)
+	return nil
+}
+
+// List 列出规则，非管理员只能看到自己添加的规则
+func (m *TriggerManager) List(rw io.ReadWriter, session command.Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []int
+	for id, t := range m.triggers {
+		if session.Admin || t.Owner == session.User {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		fmt.Fprintln(rw, "No triggers")
+		return
+	}
+	sort.Ints(ids)
+	fmt.Fprintf(rw, "ID\tTARGET\tSTREAM\tCOOLDOWN\tHITS\tFIRED\tUSER\tRULE\tLAST ERROR\n")
+	for _, id := range ids {
+		t := m.triggers[id]
+		stream, lastErr := t.Stream, t.lastErr
+		if stream == "" {
+			stream = "both"
+		}
+		if lastErr == "" {
+			lastErr = "-"
+		}
+		fmt.Fprintf(rw, "%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			t.ID, t.Target, stream, t.Cooldown, t.hits, t.fired, ownerName(t.Owner), t.rule(), lastErr)
+	}
+}
+
+// match 检查任务的一行输出并计数，返回冷却期已过、需要执行动作的规则的副本
+func (m *TriggerManager) match(task *Task, stream, line string) []Trigger {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var fired []Trigger
+	now := time.Now()
+	for _, t := range m.triggers {
+		if (t.Stream != "" && t.Stream != stream) || !t.applies(task) || !t.Pattern.MatchString(line) {
+			continue
+		}
+		count, ok := t.counts[task.ID]
+		if !ok {
+			count = &triggerCount{}
+			t.counts[task.ID] = count
+		}
+		t.hits++
+		count.hits++
+		if !count.last.IsZero() && now.Sub(count.last) < t.Cooldown {
+			continue
+		}
+		count.last = now
+		count.fired++
+		t.fired++
+		fired = append(fired, *t)
+	}
+	return fired
+}
+
+// failed 记录规则执行动作失败的原因
+func (m *TriggerManager) failed(id int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.triggers[id]; ok {
+		t.lastErr = err.Error()
+	}
+}
+
+// hitsFor 返回作用于任务或命中过任务的规则，按 ID 排序
+func (m *TriggerManager) hitsFor(task *Task) []TriggerHits {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hits []TriggerHits
+	for _, t := range m.triggers {
+		count, ok := t.counts[task.ID]
+		if !ok && !t.applies(task) {
+			continue
+		}
+		h := TriggerHits{ID: t.ID, Rule: t.rule()}
+		if ok {
+			h.Hits, h.Fired = count.hits, count.fired
+		}
+		hits = append(hits, h)
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].ID < hits[j].ID })
+	return hits
+}
+
+// finish 任务结束时返回命中过任务的规则，清除其计数并删除只作用于该任务的规则
+func (m *TriggerManager) finish(taskID int) []TriggerHits {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hits []TriggerHits
+	for id, t := range m.triggers {
+		if count, ok := t.counts[taskID]; ok {
+			hits = append(hits, TriggerHits{ID: t.ID, Rule: t.rule(), Hits: count.hits, Fired: count.fired})
+			delete(t.counts, taskID)
+		}
+		if t.TaskID == taskID {
+			delete(m.triggers, id)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].ID < hits[j].ID })
+	return hits
+}
+
+// showTriggers 在 task show 中显示规则的命中次数
+func showTriggers(rw io.ReadWriter, hits []TriggerHits) {
+	for i, h := range hits {
+		label := "Triggers:  "
+		if i > 0 {
+			label = "           "
+		}
+		fmt.Fprintf(rw, "%s #%d %s: %d hits, %d fired\n", label, h.ID, h.Rule, h.Hits, h.Fired)
+	}
+}
+
+// fireTrigger 执行规则的动作，并发布 triggered 事件
+func (tm *TaskManager) fireTrigger(task *Task, t Trigger, stream, line string) {
+	e := taskEvent(task, EventTriggered)
+	e.Reason = fmt.Sprintf("matched trigger %d (%s)", t.ID, t.rule())
+	e.Stream, e.Line = stream, line
+	tm.events.Publish(e)
+
+	var err error
+	rw := &taskIO{reader: strings.NewReader(""), writer: io.Discard, errWriter: io.Discard}
+	switch t.Action {
+	case TriggerKill:
+		fmt.Fprintf(task.errOutput, "[trigger %d matched, killing task %d]\n", t.ID, task.ID)
+		err = tm.KillTask(rw, systemSession, strconv.Itoa(task.ID))
+	case TriggerRestart:
+		err = tm.restartTask(task, fmt.Sprintf("restarted by trigger %d", t.ID))
+	case TriggerRun:
+		opts := TaskOptions{
+			Restart: RestartNever,
+			Owner:   t.Owner,
+			Labels:  map[string]string{"trigger": strconv.Itoa(t.ID), "trigger-task": strconv.Itoa(task.ID)},
+		}
+		if tm.StartTask(rw, opts, t.Command[0], t.Command[1:]...) == 0 {
+			err = fmt.Errorf("failed to start %s", t.Command[0])
+		}
+	}
+	if err != nil {
+		tm.triggers.failed(t.ID, err)
+	}
+}
+
+// restartTask 向任务本次运行的子进程组发送 SIGTERM，运行结束后不论重启策略立即重启
+// 宽限期后仍未退出的进程组被强制结束
+func (tm *TaskManager) restartTask(task *Task, reason string) error {
+	tm.tasksLock.Lock()
+	if task.Status != TaskStatusRunning {
+		tm.tasksLock.Unlock()
+		return fmt.Errorf("task %d is not running", task.ID)
+	}
+	if task.detached != nil && task.detached.adopted() {
+		tm.tasksLock.Unlock()
+		return fmt.Errorf("task %d was adopted after a server restart and cannot be restarted", task.ID)
+	}
+	task.procLock.Lock()
+	processes := make(map[int]*os.Process, len(task.processes))
+	for pid, p := range task.processes {
+		processes[pid] = p
+	}
+	task.procLock.Unlock()
+	if len(processes) == 0 {
+		tm.tasksLock.Unlock()
+		return fmt.Errorf("task %d has no child process to restart", task.ID)
+	}
+	task.forcedRestart = reason
+	input := task.InputWriter
+	tm.tasksLock.Unlock()
+
+	// 每次运行有独立的输入管道，关闭本次运行的输入使等待输入的处理函数返回
+	fmt.Fprintf(task.errOutput, "[%s, stopping task %d]\n", reason, task.ID)
+	for _, p := range processes {
+		terminateProcessGroup(p)
+	}
+	input.Close()
+	time.AfterFunc(killGracePeriod, func() {
+		task.procLock.Lock()
+		defer task.procLock.Unlock()
+		for pid, p := range processes {
+			if task.processes[pid] == p {
+				killProcessGroup(p)
+			}
+		}
+	})
+	return nil
+}
+
+// authorizeTask 检查任务正在运行且会话可以操作它
+func (tm *TaskManager) authorizeTask(session command.Session, id int) error {
+	tm.tasksLock.Lock()
+	defer tm.tasksLock.Unlock()
+	task, exists := tm.tasks[id]
+	if !exists || !task.alive() {
+		return fmt.Errorf("task %d is not running", id)
+	}
+	return authorize(session, task)
+}
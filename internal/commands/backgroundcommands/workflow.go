@@ -0,0 +1,431 @@
+package backgroundcommands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// StepCondition 步骤在依赖结束后是否运行的条件
+type StepCondition string
+
+const (
+	WhenSuccess StepCondition = "success" // 所有依赖都成功(默认)
+	WhenFailure StepCondition = "failure" // 至少一个依赖失败
+	WhenAlways  StepCondition = "always"  // 依赖结束即运行
+)
+
+// StepStatus 工作流步骤的状态
+type StepStatus string
+
+const (
+	StepPending   StepStatus = "PENDING"
+	StepRunning   StepStatus = "RUNNING"
+	StepSucceeded StepStatus = "SUCCEEDED"
+	StepFailed    StepStatus = "FAILED"
+	StepSkipped   StepStatus = "SKIPPED"
+)
+
+// WorkflowStep 工作流定义中的一个步骤
+type WorkflowStep struct {
+	Name      string        `yaml:"name"`
+	Command   string        `yaml:"command"`
+	Args      []string      `yaml:"args"`
+	DependsOn []string      `yaml:"depends_on"`
+	When      StepCondition `yaml:"when"`
+	Timeout   string        `yaml:"timeout"` // 整个步骤(含重试)的超时，如 10m
+	Retries   int           `yaml:"retries"` // 失败后的重试次数
+
+	timeout time.Duration
+}
+
+// Workflow 工作流定义
+type Workflow struct {
+	Name  string          `yaml:"name"`
+	Steps []*WorkflowStep `yaml:"steps"`
+}
+
+// LoadWorkflow 读取并校验 YAML 工作流定义
+func LoadWorkflow(path string) (*Workflow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workflow: %v", err)
+	}
+	var wf Workflow
+	if err := yaml.Unmarshal(data, &wf); err != nil {
+		return nil, fmt.Errorf("failed to parse workflow %s: %v", path, err)
+	}
+	if wf.Name == "" {
+		wf.Name = path
+	}
+	if err := wf.validate(); err != nil {
+		return nil, err
+	}
+	return &wf, nil
+}
+
+// validate 检查步骤名唯一、依赖存在且没有环
+func (wf *Workflow) validate() error {
+	if len(wf.Steps) == 0 {
+		return fmt.Errorf("workflow %s has no steps", wf.Name)
+	}
+	steps := make(map[string]*WorkflowStep)
+	for _, step := range wf.Steps {
+		if step.Name == "" || step.Command == "" {
+			return fmt.Errorf("every step needs a name and a command")
+		}
+		if _, exists := steps[step.Name]; exists {
+			return fmt.Errorf("duplicate step name: %s", step.Name)
+		}
+		switch step.When {
+		case "":
+			step.When = WhenSuccess
+		case WhenSuccess, WhenFailure, WhenAlways:
+		default:
+			return fmt.Errorf("step %s: invalid condition %s (success, failure, always)", step.Name, step.When)
+		}
+		if step.Timeout != "" {
+			timeout, err := time.ParseDuration(step.Timeout)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("step %s: invalid timeout %s", step.Name, step.Timeout)
+			}
+			step.timeout = timeout
+		}
+		if step.Retries < 0 {
+			return fmt.Errorf("step %s: retries must not be negative", step.Name)
+		}
+		steps[step.Name] = step
+	}
+
+	// 按拓扑顺序逐个移除入度为 0 的步骤，剩余的步骤构成环
+	indegree := make(map[string]int)
+	for _, step := range wf.Steps {
+		for _, dep := range step.DependsOn {
+			if _, exists := steps[dep]; !exists {
+				return fmt.Errorf("step %s depends on unknown step %s", step.Name, dep)
+			}
+		}
+		indegree[step.Name] = len(step.DependsOn)
+	}
+	removed := 0
+	for progress := true; progress; {
+		progress = false
+		for _, step := range wf.Steps {
+			if indegree[step.Name] != 0 {
+				continue
+			}
+			indegree[step.Name] = -1
+			removed++
+			progress = true
+			for _, other := range wf.Steps {
+				for _, dep := range other.DependsOn {
+					if dep == step.Name {
+						indegree[other.Name]--
+					}
+				}
+			}
+		}
+	}
+	if removed != len(wf.Steps) {
+		return fmt.Errorf("workflow %s has a dependency cycle", wf.Name)
+	}
+	return nil
+}
+
+// stepState 一次运行中步骤的状态
+type stepState struct {
+	step      *WorkflowStep
+	status    StepStatus
+	taskID    int
+	attempts  int
+	startTime time.Time
+	endTime   time.Time
+	reason    string
+}
+
+// WorkflowRun 工作流的一次运行
+type WorkflowRun struct {
+	ID        int
+	File      string
+	Owner     string // 启动工作流的用户，也是各步骤任务的所有者
+	workflow  *Workflow
+	steps     []*stepState
+	byName    map[string]*stepState
+	status    string
+	startTime time.Time
+	endTime   time.Time
+}
+
+// WorkflowManager 在 TaskManager 之上按依赖关系运行工作流
+type WorkflowManager struct {
+	mu     sync.Mutex
+	tm     *TaskManager
+	runs   map[int]*WorkflowRun
+	nextID int
+}
+
+// NewWorkflowManager 创建工作流管理器
+func NewWorkflowManager(tm *TaskManager) *WorkflowManager {
+	return &WorkflowManager{tm: tm, runs: make(map[int]*WorkflowRun)}
+}
+
+// Run 以 owner 的身份开始运行工作流，返回运行 ID
+func (wm *WorkflowManager) Run(file string, wf *Workflow, owner string) int {
+	run := &WorkflowRun{File: file, Owner: owner, workflow: wf, byName: make(map[string]*stepState)}
+	for _, step := range wf.Steps {
+		state := &stepState{step: step, status: StepPending}
+		run.steps = append(run.steps, state)
+		run.byName[step.Name] = state
+	}
+
+	wm.mu.Lock()
+	wm.nextID++
+	run.ID = wm.nextID
+	wm.runs[run.ID] = run
+	run.status = "RUNNING"
+	run.startTime = time.Now()
+	wm.mu.Unlock()
+
+	go wm.execute(run)
+	return run.ID
+}
+
+// Resume 从失败的步骤继续运行，已成功的步骤不会重新运行，只有启动者和管理员可以继续
+func (wm *WorkflowManager) Resume(session command.Session, id int) error {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	run, exists := wm.runs[id]
+	if !exists {
+		return fmt.Errorf("workflow run %d not found", id)
+	}
+	if !session.Admin && run.Owner != session.User {
+		return fmt.Errorf("permission denied: workflow run %d belongs to %s", id, ownerName(run.Owner))
+	}
+	if run.status == "RUNNING" {
+		return fmt.Errorf("workflow run %d is still running", id)
+	}
+	if run.status == "SUCCEEDED" {
+		return fmt.Errorf("workflow run %d already succeeded", id)
+	}
+	for _, state := range run.steps {
+		if state.status != StepSucceeded {
+			state.status = StepPending
+			state.taskID = 0
+			state.reason = ""
+		}
+	}
+	run.status = "RUNNING"
+	run.endTime = time.Time{}
+	go wm.execute(run)
+	return nil
+}
+
+// execute 启动所有依赖已满足的步骤，直到没有可运行的步骤
+func (wm *WorkflowManager) execute(run *WorkflowRun) {
+	done := make(chan *stepState)
+	running := 0
+	for {
+		wm.mu.Lock()
+		// 跳过的步骤可能让其它步骤就绪，重复检查直到没有变化
+		for changed := true; changed; {
+			changed = false
+			for _, state := range run.steps {
+				if state.status != StepPending {
+					continue
+				}
+				ready, skip := run.ready(state)
+				if !ready {
+					continue
+				}
+				changed = true
+				if skip != "" {
+					state.status = StepSkipped
+					state.reason = skip
+					continue
+				}
+				state.status = StepRunning
+				state.startTime = time.Now()
+				state.endTime = time.Time{}
+				running++
+				go wm.runStep(run, state, done)
+			}
+		}
+		wm.mu.Unlock()
+
+		if running == 0 {
+			break
+		}
+		<-done
+		running--
+	}
+
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	run.status = "SUCCEEDED"
+	for _, state := range run.steps {
+		// 条件不满足而跳过的步骤不影响结果，因依赖失败而跳过的步骤会在恢复时重新运行
+		if state.status == StepFailed || state.status == StepPending {
+			run.status = "FAILED"
+		}
+	}
+	run.endTime = time.Now()
+}
+
+// ready 判断步骤的依赖是否都已结束，依赖结果不满足条件时返回跳过的原因，调用方需持有 mu
+func (run *WorkflowRun) ready(state *stepState) (bool, string) {
+	failed := 0
+	for _, dep := range state.step.DependsOn {
+		switch run.byName[dep].status {
+		case StepPending, StepRunning:
+			return false, ""
+		case StepFailed, StepSkipped:
+			failed++
+		}
+	}
+	switch state.step.When {
+	case WhenFailure:
+		if failed == 0 {
+			return true, "no dependency failed"
+		}
+	case WhenSuccess:
+		if failed > 0 {
+			return true, "dependency did not succeed"
+		}
+	}
+	return true, ""
+}
+
+// runStep 通过任务管理器运行一个步骤，重试由任务的重启策略完成
+func (wm *WorkflowManager) runStep(run *WorkflowRun, state *stepState, done chan<- *stepState) {
+	defer func() { done <- state }()
+	step := state.step
+
+	rw := &taskIO{reader: strings.NewReader(""), writer: io.Discard, errWriter: io.Discard}
+	opts := TaskOptions{Restart: RestartNever}
+	if step.Retries > 0 {
+		opts = TaskOptions{Restart: RestartOnFailure, MaxRetries: step.Retries}
+	}
+	opts.Owner = run.Owner
+	opts.Labels = map[string]string{"workflow": strconv.Itoa(run.ID), "step": step.Name}
+	id := wm.tm.StartTask(rw, opts, step.Command, step.Args...)
+
+	wm.mu.Lock()
+	state.taskID = id
+	wm.mu.Unlock()
+	if id == 0 {
+		wm.finishStep(state, StepFailed, "failed to start task", 0)
+		return
+	}
+
+	timedOut := false
+	if step.timeout > 0 {
+		timer := time.AfterFunc(step.timeout, func() {
+			wm.mu.Lock()
+			timedOut = true
+			wm.mu.Unlock()
+			wm.tm.KillTask(rw, systemSession, strconv.Itoa(id))
+		})
+		defer timer.Stop()
+	}
+
+	record, ok := wm.tm.WaitTask(id)
+	wm.mu.Lock()
+	expired := timedOut
+	wm.mu.Unlock()
+	switch {
+	case !ok:
+		wm.finishStep(state, StepFailed, "task record not found", 0)
+	case expired:
+		wm.finishStep(state, StepFailed, fmt.Sprintf("timed out after %s", step.timeout), record.Restarts)
+	case record.Status == TaskStatusFinished:
+		wm.finishStep(state, StepSucceeded, fmt.Sprintf("exit code %d", record.ExitCode), record.Restarts)
+	case record.Error != "":
+		wm.finishStep(state, StepFailed, record.Error, record.Restarts)
+	default:
+		wm.finishStep(state, StepFailed, fmt.Sprintf("%s, exit code %d", strings.ToLower(string(record.Status)), record.ExitCode), record.Restarts)
+	}
+}
+
+func (wm *WorkflowManager) finishStep(state *stepState, status StepStatus, reason string, restarts int) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	state.status = status
+	state.reason = reason
+	state.attempts += restarts + 1
+	state.endTime = time.Now()
+}
+
+// List 列出所有工作流运行
+func (wm *WorkflowManager) List(rw io.ReadWriter) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if len(wm.runs) == 0 {
+		fmt.Fprintln(rw, "No workflow runs")
+		return
+	}
+	runs := make([]*WorkflowRun, 0, len(wm.runs))
+	for _, run := range wm.runs {
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+
+	fmt.Fprintf(rw, "RUN\tSTATUS\tSTART\tSTEPS\tWORKFLOW\n")
+	for _, run := range runs {
+		succeeded := 0
+		for _, state := range run.steps {
+			if state.status == StepSucceeded {
+				succeeded++
+			}
+		}
+		fmt.Fprintf(rw, "%d\t%s\t%s\t%d/%d\t%s (%s)\n",
+			run.ID, run.status, run.startTime.Format("2006-01-02 15:04:05"),
+			succeeded, len(run.steps), run.workflow.Name, run.File)
+	}
+}
+
+// Status 显示一次运行中每个步骤的状态
+func (wm *WorkflowManager) Status(rw io.ReadWriter, id int) error {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	run, exists := wm.runs[id]
+	if !exists {
+		return fmt.Errorf("workflow run %d not found", id)
+	}
+
+	fmt.Fprintf(rw, "Workflow: %s (%s)\n", run.workflow.Name, run.File)
+	fmt.Fprintf(rw, "Run:      %d %s\n", run.ID, run.status)
+	fmt.Fprintf(rw, "STEP\tSTATUS\tTASK\tATTEMPTS\tDURATION\tDEPENDS ON\tRESULT\n")
+	for _, state := range run.steps {
+		task, duration := "-", "-"
+		if state.taskID != 0 {
+			task = strconv.Itoa(state.taskID)
+		}
+		if !state.startTime.IsZero() {
+			end := state.endTime
+			if end.IsZero() {
+				end = time.Now()
+			}
+			duration = end.Sub(state.startTime).Round(time.Millisecond).String()
+		}
+		deps := "-"
+		if len(state.step.DependsOn) > 0 {
+			deps = strings.Join(state.step.DependsOn, ",")
+		}
+		reason := state.reason
+		if reason == "" {
+			reason = "-"
+		}
+		fmt.Fprintf(rw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			state.step.Name, state.status, task, state.attempts, duration, deps, reason)
+	}
+	return nil
+}
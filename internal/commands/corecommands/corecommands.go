@@ -1,6 +1,9 @@
 package corecommands
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/recyvan/smf/internal/command"
 )
 
@@ -11,24 +14,58 @@ Options:
     -p, --python    Python interpreter path (default: python3)
     -e, --env       Set environment variables (format: KEY=VALUE)
     -i, --interactive Enable interactive mode
+    -t, --pty       Run in a pseudo-terminal (full-screen tools, prompts, colors)
+    --venv          Run inside a named virtualenv (see help venv)
 Examples:
     pyexec -f script.py
     pyexec -f script.py arg1 arg2
     pyexec -p /usr/local/bin/python3 -f script.py
     pyexec -e "PYTHONPATH=/custom/path" -f script.py
+    pyexec --venv etl -f script.py
     bg pyexec -f long_running.py`
+
+	runstring = `run [options] -i <interpreter> -f <script_path> [script_args...]
+Options:
+    -i, --interp      Interpreter name (bash, sh, node, perl, ruby, python or configured)
+    -f, --file        Script file path (required)
+    -p, --path        Override interpreter path
+    -e, --env         Set environment variables (format: KEY=VALUE)
+    -I, --interactive Enable interactive mode
+    -t, --pty         Run in a pseudo-terminal
+    -l, --list        List available interpreters
+Interpreters can be added in the server's -interpreters file (default interpreters.json):
+    {"interpreters": [{"name": "php", "path": "/usr/bin/php", "args": [], "env": {}}]}
+Examples:
+    run -i bash -f deploy.sh
+    run -i node -e NODE_ENV=production -f app.js
+    bg run -i perl -f watch.pl`
 )
 
 // CoreCommands 提供引擎核心命令
 type CoreCommands struct {
-	registry *command.Registry
+	registry     *command.Registry
+	interpreters *InterpreterRegistry
+	venvs        *VenvManager
 }
 
-// NewCoreCommands 创建核心命令提供者
+// NewCoreCommands 创建核心命令提供者，只包含内置解释器
 func NewCoreCommands(registry *command.Registry) *CoreCommands {
 	return &CoreCommands{
-		registry: registry,
+		registry:     registry,
+		interpreters: NewInterpreterRegistry(),
+		venvs:        NewVenvManager(DefaultVenvDir),
+	}
+}
+
+// SetInterpreterFile 从配置文件加载额外的解释器，路径为空或文件不存在时只使用内置解释器
+func (cc *CoreCommands) SetInterpreterFile(path string) error {
+	if path == "" {
+		return nil
 	}
+	if err := cc.interpreters.LoadFile(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error loading interpreters: %v", err)
+	}
+	return nil
 }
 
 // ProvideCommands 实现 command.CommandProvider 接口
@@ -39,7 +76,6 @@ func (cc *CoreCommands) ProvideCommands() []command.Ecommand {
 			Description: "Display help information for commands",
 			Usage:       "help [command]",
 			Type:        "system",
-			Background:  false,
 			Handler:     cc.handleHelp,
 		},
 		{
@@ -47,7 +83,6 @@ func (cc *CoreCommands) ProvideCommands() []command.Ecommand {
 			Description: "List all available commands",
 			Usage:       "list [-a]",
 			Type:        "system",
-			Background:  false,
 			Handler:     cc.handleList,
 		},
 		{
@@ -55,7 +90,6 @@ func (cc *CoreCommands) ProvideCommands() []command.Ecommand {
 			Description: "Show engine and system information",
 			Usage:       "info",
 			Type:        "system",
-			Background:  false,
 			Handler:     cc.handleInfo,
 		},
 		{
@@ -63,7 +97,6 @@ func (cc *CoreCommands) ProvideCommands() []command.Ecommand {
 			Description: "Display current time",
 			Usage:       "time [format]",
 			Type:        "system",
-			Background:  false,
 			Handler:     cc.handleTime,
 		},
 		{
@@ -71,7 +104,6 @@ func (cc *CoreCommands) ProvideCommands() []command.Ecommand {
 			Description: "Echo input text",
 			Usage:       "echo [text...]",
 			Type:        "system",
-			Background:  false,
 			Handler:     cc.handleEcho,
 		},
 		{
@@ -79,24 +111,44 @@ func (cc *CoreCommands) ProvideCommands() []command.Ecommand {
 			Description: "Show engine version information",
 			Usage:       "version",
 			Type:        "system",
-			Background:  false,
 			Handler:     cc.handleVersion,
 		},
 		{
-			Name:        "exec",
-			Description: "Execute system command",
-			Usage:       "exec <command> [args...]",
-			Type:        "system",
-			Handler:     cc.handleExec,
+			Name:             "exec",
+			Description:      "Execute system command",
+			Usage:            execstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundAllowed,
+			OwnTimeout:       true, // --timeout 控制运行时间
+			RunsProcess:      true,
+			Handler:          cc.handleExec,
 		},
 
 		{
-			Name:        "pyexec",
-			Description: "Execute Python scripts with various options",
-			Usage:       pyexecstring,
-			Type:        "system",
-			Background:  true, // 支持后台运行
-			Handler:     cc.handlePyExec,
+			Name:             "pyexec",
+			Description:      "Execute Python scripts with various options",
+			Usage:            pyexecstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundAllowed,
+			RunsProcess:      true,
+			Handler:          cc.handlePyExec,
+		},
+		{
+			Name:             "run",
+			Description:      "Execute scripts with any configured interpreter",
+			Usage:            runstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundAllowed,
+			RunsProcess:      true,
+			Handler:          cc.handleRun,
+		},
+		{
+			Name:             "venv",
+			Description:      "Manage Python virtualenvs for pyexec",
+			Usage:            venvstring,
+			Type:             "system",
+			BackgroundPolicy: command.BackgroundAllowed,
+			Handler:          cc.handleVenv,
 		},
 	}
 }
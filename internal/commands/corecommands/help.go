@@ -39,8 +39,8 @@ Command: %s
 Type: %s
 Description: %s
 Usage: %s
-Background: %v
-`, cmd.Name, cmd.Type, cmd.Description, cmd.Usage, cmd.Background)
+Background: %s
+`, cmd.Name, cmd.Type, cmd.Description, cmd.Usage, backgroundLabel(cmd))
 
 	fmt.Fprint(rw, cmdHelp)
 	return []byte(cmdHelp), nil
@@ -94,8 +94,11 @@ func (cc *CoreCommands) showGeneralHelp(rw io.ReadWriter) ([]byte, error) {
 			for _, cmd := range cmds {
 				// 添加背景任务标记
 				bgMark := " "
-				if cmd.Background {
+				switch cmd.Policy() {
+				case command.BackgroundAllowed:
 					bgMark = "*" // 使用星号标记支持后台运行的命令
+				case command.BackgroundRequired:
+					bgMark = "&" // 只能在后台运行的命令
 				}
 
 				fmt.Fprintf(rw, "  %s %-*s  %s\n",
@@ -109,8 +112,17 @@ func (cc *CoreCommands) showGeneralHelp(rw io.ReadWriter) ([]byte, error) {
 
 	// 添加图例说明
 	fmt.Fprintf(rw, "\nLegend:\n")
-	fmt.Fprintf(rw, "  * Command can run in background\n")
+	fmt.Fprintf(rw, "  * Command can run in background (bg <command> or end the line with &)\n")
+	fmt.Fprintf(rw, "  & Command must run in background\n")
 
 	fmt.Fprint(rw, output.String())
 	return []byte(output.String()), nil
 }
+
+// backgroundLabel 命令的后台运行策略及原因
+func backgroundLabel(cmd command.Ecommand) string {
+	if cmd.BackgroundReason == "" {
+		return string(cmd.Policy())
+	}
+	return fmt.Sprintf("%s (%s)", cmd.Policy(), cmd.BackgroundReason)
+}
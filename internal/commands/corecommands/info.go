@@ -27,7 +27,7 @@ Background: %d commands capable
 func countBackgroundCommands(registry *command.Registry) int {
 	count := 0
 	for _, cmd := range registry.List() {
-		if cmd.Background {
+		if cmd.Policy() != command.BackgroundForbidden {
 			count++
 		}
 	}
@@ -0,0 +1,95 @@
+package corecommands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DefaultInterpreterConfig 解释器配置文件默认位置
+const DefaultInterpreterConfig = "interpreters.json"
+
+// Interpreter 脚本解释器定义
+type Interpreter struct {
+	Name string            `json:"name"`           // 解释器名称，如 bash、node
+	Path string            `json:"path"`           // 解释器可执行文件路径
+	Args []string          `json:"args,omitempty"` // 放在脚本路径之前的默认参数
+	Env  map[string]string `json:"env,omitempty"`  // 默认环境变量
+}
+
+// InterpreterRegistry 解释器注册表
+type InterpreterRegistry struct {
+	sync.RWMutex
+	interpreters map[string]Interpreter
+}
+
+// NewInterpreterRegistry 创建包含内置解释器的注册表
+func NewInterpreterRegistry() *InterpreterRegistry {
+	r := &InterpreterRegistry{
+		interpreters: make(map[string]Interpreter),
+	}
+	for _, interp := range []Interpreter{
+		{Name: "bash", Path: "bash"},
+		{Name: "sh", Path: "sh"},
+		{Name: "node", Path: "node"},
+		{Name: "perl", Path: "perl"},
+		{Name: "ruby", Path: "ruby"},
+		{Name: "python", Path: "python3"},
+	} {
+		r.Register(interp)
+	}
+	return r
+}
+
+func (r *InterpreterRegistry) Register(interp Interpreter) {
+	r.Lock()
+	defer r.Unlock()
+	r.interpreters[interp.Name] = interp
+}
+
+func (r *InterpreterRegistry) Get(name string) (Interpreter, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	interp, exists := r.interpreters[name]
+	return interp, exists
+}
+
+// List 按名称排序返回所有解释器
+func (r *InterpreterRegistry) List() []Interpreter {
+	r.RLock()
+	defer r.RUnlock()
+	interps := make([]Interpreter, 0, len(r.interpreters))
+	for _, interp := range r.interpreters {
+		interps = append(interps, interp)
+	}
+	sort.Slice(interps, func(i, j int) bool {
+		return interps[i].Name < interps[j].Name
+	})
+	return interps
+}
+
+// LoadFile 从 JSON 配置文件加载解释器，同名解释器覆盖内置定义
+// 文件格式: {"interpreters": [{"name": "php", "path": "/usr/bin/php", "args": ["-d", "display_errors=1"]}]}
+func (r *InterpreterRegistry) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var config struct {
+		Interpreters []Interpreter `json:"interpreters"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse interpreter config %s: %v", path, err)
+	}
+
+	for _, interp := range config.Interpreters {
+		if interp.Name == "" || interp.Path == "" {
+			return fmt.Errorf("interpreter config %s: name and path are required", path)
+		}
+		r.Register(interp)
+	}
+	return nil
+}
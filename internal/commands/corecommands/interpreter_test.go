@@ -0,0 +1,40 @@
+package corecommands
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+func TestSetInterpreterFile(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "interpreters.json")
+	if err := os.WriteFile(config, []byte(`{"interpreters": [{"name": "php", "path": "/usr/bin/php"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cc := NewCoreCommands(command.NewRegistry())
+	if err := cc.SetInterpreterFile(config); err != nil {
+		t.Fatal(err)
+	}
+	if interp, ok := cc.interpreters.Get("php"); !ok || interp.Path != "/usr/bin/php" {
+		t.Fatalf("php interpreter = %+v, %v", interp, ok)
+	}
+
+	// 路径为空或文件不存在时只使用内置解释器
+	for _, path := range []string{"", filepath.Join(dir, "missing.json")} {
+		if err := NewCoreCommands(command.NewRegistry()).SetInterpreterFile(path); err != nil {
+			t.Fatalf("SetInterpreterFile(%q): %v", path, err)
+		}
+	}
+
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(broken, []byte(`{"interpreters": [{"name": "php"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewCoreCommands(command.NewRegistry()).SetInterpreterFile(broken); err == nil || !strings.Contains(err.Error(), "path are required") {
+		t.Fatalf("SetInterpreterFile with a broken config: %v", err)
+	}
+}
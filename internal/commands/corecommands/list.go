@@ -42,7 +42,7 @@ func (cc *CoreCommands) handleList(rw io.ReadWriter, ctx context.Context, args [
 			// Detailed view
 			for _, cmd := range cmds {
 				output.WriteString(fmt.Sprintf("  %-12s - %s\n", cmd.Name, cmd.Description))
-				output.WriteString(fmt.Sprintf("    Type: %s, Background: %v\n", cmd.Type, cmd.Background))
+				output.WriteString(fmt.Sprintf("    Type: %s, Background: %s\n", cmd.Type, cmd.Policy()))
 			}
 		} else {
 			// Simple view
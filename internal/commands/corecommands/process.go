@@ -0,0 +1,63 @@
+package corecommands
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// startCommand 在独立进程组中启动命令，并通知进程观察者
+// 独立运行的后台任务由观察者改写为通过 shim 启动
+func startCommand(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	if launcher, ok := command.DetachedLauncherFrom(ctx); ok {
+		if err := launcher.WrapCommand(cmd); err != nil {
+			return err
+		}
+	}
+	done, err := prepareCommand(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	done()
+	if err != nil {
+		return err
+	}
+	notifyStarted(ctx, cmd)
+	return nil
+}
+
+// prepareCommand 让进程观察者在启动前修改命令，返回命令启动后调用的函数
+func prepareCommand(ctx context.Context, cmd *exec.Cmd) (func(), error) {
+	if preparer, ok := command.CommandPreparerFrom(ctx); ok {
+		return preparer.PrepareCommand(cmd)
+	}
+	return func() {}, nil
+}
+
+// waitCommand 等待命令结束，并通知进程观察者
+func waitCommand(ctx context.Context, cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	notifyExited(ctx, cmd)
+	return err
+}
+
+func notifyStarted(ctx context.Context, cmd *exec.Cmd) {
+	if observer, ok := command.ProcessObserverFrom(ctx); ok {
+		observer.ProcessStarted(cmd.Process)
+	}
+}
+
+func notifyExited(ctx context.Context, cmd *exec.Cmd) {
+	if observer, ok := command.ProcessObserverFrom(ctx); ok && cmd.ProcessState != nil {
+		observer.ProcessExited(cmd.Process, cmd.ProcessState)
+	}
+}
+
+// inBackground 命令是否运行在后台任务中
+func inBackground(ctx context.Context) bool {
+	_, ok := command.ProcessObserverFrom(ctx)
+	return ok
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+
+package corecommands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup 让命令运行在独立的进程组中，终止时可以一并结束其子进程
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateProcess 向进程所在的进程组发送 SIGTERM 请求退出
+func terminateProcess(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGTERM); err == nil {
+		return nil
+	}
+	return p.Signal(syscall.SIGTERM)
+}
+
+// setCredential 设置命令以指定用户(uid 或用户名)运行
+func setCredential(cmd *exec.Cmd, name string) error {
+	u, err := user.LookupId(name)
+	if err != nil {
+		if u, err = user.Lookup(name); err != nil {
+			return fmt.Errorf("unknown user: %s", name)
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid uid: %s", u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid gid: %s", u.Gid)
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
+
+// describeProcessState 汇总退出码、信号和资源使用情况
+func describeProcessState(state *os.ProcessState) string {
+	exit := fmt.Sprintf("Exit code: %d", state.ExitCode())
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exit = fmt.Sprintf("Signal: %v", status.Signal())
+	}
+
+	usage := fmt.Sprintf("CPU: user %.3fs sys %.3fs",
+		state.UserTime().Seconds(), state.SystemTime().Seconds())
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Linux 下 Maxrss 单位为 KB
+		usage += fmt.Sprintf(", max RSS: %d KB", rusage.Maxrss)
+	}
+	return fmt.Sprintf("%s, %s", exit, usage)
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package corecommands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup Windows 下由 taskkill /T 结束子进程，无需设置
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcess 结束进程及其子进程
+func terminateProcess(p *os.Process) error {
+	return exec.Command("taskkill", "/F", "/T", "/PID", fmt.Sprint(p.Pid)).Run()
+}
+
+// setCredential Windows 下不支持切换用户
+func setCredential(cmd *exec.Cmd, name string) error {
+	return fmt.Errorf("--user is not supported on windows")
+}
+
+// describeProcessState 汇总退出码和资源使用情况
+func describeProcessState(state *os.ProcessState) string {
+	return fmt.Sprintf("Exit code: %d, CPU: user %.3fs sys %.3fs",
+		state.ExitCode(), state.UserTime().Seconds(), state.SystemTime().Seconds())
+}
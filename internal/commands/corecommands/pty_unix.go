@@ -0,0 +1,84 @@
+//go:build !windows
+
+package corecommands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/recyvan/smf/internal/command"
+	"github.com/recyvan/smf/internal/protocol"
+)
+
+// runInPty 在伪终端中运行命令并等待其退出
+// 通知客户端进入原始模式，转发按键输入和窗口大小变化，命令退出后通知客户端恢复
+func runInPty(ctx context.Context, rw io.ReadWriter, cmd *exec.Cmd) error {
+	if _, ok := command.DetachedLauncherFrom(ctx); ok {
+		return fmt.Errorf("pty mode cannot be used with detached tasks")
+	}
+	// 原始模式的切换依赖控制帧，不能处理控制帧的客户端无法进入和退出原始模式
+	if !command.SupportsFrames(rw) {
+		return fmt.Errorf("pty mode requires a client that supports control frames, run without --pty")
+	}
+	// pty.Start 会让命令成为新会话的首进程，进程组与进程 ID 相同
+	done, err := prepareCommand(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	ptmx, err := pty.Start(cmd)
+	done()
+	if err != nil {
+		return err
+	}
+	defer ptmx.Close()
+	notifyStarted(ctx, cmd)
+
+	protocol.WriteFrame(rw, protocol.FrameRawMode, "on")
+
+	// 客户端输入 -> 伪终端，客户端确认退出原始模式后结束
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		reader := protocol.NewReader(rw, func(frame protocol.Frame) bool {
+			switch frame.Kind {
+			case protocol.FrameWinsize:
+				if rows, cols, ok := protocol.ParseWinsize(frame.Payload); ok {
+					pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+				}
+			case protocol.FrameRawMode:
+				return frame.Payload != "off"
+			}
+			return true
+		})
+		io.Copy(ptmx, reader)
+	}()
+
+	// 伪终端 -> 客户端，命令退出后读取会返回错误
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		io.Copy(rw, ptmx)
+	}()
+
+	err = waitCommand(ctx, cmd)
+	select {
+	case <-outputDone:
+	case <-time.After(time.Second):
+	}
+
+	// 等待客户端确认退出原始模式，超时后中断读取；返回前输入协程必须退出，否则会读走用户的下一行命令
+	protocol.WriteFrame(rw, protocol.FrameRawMode, "off")
+	select {
+	case <-inputDone:
+	case <-time.After(2 * time.Second):
+		if restore, ok := command.InterruptRead(rw); ok {
+			<-inputDone
+			restore()
+		}
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package corecommands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// runInPty Windows 下不支持伪终端
+func runInPty(ctx context.Context, rw io.ReadWriter, cmd *exec.Cmd) error {
+	return fmt.Errorf("pty mode is not supported on windows")
+}
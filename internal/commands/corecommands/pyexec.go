@@ -8,70 +8,124 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
 )
 
-// PyExecOptions Python脚本执行选项
-type PyExecOptions struct {
-	FilePath    string            // 脚本文件路径
-	Args        []string          // 传递给脚本的参数
-	Env         map[string]string // 环境变量
-	PythonPath  string            // Python解释器路径
-	Interactive bool              // 是否交互模式
+// ScriptExecOptions 脚本执行选项，pyexec 与 run 共用
+type ScriptExecOptions struct {
+	FilePath        string            // 脚本文件路径
+	Args            []string          // 传递给脚本的参数
+	Env             map[string]string // 环境变量
+	Interpreter     string            // 解释器名称
+	InterpreterPath string            // 解释器路径，为空时使用注册表中的路径
+	Venv            string            // Python 虚拟环境名称
+	Interactive     bool              // 是否交互模式
+	Pty             bool              // 是否在伪终端中运行
 }
 
+// PyExecOptions Python脚本执行选项
+type PyExecOptions = ScriptExecOptions
+
 func (cc *CoreCommands) handlePyExec(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
-	opts, err := parsePyExecArgs(args)
+	opts, err := parseScriptArgs(args, "python")
 	if err != nil {
 		return nil, err
 	}
+	return cc.runScript(rw, ctx, opts)
+}
+
+// runScript 使用指定解释器执行脚本
+func (cc *CoreCommands) runScript(rw io.ReadWriter, ctx context.Context, opts *ScriptExecOptions) ([]byte, error) {
+	interp, exists := cc.interpreters.Get(opts.Interpreter)
+	if !exists {
+		return nil, fmt.Errorf("unknown interpreter: %s", opts.Interpreter)
+	}
+	if opts.InterpreterPath != "" {
+		interp.Path = opts.InterpreterPath
+	}
+	if opts.Venv != "" {
+		python, err := cc.venvs.Python(opts.Venv)
+		if err != nil {
+			return nil, err
+		}
+		venvEnv, _ := cc.venvs.Env(opts.Venv)
+		interp.Path = python
+		interp.Env = mergeEnv(interp.Env, venvEnv)
+	}
 
 	// 验证文件存在
 	if _, err := os.Stat(opts.FilePath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("python script not found: %s", opts.FilePath)
+		return nil, fmt.Errorf("%s script not found: %s", interp.Name, opts.FilePath)
 	}
 
-	// 构建命令
-	cmdArgs := []string{opts.FilePath}
+	// 构建命令: 解释器默认参数 + 脚本 + 脚本参数
+	cmdArgs := append([]string{}, interp.Args...)
+	cmdArgs = append(cmdArgs, opts.FilePath)
 	cmdArgs = append(cmdArgs, opts.Args...)
 
-	cmd := exec.CommandContext(ctx, opts.PythonPath, cmdArgs...)
+	cmd := exec.CommandContext(ctx, interp.Path, cmdArgs...)
+	// 取消时先向进程组发送 SIGTERM，1 秒后仍未退出再强制结束
+	cmd.Cancel = func() error {
+		return terminateProcess(cmd.Process)
+	}
+	cmd.WaitDelay = time.Second
 
-	// 设置环境变量
-	if len(opts.Env) > 0 {
+	// 设置环境变量，命令行指定的优先于解释器默认值
+	if len(interp.Env) > 0 || len(opts.Env) > 0 {
 		cmd.Env = os.Environ() // 保留现有环境变量
+		for k, v := range interp.Env {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
 		for k, v := range opts.Env {
 			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 		}
 	}
 
+	// 伪终端模式总是等待脚本结束
+	if opts.Pty {
+		if err := runInPty(ctx, rw, cmd); err != nil {
+			return nil, fmt.Errorf("%s script execution failed: %v", interp.Name, err)
+		}
+		return []byte(fmt.Sprintf("%s script finished: %s\n", interp.Name, opts.FilePath)), nil
+	}
+
 	// 设置标准输入输出
 	cmd.Stdout = rw
-	cmd.Stderr = rw
+	cmd.Stderr = command.Stderr(rw)
 
 	if opts.Interactive {
 		cmd.Stdin = rw
 	}
 
 	// 执行命令
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start python script: %v", err)
+	if err := startCommand(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("failed to start %s script: %v", interp.Name, err)
 	}
 
-	// 如果是交互模式，等待命令完成
-	if opts.Interactive {
-		if err := cmd.Wait(); err != nil {
-			return nil, fmt.Errorf("python script execution failed: %v", err)
+	// 交互模式或后台任务中等待命令完成，使任务的生命周期与脚本一致
+	if opts.Interactive || inBackground(ctx) {
+		if err := waitCommand(ctx, cmd); err != nil {
+			return nil, fmt.Errorf("%s script execution failed: %v", interp.Name, err)
 		}
+		return []byte(fmt.Sprintf("%s script finished: %s\n", interp.Name, opts.FilePath)), nil
 	}
+	// 前台非交互模式不阻塞，由后台协程回收进程
+	go cmd.Wait()
 
-	return []byte(fmt.Sprintf("Python script execution started: %s\n", opts.FilePath)), nil
+	return []byte(fmt.Sprintf("%s script execution started: %s\n", interp.Name, opts.FilePath)), nil
 }
 
-func parsePyExecArgs(args []string) (*PyExecOptions, error) {
-	opts := &PyExecOptions{
-		PythonPath: "python3",
-		Env:        make(map[string]string),
+// parseScriptArgs 解析脚本执行参数
+// interpreter 为空时表示 run 命令: -i 指定解释器，交互模式使用 -I/--interactive；
+// 否则为 pyexec 这类固定解释器的命令: -i 表示交互模式，-p 指定解释器路径
+func parseScriptArgs(args []string, interpreter string) (*ScriptExecOptions, error) {
+	opts := &ScriptExecOptions{
+		Interpreter: interpreter,
+		Env:         make(map[string]string),
 	}
+	fixed := interpreter != ""
 
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
@@ -81,11 +135,11 @@ func parsePyExecArgs(args []string) (*PyExecOptions, error) {
 			}
 			opts.FilePath = args[i+1]
 			i++
-		case "-p", "--python":
+		case "-p", "--python", "--path":
 			if i+1 >= len(args) {
-				return nil, fmt.Errorf("missing python interpreter path")
+				return nil, fmt.Errorf("missing interpreter path")
 			}
-			opts.PythonPath = args[i+1]
+			opts.InterpreterPath = args[i+1]
 			i++
 		case "-e", "--env":
 			if i+1 >= len(args) {
@@ -97,8 +151,26 @@ func parsePyExecArgs(args []string) (*PyExecOptions, error) {
 			}
 			opts.Env[parts[0]] = parts[1]
 			i++
-		case "-i", "--interactive":
+		case "-i", "--interp":
+			if fixed {
+				opts.Interactive = true
+				continue
+			}
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing interpreter name")
+			}
+			opts.Interpreter = args[i+1]
+			i++
+		case "-I", "--interactive":
 			opts.Interactive = true
+		case "-t", "--pty":
+			opts.Pty = true
+		case "--venv":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing virtualenv name")
+			}
+			opts.Venv = args[i+1]
+			i++
 		default:
 			// 如果已经找到文件路径，将剩余参数作为脚本参数
 			if opts.FilePath != "" {
@@ -107,9 +179,15 @@ func parsePyExecArgs(args []string) (*PyExecOptions, error) {
 		}
 	}
 
+	if opts.Interpreter == "" {
+		return nil, fmt.Errorf("interpreter is required (-i option)")
+	}
 	if opts.FilePath == "" {
 		return nil, fmt.Errorf("script file path is required (-f option)")
 	}
+	if opts.Venv != "" && opts.InterpreterPath != "" {
+		return nil, fmt.Errorf("--venv cannot be used with -p/--python: the virtualenv provides the interpreter")
+	}
 
 	// 转换为绝对路径
 	absPath, err := filepath.Abs(opts.FilePath)
@@ -119,3 +197,15 @@ func parsePyExecArgs(args []string) (*PyExecOptions, error) {
 
 	return opts, nil
 }
+
+// mergeEnv 合并环境变量，后者覆盖前者
+func mergeEnv(base, override map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
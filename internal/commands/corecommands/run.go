@@ -0,0 +1,33 @@
+package corecommands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// handleRun 使用任意已注册解释器执行脚本
+func (cc *CoreCommands) handleRun(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) > 0 && (args[0] == "-l" || args[0] == "--list") {
+		return cc.listInterpreters(rw)
+	}
+
+	opts, err := parseScriptArgs(args, "")
+	if err != nil {
+		return nil, err
+	}
+	return cc.runScript(rw, ctx, opts)
+}
+
+// listInterpreters 列出所有可用解释器
+func (cc *CoreCommands) listInterpreters(rw io.ReadWriter) ([]byte, error) {
+	var output strings.Builder
+	output.WriteString("Available Interpreters:\n")
+	for _, interp := range cc.interpreters.List() {
+		output.WriteString(fmt.Sprintf("  %-8s %s %s\n", interp.Name, interp.Path, strings.Join(interp.Args, " ")))
+	}
+
+	fmt.Fprint(rw, output.String())
+	return []byte(output.String()), nil
+}
@@ -2,94 +2,244 @@ package corecommands
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"runtime"
-	"syscall"
+	"strings"
 	"time"
+
+	"github.com/recyvan/smf/internal/command"
 )
 
+// defaultExecTimeout 前台 exec 默认超时时间，后台运行时默认不限制，由任务的 --timeout 控制
+var defaultExecTimeout = 30 * time.Second
+
+var execstring = `exec [options] [--] <command> [args...]
+Options:
+    --timeout <duration>  Kill the command after duration (default: 30s in foreground, none in background; "none" or 0 disables)
+    --cwd <dir>           Working directory
+    --env KEY=VALUE       Set environment variable (repeatable)
+    --clear-env           Do not inherit the server environment
+    --stdin <file>        Read standard input from file
+    --user <uid|name>     Run as another user (requires privileges)
+    --pty                 Run in a pseudo-terminal
+Examples:
+    exec ls -la
+    exec --timeout none --cwd /opt/app ./long_job.sh
+    exec --clear-env --env PATH=/usr/bin --stdin input.txt sort`
+
+// ExecOptions 系统命令执行选项
+type ExecOptions struct {
+	Name      string            // 命令名称
+	Args      []string          // 命令参数
+	Timeout   time.Duration     // 超时时间，0 表示不限制
+	Dir       string            // 工作目录
+	Env       map[string]string // 额外的环境变量
+	ClearEnv  bool              // 是否清空继承的环境变量
+	StdinFile string            // 标准输入文件
+	User      string            // 运行用户(uid 或用户名)
+	Pty       bool              // 是否在伪终端中运行
+}
+
 func (cc *CoreCommands) handleExec(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
-	if len(args) == 0 {
+	opts, err := parseExecArgs(args, inBackground(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
 		fmt.Fprint(rw, "missing command")
 		return nil, nil
 	}
-	return executeCommand(rw, ctx, args[0], args[1:]...)
+	return executeCommand(rw, ctx, opts)
 }
 
-func executeCommand(writer io.ReadWriter, ctx context.Context, cmdName string, args ...string) ([]byte, error) {
-	// 创建新的上下文，确保每次执行都是独立的
-	cmdCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+// parseExecArgs 解析 exec 参数，选项必须位于命令之前；后台运行时默认不超时
+func parseExecArgs(args []string, background bool) (*ExecOptions, error) {
+	opts := &ExecOptions{
+		Timeout: defaultExecTimeout,
+		Env:     make(map[string]string),
+	}
+	if background {
+		opts.Timeout = 0
+	}
 
-	var cmd *exec.Cmd
+	i := 0
+	for ; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			break
+		}
+		if args[i] == "--" {
+			i++
+			break
+		}
 
-	// Windows系统命令处理
-	if runtime.GOOS == "windows" {
-		if cmdName == "cmd" {
-			if len(args) < 2 {
-				fmt.Fprintf(writer, "invalid command format. Use: exec cmd /c <command>\n")
-				return nil, nil
+		// 需要取值的选项
+		value := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing value for %s", args[i])
 			}
-			cmd = exec.CommandContext(cmdCtx, cmdName, args...)
-		} else {
-			cmd = exec.CommandContext(cmdCtx, cmdName, args...)
+			i++
+			return args[i], nil
+		}
+
+		switch args[i] {
+		case "--timeout":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			timeout, err := parseTimeout(v)
+			if err != nil {
+				return nil, err
+			}
+			opts.Timeout = timeout
+		case "--cwd":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			opts.Dir = v
+		case "--env":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid environment variable format: %s", v)
+			}
+			opts.Env[parts[0]] = parts[1]
+		case "--clear-env":
+			opts.ClearEnv = true
+		case "--stdin":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			opts.StdinFile = v
+		case "--user":
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			opts.User = v
+		case "--pty":
+			opts.Pty = true
+		default:
+			return nil, fmt.Errorf("unknown exec option: %s", args[i])
 		}
-	} else {
-		cmd = exec.CommandContext(cmdCtx, cmdName, args...)
 	}
 
-	// 设置命令执行环境
-	cmd.Env = os.Environ()
+	// 伪终端的输入来自客户端的按键
+	if opts.Pty && opts.StdinFile != "" {
+		return nil, fmt.Errorf("--stdin cannot be used with --pty")
+	}
+
+	if i < len(args) {
+		opts.Name = args[i]
+		opts.Args = args[i+1:]
+	}
+	return opts, nil
+}
+
+// parseTimeout 解析超时时间，none/0 表示不限制
+func parseTimeout(v string) (time.Duration, error) {
+	if v == "none" || v == "0" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid timeout: %s", v)
+	}
+	return timeout, nil
+}
 
-	// 直接将命令的输出重定向到writer
-	cmd.Stdout = writer
-	cmd.Stderr = writer
+func executeCommand(writer io.ReadWriter, ctx context.Context, opts *ExecOptions) ([]byte, error) {
+	cmdCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
 
-	// 启动命令
-	if err := cmd.Start(); err != nil {
-		fmt.Fprintf(writer, "Failed to start command: %v\n", err)
+	// Windows系统命令处理
+	if runtime.GOOS == "windows" && opts.Name == "cmd" && len(opts.Args) < 2 {
+		fmt.Fprintf(writer, "invalid command format. Use: exec cmd /c <command>\n")
 		return nil, nil
 	}
+	cmd := exec.CommandContext(cmdCtx, opts.Name, opts.Args...)
+
+	// 超时或取消时先尝试正常终止，1 秒后仍未退出再强制结束
+	cmd.Cancel = func() error {
+		return terminateProcess(cmd.Process)
+	}
+	cmd.WaitDelay = time.Second
+
+	// 设置命令执行环境
+	if !opts.ClearEnv {
+		cmd.Env = os.Environ()
+	} else {
+		cmd.Env = []string{}
+	}
+	for k, v := range opts.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	cmd.Dir = opts.Dir
 
-	// 使用channel等待命令完成
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-		close(done)
-	}()
+	if opts.User != "" {
+		if err := setCredential(cmd, opts.User); err != nil {
+			fmt.Fprintf(writer, "Failed to set user: %v\n", err)
+			return nil, nil
+		}
+	}
 
-	// 等待命令完成或超时
-	select {
-	case err := <-done:
+	if opts.StdinFile != "" {
+		stdin, err := os.Open(opts.StdinFile)
 		if err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				// 命令执行失败但是正常退出
-				fmt.Fprintf(writer, "Command failed with exit code: %d\n", exitErr.ExitCode())
-				return nil, nil
-			}
-			// 其他错误
-			fmt.Fprintf(writer, "Command failed with error: %v\n", err)
+			fmt.Fprintf(writer, "Failed to open stdin file: %v\n", err)
 			return nil, nil
 		}
-		// 成功执行
-		fmt.Fprintf(writer, "Command completed successfully\n")
-		return nil, nil
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
 
-	case <-cmdCtx.Done():
-		// 命令执行超时，确保清理
-		if cmd.Process != nil {
-			if runtime.GOOS == "windows" {
-				exec.Command("taskkill", "/F", "/T", "/PID", fmt.Sprint(cmd.Process.Pid)).Run()
-			} else {
-				cmd.Process.Signal(syscall.SIGTERM)
-				time.Sleep(time.Second)
-				cmd.Process.Kill()
-			}
+	var err error
+	if opts.Pty {
+		// 伪终端模式下由 runInPty 负责启动命令和转发输入输出
+		err = runInPty(ctx, writer, cmd)
+	} else {
+		// 直接将命令的输出重定向到writer
+		cmd.Stdout = writer
+		cmd.Stderr = command.Stderr(writer)
+		if err = startCommand(ctx, cmd); err == nil {
+			err = waitCommand(ctx, cmd)
 		}
-		fmt.Fprintf(writer, "Command timed out after 30 seconds\n")
+	}
+
+	// 命令未能启动
+	if cmd.ProcessState == nil {
+		fmt.Fprintf(writer, "Failed to start command: %v\n", err)
 		return nil, nil
 	}
+
+	if errors.Is(cmdCtx.Err(), context.DeadlineExceeded) {
+		fmt.Fprintf(writer, "Command timed out after %v\n", opts.Timeout)
+	} else if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			// 其他错误
+			fmt.Fprintf(writer, "Command failed with error: %v\n", err)
+		} else if exitErr.ExitCode() >= 0 {
+			// 命令执行失败但是正常退出
+			fmt.Fprintf(writer, "Command failed with exit code: %d\n", exitErr.ExitCode())
+		}
+	} else {
+		// 成功执行
+		fmt.Fprintf(writer, "Command completed successfully\n")
+	}
+	fmt.Fprintln(writer, describeProcessState(cmd.ProcessState))
+	return nil, nil
 }
@@ -0,0 +1,64 @@
+//go:build linux
+
+package corecommands
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// nopObserver 模拟后台任务注入的进程观察者
+type nopObserver struct{}
+
+func (nopObserver) ProcessStarted(p *os.Process)                        {}
+func (nopObserver) ProcessExited(p *os.Process, state *os.ProcessState) {}
+
+// TestBackgroundExecHasNoDefaultTimeout 后台运行的 exec 超过默认超时时间后仍正常结束
+func TestBackgroundExecHasNoDefaultTimeout(t *testing.T) {
+	saved := defaultExecTimeout
+	defaultExecTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { defaultExecTimeout = saved })
+
+	cc := &CoreCommands{}
+	args := []string{"sleep", "0.5"}
+
+	var fg bytes.Buffer
+	if _, err := cc.handleExec(&fg, context.Background(), args); err != nil {
+		t.Fatalf("foreground exec: %v", err)
+	}
+	if !strings.Contains(fg.String(), "Command timed out") {
+		t.Fatalf("foreground exec output %q, want a timeout", fg.String())
+	}
+
+	var bg bytes.Buffer
+	ctx := command.WithProcessObserver(context.Background(), nopObserver{})
+	if _, err := cc.handleExec(&bg, ctx, args); err != nil {
+		t.Fatalf("background exec: %v", err)
+	}
+	if !strings.Contains(bg.String(), "Command completed successfully") {
+		t.Fatalf("background exec output %q, want success", bg.String())
+	}
+}
+
+func TestParseExecArgsBackgroundTimeout(t *testing.T) {
+	opts, err := parseExecArgs([]string{"sleep", "60"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Timeout != 0 {
+		t.Fatalf("background timeout is %v, want none", opts.Timeout)
+	}
+	opts, err = parseExecArgs([]string{"--timeout", "2h", "sleep", "60"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Timeout != 2*time.Hour {
+		t.Fatalf("explicit timeout is %v, want 2h", opts.Timeout)
+	}
+}
@@ -0,0 +1,262 @@
+package corecommands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/recyvan/smf/internal/command"
+)
+
+// DefaultVenvDir 虚拟环境默认存放目录
+const DefaultVenvDir = "venvs"
+
+var venvstring = `venv <subcommand> [options]
+Subcommands:
+    create <name> [--python path]   Create a virtualenv (default interpreter: python3)
+    list                            List virtualenvs
+    rm <name>                       Remove a virtualenv
+    install <name> --wheels <dir> [-r requirements.txt] [packages...]
+                                    Install packages offline from a local wheel directory
+Examples:
+    venv create etl --python /usr/bin/python3.11
+    venv install etl --wheels ./wheels -r requirements.txt
+    pyexec --venv etl -f job.py`
+
+// VenvManager 管理 Python 虚拟环境
+type VenvManager struct {
+	root string
+}
+
+// NewVenvManager 创建虚拟环境管理器
+func NewVenvManager(root string) *VenvManager {
+	return &VenvManager{root: root}
+}
+
+// Path 返回虚拟环境目录
+func (vm *VenvManager) Path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid virtualenv name: %q", name)
+	}
+	return filepath.Abs(filepath.Join(vm.root, name))
+}
+
+// Python 返回虚拟环境中的解释器路径
+func (vm *VenvManager) Python(name string) (string, error) {
+	dir, err := vm.Path(name)
+	if err != nil {
+		return "", err
+	}
+	python := filepath.Join(dir, "bin", "python")
+	if runtime.GOOS == "windows" {
+		python = filepath.Join(dir, "Scripts", "python.exe")
+	}
+	if _, err := os.Stat(python); err != nil {
+		return "", fmt.Errorf("virtualenv %s not found", name)
+	}
+	return python, nil
+}
+
+// Env 返回在虚拟环境中运行所需的环境变量
+func (vm *VenvManager) Env(name string) (map[string]string, error) {
+	python, err := vm.Python(name)
+	if err != nil {
+		return nil, err
+	}
+	binDir := filepath.Dir(python)
+	return map[string]string{
+		"VIRTUAL_ENV": filepath.Dir(binDir),
+		"PATH":        binDir + string(os.PathListSeparator) + os.Getenv("PATH"),
+	}, nil
+}
+
+func (cc *CoreCommands) handleVenv(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) == 0 {
+		fmt.Fprintln(rw, venvstring)
+		return nil, nil
+	}
+
+	switch args[0] {
+	case "create":
+		return cc.venvCreate(rw, ctx, args[1:])
+	case "list", "ls":
+		return cc.venvList(rw)
+	case "rm", "remove":
+		return cc.venvRemove(rw, args[1:])
+	case "install":
+		return cc.venvInstall(rw, ctx, args[1:])
+	default:
+		return nil, fmt.Errorf("unknown venv subcommand: %s", args[0])
+	}
+}
+
+func (cc *CoreCommands) venvCreate(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	var name string
+	python := "python3"
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-p", "--python":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing python interpreter path")
+			}
+			python = args[i+1]
+			i++
+		default:
+			name = args[i]
+		}
+	}
+
+	dir, err := cc.venvs.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("virtualenv %s already exists", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create venv directory: %v", err)
+	}
+
+	cmd := exec.CommandContext(ctx, python, "-m", "venv", dir)
+	cmd.Stdout = rw
+	cmd.Stderr = command.Stderr(rw)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to create virtualenv %s: %v", name, err)
+	}
+
+	output := fmt.Sprintf("Virtualenv %s created: %s\n", name, dir)
+	fmt.Fprint(rw, output)
+	return []byte(output), nil
+}
+
+func (cc *CoreCommands) venvList(rw io.ReadWriter) ([]byte, error) {
+	entries, err := os.ReadDir(cc.venvs.root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read venv directory: %v", err)
+	}
+
+	var output strings.Builder
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		version, ok := readVenvVersion(filepath.Join(cc.venvs.root, entry.Name(), "pyvenv.cfg"))
+		if !ok {
+			continue
+		}
+		output.WriteString(fmt.Sprintf("%s\t%s\n", entry.Name(), version))
+	}
+	if output.Len() == 0 {
+		output.WriteString("No virtualenvs\n")
+	}
+
+	fmt.Fprint(rw, output.String())
+	return []byte(output.String()), nil
+}
+
+func (cc *CoreCommands) venvRemove(rw io.ReadWriter, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		fmt.Fprint(rw, "usage: venv rm <name>")
+		return nil, nil
+	}
+	dir, err := cc.venvs.Path(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := readVenvVersion(filepath.Join(dir, "pyvenv.cfg")); !ok {
+		return nil, fmt.Errorf("virtualenv %s not found", args[0])
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to remove virtualenv %s: %v", args[0], err)
+	}
+
+	output := fmt.Sprintf("Virtualenv %s removed\n", args[0])
+	fmt.Fprint(rw, output)
+	return []byte(output), nil
+}
+
+// venvInstall 仅从本地 wheel 目录安装依赖，不访问包索引
+func (cc *CoreCommands) venvInstall(rw io.ReadWriter, ctx context.Context, args []string) ([]byte, error) {
+	if len(args) < 1 {
+		fmt.Fprint(rw, "usage: venv install <name> --wheels <dir> [-r requirements.txt] [packages...]")
+		return nil, nil
+	}
+	python, err := cc.venvs.Python(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var wheelDir string
+	var targets []string // 输出中显示的安装内容
+	pipArgs := []string{"-m", "pip", "install", "--no-index"}
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "-w", "--wheels":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing wheel directory")
+			}
+			wheelDir = args[i+1]
+			i++
+		case "-r", "--requirement":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing requirements file")
+			}
+			pipArgs = append(pipArgs, "-r", args[i+1])
+			targets = append(targets, "requirements from "+args[i+1])
+			i++
+		default:
+			pipArgs = append(pipArgs, args[i])
+			targets = append(targets, args[i])
+		}
+	}
+	if wheelDir == "" {
+		return nil, fmt.Errorf("wheel directory is required (--wheels option)")
+	}
+	if info, err := os.Stat(wheelDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("wheel directory not found: %s", wheelDir)
+	}
+	pipArgs = append(pipArgs, "--find-links", wheelDir)
+
+	cmd := exec.CommandContext(ctx, python, pipArgs...)
+	cmd.Stdout = rw
+	cmd.Stderr = command.Stderr(rw)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pip install failed: %v", err)
+	}
+
+	if len(targets) == 0 {
+		targets = append(targets, "packages")
+	}
+	output := fmt.Sprintf("Installed %s into venv %s\n", strings.Join(targets, ", "), args[0])
+	fmt.Fprint(rw, output)
+	return []byte(output), nil
+}
+
+// readVenvVersion 读取 pyvenv.cfg 中的 Python 版本
+func readVenvVersion(cfgPath string) (string, bool) {
+	file, err := os.Open(cfgPath)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	version := "unknown"
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if key == "version" || key == "version_info" {
+			version = strings.TrimSpace(value)
+		}
+	}
+	return version, true
+}
@@ -19,12 +19,12 @@ func (cc *CustomCommand) ProvideCommands() []command.Ecommand {
 	// 创建命令
 	return []command.Ecommand{
 		{
-			Name:        "test",
-			Description: "This is a test command",
-			Usage:       "test",
-			Type:        "customcommands",
-			Background:  true, // 支持后台运行
-			Handler:     cc.test,
+			Name:             "test",
+			Description:      "This is a test command",
+			Usage:            "test",
+			Type:             "customcommands",
+			BackgroundPolicy: command.BackgroundAllowed,
+			Handler:          cc.test,
 		},
 	}
 }
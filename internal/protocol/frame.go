@@ -0,0 +1,342 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 控制帧以 OSC 转义序列的形式嵌入数据流: ESC ] smf;<kind>;<payload> BEL
+// 不认识该序列的终端会直接忽略，普通文本输出不受影响
+
+const (
+	// FrameRawMode 服务端通知客户端切换终端原始模式，payload 为 on/off；
+	// 客户端退出原始模式后回送 off 作为确认
+	FrameRawMode = "raw"
+	// FrameWinsize 客户端上报终端窗口大小，payload 为 <rows>;<cols>
+	FrameWinsize = "winsize"
+	// FrameStderr 服务端发送的标准错误输出，payload 为 base64 编码的数据
+	FrameStderr = "stderr"
+	// FrameInteract 服务端通知客户端进入或结束任务交互，payload 为 on;<断开按键> 或 off；
+	// 客户端收到 off 后回送 off 作为确认
+	FrameInteract = "interact"
+	// FrameDetach 客户端识别到断开按键后通知服务端结束交互，payload 为空
+	FrameDetach = "detach"
+	// FrameNotify 服务端异步推送的后台任务事件，payload 为 base64 编码的单行文本
+	FrameNotify = "notify"
+	// FrameEscape 服务端转义的普通输出中的 ESC 字符，payload 为空；Parser 将其还原为普通数据
+	FrameEscape = "esc"
+)
+
+// DefaultDetachKeys 默认的断开交互按键
+const DefaultDetachKeys = "ctrl-]"
+
+var (
+	framePrefix = []byte("\x1b]smf;")
+	frameSuffix = byte('\a')
+)
+
+// Frame 控制帧
+type Frame struct {
+	Kind    string
+	Payload string
+}
+
+// Encode 编码控制帧，payload 中不能包含 BEL 和 ESC
+func Encode(kind, payload string) []byte {
+	buf := make([]byte, 0, len(framePrefix)+len(kind)+len(payload)+2)
+	buf = append(buf, framePrefix...)
+	buf = append(buf, kind...)
+	buf = append(buf, ';')
+	buf = append(buf, payload...)
+	return append(buf, frameSuffix)
+}
+
+// RawFrameWriter 会转义普通数据的写入器，控制帧需要通过 WriteRawFrame 原样写入
+type RawFrameWriter interface {
+	WriteRawFrame(frame []byte) error
+}
+
+// WriteFrame 向 w 写入一个控制帧
+func WriteFrame(w io.Writer, kind, payload string) error {
+	if fw, ok := w.(RawFrameWriter); ok {
+		return fw.WriteRawFrame(Encode(kind, payload))
+	}
+	_, err := w.Write(Encode(kind, payload))
+	return err
+}
+
+// EscapeWriter 将普通数据中可能被当作控制帧开头的 ESC 转义为 esc 帧，
+// 防止命令的输出伪造控制帧；控制帧通过 WriteRawFrame 原样写入
+type EscapeWriter struct {
+	w io.Writer
+}
+
+// NewEscapeWriter 创建转义普通数据的写入器
+func NewEscapeWriter(w io.Writer) *EscapeWriter {
+	return &EscapeWriter{w: w}
+}
+
+func (ew *EscapeWriter) Write(p []byte) (int, error) {
+	buf := p
+	for len(buf) > 0 {
+		i := bytes.IndexByte(buf, framePrefix[0])
+		if i < 0 {
+			break
+		}
+		// 写入的末尾可能是被截断的前缀，同样需要转义
+		rest := buf[i:]
+		if !bytes.HasPrefix(rest, framePrefix) && !bytes.HasPrefix(framePrefix, rest) {
+			if _, err := ew.w.Write(buf[:i+1]); err != nil {
+				return 0, err
+			}
+			buf = buf[i+1:]
+			continue
+		}
+		if _, err := ew.w.Write(append(buf[:i:i], Encode(FrameEscape, "")...)); err != nil {
+			return 0, err
+		}
+		buf = buf[i+1:]
+	}
+	if len(buf) > 0 {
+		if _, err := ew.w.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// WriteRawFrame 实现 RawFrameWriter，原样写入已编码的控制帧
+func (ew *EscapeWriter) WriteRawFrame(frame []byte) error {
+	_, err := ew.w.Write(frame)
+	return err
+}
+
+// EncodeWinsize 编码窗口大小
+func EncodeWinsize(rows, cols int) []byte {
+	return Encode(FrameWinsize, strconv.Itoa(rows)+";"+strconv.Itoa(cols))
+}
+
+// ParseWinsize 解析窗口大小帧的 payload
+func ParseWinsize(payload string) (rows, cols int, ok bool) {
+	r, c, found := strings.Cut(payload, ";")
+	if !found {
+		return 0, 0, false
+	}
+	rows, err1 := strconv.Atoi(r)
+	cols, err2 := strconv.Atoi(c)
+	if err1 != nil || err2 != nil || rows <= 0 || cols <= 0 {
+		return 0, 0, false
+	}
+	return rows, cols, true
+}
+
+// ParseDetachKeys 解析断开按键序列，格式与 docker 相同: 以逗号分隔的单个字符或 ctrl-<字符>，
+// 例如 ctrl-p,ctrl-q
+func ParseDetachKeys(spec string) ([]byte, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("empty detach keys")
+	}
+	var keys []byte
+	for _, key := range strings.Split(spec, ",") {
+		key = strings.TrimSpace(key)
+		if len(key) == 1 {
+			keys = append(keys, key[0])
+			continue
+		}
+		name, ok := strings.CutPrefix(strings.ToLower(key), "ctrl-")
+		if !ok || len(name) != 1 {
+			return nil, fmt.Errorf("invalid detach key: %q", key)
+		}
+		switch c := name[0]; {
+		case c >= 'a' && c <= 'z':
+			keys = append(keys, c-'a'+1)
+		case c == '@':
+			keys = append(keys, 0)
+		case c >= '[' && c <= '_':
+			keys = append(keys, c-'['+0x1b)
+		default:
+			return nil, fmt.Errorf("invalid detach key: %q", key)
+		}
+	}
+	return keys, nil
+}
+
+// DetachMatcher 在输入中查找断开按键序列，可处理跨多次读取的序列
+type DetachMatcher struct {
+	keys    []byte
+	matched int
+}
+
+// NewDetachMatcher 创建断开按键匹配器
+func NewDetachMatcher(keys []byte) *DetachMatcher {
+	return &DetachMatcher{keys: keys}
+}
+
+// Scan 返回应当转发的数据，找到完整的按键序列时 found 为 true，序列之后的数据被丢弃
+// 可能属于序列开头的按键会暂时保留，后续输入不匹配时再一并返回
+func (m *DetachMatcher) Scan(data []byte) (out []byte, found bool) {
+	for _, b := range data {
+		if b == m.keys[m.matched] {
+			m.matched++
+			if m.matched == len(m.keys) {
+				m.matched = 0
+				return out, true
+			}
+			continue
+		}
+		if m.matched > 0 {
+			out = append(out, m.keys[:m.matched]...)
+			m.matched = 0
+			if b == m.keys[0] {
+				m.matched = 1
+				continue
+			}
+		}
+		out = append(out, b)
+	}
+	return out, false
+}
+
+// StderrWriter 将写入的数据编码为标准错误帧
+type StderrWriter struct {
+	w io.Writer
+}
+
+// NewStderrWriter 创建标准错误帧写入器
+func NewStderrWriter(w io.Writer) *StderrWriter {
+	return &StderrWriter{w: w}
+}
+
+func (sw *StderrWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := WriteFrame(sw.w, FrameStderr, base64.StdEncoding.EncodeToString(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// DecodeStderr 解码标准错误帧的 payload
+func DecodeStderr(payload string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(payload)
+}
+
+// WriteNotify 向 w 写入一条事件通知帧
+func WriteNotify(w io.Writer, text string) error {
+	return WriteFrame(w, FrameNotify, base64.StdEncoding.EncodeToString([]byte(text)))
+}
+
+// DecodeNotify 解码事件通知帧的 payload
+func DecodeNotify(payload string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	return string(data), err
+}
+
+// Parser 从数据流中分离控制帧，可处理跨多次读取被截断的帧
+type Parser struct {
+	pending []byte
+}
+
+// Feed 输入一段数据，返回其中的普通数据和完整的控制帧
+func (p *Parser) Feed(data []byte) (plain []byte, frames []Frame) {
+	p.FeedFunc(data, func(b []byte) {
+		plain = append(plain, b...)
+	}, func(frame Frame) {
+		frames = append(frames, frame)
+	})
+	return plain, frames
+}
+
+// FeedFunc 输入一段数据，按出现顺序回调普通数据和控制帧
+func (p *Parser) FeedFunc(data []byte, onPlain func([]byte), onFrame func(Frame)) {
+	buf := data
+	if len(p.pending) > 0 {
+		buf = append(p.pending, data...)
+		p.pending = nil
+	}
+
+	for len(buf) > 0 {
+		start := bytes.IndexByte(buf, framePrefix[0])
+		if start < 0 {
+			onPlain(buf)
+			return
+		}
+		if start > 0 {
+			onPlain(buf[:start])
+			buf = buf[start:]
+		}
+
+		// 前缀可能被截断，保留到下一次读取
+		if len(buf) < len(framePrefix) {
+			if bytes.HasPrefix(framePrefix, buf) {
+				p.pending = append([]byte{}, buf...)
+				return
+			}
+		} else if bytes.HasPrefix(buf, framePrefix) {
+			end := bytes.IndexByte(buf, frameSuffix)
+			if end < 0 {
+				p.pending = append([]byte{}, buf...)
+				return
+			}
+			kind, payload, _ := strings.Cut(string(buf[len(framePrefix):end]), ";")
+			if kind == FrameEscape {
+				onPlain(framePrefix[:1])
+			} else {
+				onFrame(Frame{Kind: kind, Payload: payload})
+			}
+			buf = buf[end+1:]
+			continue
+		}
+
+		// 普通的 ESC 字符
+		onPlain(buf[:1])
+		buf = buf[1:]
+	}
+}
+
+// Reader 包装 io.Reader，过滤掉其中的控制帧并交给 handler 处理
+type Reader struct {
+	r       io.Reader
+	parser  Parser
+	handler func(Frame) bool
+	plain   []byte
+	stopped bool
+}
+
+// NewReader 创建过滤控制帧的 Reader，handler 返回 false 时 Reader 结束读取并返回 io.EOF
+func NewReader(r io.Reader, handler func(Frame) bool) *Reader {
+	return &Reader{r: r, handler: handler}
+}
+
+func (fr *Reader) Read(p []byte) (int, error) {
+	for len(fr.plain) == 0 {
+		if fr.stopped {
+			return 0, io.EOF
+		}
+		buf := make([]byte, len(p))
+		n, err := fr.r.Read(buf)
+		plain, frames := fr.parser.Feed(buf[:n])
+		fr.plain = append(fr.plain, plain...)
+		for _, frame := range frames {
+			if fr.handler != nil && !fr.handler(frame) {
+				fr.stopped = true
+				break
+			}
+		}
+		if err != nil {
+			if len(fr.plain) > 0 {
+				break
+			}
+			return 0, err
+		}
+	}
+
+	n := copy(p, fr.plain)
+	fr.plain = fr.plain[n:]
+	return n, nil
+}
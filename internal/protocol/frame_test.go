@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEscapeWriterBlocksForgedFrames 命令输出中伪造的控制帧被转义，客户端还原出原始内容而不会收到帧
+func TestEscapeWriterBlocksForgedFrames(t *testing.T) {
+	forged := "a\x1b]smf;raw;on\a b \x1b[1mbold\x1b[0m \x1b]smf;notify;eA==\a"
+	for _, chunks := range [][]string{
+		{forged},
+		// 前缀被拆分到两次写入中
+		{"a\x1b]sm", "f;raw;on\a b \x1b[1mbold\x1b[0m \x1b", "]smf;notify;eA==\a"},
+	} {
+		var stream bytes.Buffer
+		ew := NewEscapeWriter(&stream)
+		for _, chunk := range chunks {
+			if n, err := ew.Write([]byte(chunk)); err != nil || n != len(chunk) {
+				t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+			}
+		}
+		if err := WriteFrame(ew, FrameRawMode, "off"); err != nil {
+			t.Fatal(err)
+		}
+
+		var parser Parser
+		plain, frames := parser.Feed(stream.Bytes())
+		if string(plain) != forged {
+			t.Fatalf("plain = %q, want %q", plain, forged)
+		}
+		if len(frames) != 1 || frames[0] != (Frame{Kind: FrameRawMode, Payload: "off"}) {
+			t.Fatalf("frames = %v, want only the real raw off frame", frames)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrReadInterrupted 阻塞中的 Read 被 Interrupt 中断
+var ErrReadInterrupted = errors.New("read interrupted")
+
+// InterruptibleReader 由单独的协程读取底层 io.Reader，阻塞中的 Read 可以被中断而不丢失数据；
+// 用于命令在协程中读取连接时，命令返回前让该协程退出，避免吞掉用户输入的下一行命令
+type InterruptibleReader struct {
+	data    chan []byte
+	done    chan struct{}
+	err     error // 底层读取结束的错误，data 关闭后有效
+	pending []byte
+
+	mu        sync.Mutex
+	interrupt chan struct{}
+	closeOnce sync.Once
+}
+
+// NewInterruptibleReader 创建 InterruptibleReader 并开始读取 r
+func NewInterruptibleReader(r io.Reader) *InterruptibleReader {
+	ir := &InterruptibleReader{
+		data:      make(chan []byte),
+		done:      make(chan struct{}),
+		interrupt: make(chan struct{}),
+	}
+	go ir.pump(r)
+	return ir
+}
+
+// pump 读取底层 io.Reader，每次读到的数据交给下一次 Read
+func (ir *InterruptibleReader) pump(r io.Reader) {
+	defer close(ir.data)
+	for {
+		buf := make([]byte, 4096)
+		n, err := r.Read(buf)
+		if n > 0 {
+			select {
+			case ir.data <- buf[:n]:
+			case <-ir.done:
+				return
+			}
+		}
+		if err != nil {
+			ir.err = err
+			return
+		}
+	}
+}
+
+func (ir *InterruptibleReader) Read(p []byte) (int, error) {
+	if len(ir.pending) == 0 {
+		ir.mu.Lock()
+		interrupt := ir.interrupt
+		ir.mu.Unlock()
+		select {
+		case chunk, ok := <-ir.data:
+			if !ok {
+				if ir.err == nil {
+					return 0, io.EOF
+				}
+				return 0, ir.err
+			}
+			ir.pending = chunk
+		case <-interrupt:
+			return 0, ErrReadInterrupted
+		case <-ir.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, ir.pending)
+	ir.pending = ir.pending[n:]
+	return n, nil
+}
+
+// Interrupt 让阻塞中和之后的 Read 立即返回 ErrReadInterrupted，已读到的数据留给恢复后的 Read；
+// 等待读取的协程退出后调用返回的函数恢复读取
+func (ir *InterruptibleReader) Interrupt() (restore func()) {
+	ir.mu.Lock()
+	close(ir.interrupt)
+	ir.mu.Unlock()
+	return func() {
+		ir.mu.Lock()
+		ir.interrupt = make(chan struct{})
+		ir.mu.Unlock()
+	}
+}
+
+// Close 停止读取底层 io.Reader，底层连接需由调用方关闭
+func (ir *InterruptibleReader) Close() error {
+	ir.closeOnce.Do(func() { close(ir.done) })
+	return nil
+}
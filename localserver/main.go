@@ -11,7 +11,6 @@ import (
 
 	"io"
 	"os"
-	"strings"
 
 	"github.com/recyvan/smf/internal/commands/backgroundcommands"
 )
@@ -38,6 +37,11 @@ func (rw *ReadWriter) Write(p []byte) (n int, err error) {
 	return rw.Writer.Write(p)
 }
 
+// Stderr 本地运行时标准错误直接输出到终端的 stderr
+func (rw *ReadWriter) Stderr() io.Writer {
+	return os.Stderr
+}
+
 // PluginCommandProvider 插件命令提供者
 type PluginCommandProvider struct {
 	commands []command.Ecommand
@@ -54,7 +58,7 @@ func main() {
 	engine_1 := command.NewLocalEngine()
 
 	// 创建TaskManager
-	_, err := backgroundcommands.NewTaskManager(10)
+	_, err := backgroundcommands.NewTaskManager(10, engine_1.CmdRegistry)
 	if err != nil {
 		fmt.Printf("Error creating task manager: %v\n", err)
 		os.Exit(1)
@@ -67,6 +71,9 @@ func main() {
 	customCommands := customcommands.NewCustomCommands()
 	// 创建并添加核心命令提供者
 	coreCommands := corecommands.NewCoreCommands(engine_1.CmdRegistry)
+	if err := coreCommands.SetInterpreterFile(corecommands.DefaultInterpreterConfig); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
 	// 注册并包装命令
 	// 添加提供者到自动注册器
 	engine_1.AutoReg.AddProvider(basicCommands)
@@ -95,8 +102,12 @@ func main() {
 			break
 		}
 
-		input := scanner.Text()
-		parts := strings.Fields(input)
+		input, background := command.CutBackground(scanner.Text())
+		parts, err := command.SplitArgs(input)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
 		if len(parts) == 0 {
 			continue
 		}
@@ -109,7 +120,10 @@ func main() {
 
 		cmd, exists := engine_1.CmdRegistry.Get(cmdName)
 		if exists {
-			_, err := cmd.Handler(rw, context.Background(), args)
+			cmd, args, err := engine_1.CmdRegistry.Prepare(cmd, args, background)
+			if err == nil {
+				_, err = cmd.Handler(rw, context.Background(), args)
+			}
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 			}